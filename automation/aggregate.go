@@ -0,0 +1,373 @@
+/*
+ * Environment quantities measured by more than one sensor.
+ *
+ * The quantities: section of the rules file is a list, each of which has
+ *	name:		for the log
+ *	publish:	topic for the result.  The names of the sensors that
+ *			went into it are published on <topic>/$sources.
+ *	format:		a printf format for the result, default "%.1f"
+ *	policy:		how sensors are combined.  One of
+ *			  median: the median of the sensors.  The default.
+ *			  min: the lowest sensor
+ *			  max: the highest sensor
+ *			  primary: the first sensor listed that is usable,
+ *				so later ones are failovers
+ *	outlier:	a sensor more than this from the median of all the
+ *			sensors is left out.  Needs at least three usable
+ *			sensors.  0, the default, leaves nothing out.
+ *	filter:		the sensor filter for the result, as in filter.go,
+ *			without updated:.  Sensors whose time-last-update is
+ *			older than stale: are not used.
+ *	sensors:	list of sensors, each with
+ *			  name: for $sources and the log
+ *			  value: topic of the reading
+ *			  updated: topic of the time-last-update
+ *			  outlier: this sensor's outlier limit, if not the
+ *				quantity's
+ *			  min:, max: readings outside these are left out
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultQuantityFormat = "%.1f"
+
+type quantityConfig struct {
+	Name    string             `yaml:"name"`
+	Publish string             `yaml:"publish"`
+	Format  string             `yaml:"format"`
+	Policy  string             `yaml:"policy"`
+	Outlier float64            `yaml:"outlier"`
+	Filter  sensorFilterConfig `yaml:"filter"`
+	Sensors []sensorConfig     `yaml:"sensors"`
+}
+
+type sensorConfig struct {
+	Name    string   `yaml:"name"`
+	Value   string   `yaml:"value"`
+	Updated string   `yaml:"updated"`
+	Outlier *float64 `yaml:"outlier"`
+	Min     *float64 `yaml:"min"`
+	Max     *float64 `yaml:"max"`
+}
+
+type sensorType struct {
+	name     string
+	value    string
+	updated  string
+	outlier  float64
+	min      *float64
+	max      *float64
+	rejected bool // left out as an outlier last time
+}
+
+type quantityType struct {
+	name    string
+	publish string
+	format  string
+	policy  string
+	sensors []*sensorType
+	filter  *sensorFilterType
+
+	last    float64 // the last aggregate
+	sources string  // the sensors in it
+	valid   bool
+}
+
+// a usable reading
+type candidateType struct {
+	sensor  *sensorType
+	value   float64
+	updated time.Time
+}
+
+var policies = map[string]bool{
+	"median":  true,
+	"min":     true,
+	"max":     true,
+	"primary": true,
+}
+
+func compileQuantity(qc quantityConfig) (*quantityType, error) {
+	var err error
+
+	q := new(quantityType)
+	q.name = qc.Name
+	q.publish = qc.Publish
+	if q.publish == "" {
+		return nil, fmt.Errorf("has nothing to publish to")
+	}
+
+	q.format = qc.Format
+	if q.format == "" {
+		q.format = defaultQuantityFormat
+	}
+
+	q.policy = qc.Policy
+	if q.policy == "" {
+		q.policy = "median"
+	}
+	if !policies[q.policy] {
+		return nil, fmt.Errorf("policy %s is not median, min, max or primary", q.policy)
+	}
+	if qc.Outlier < 0 {
+		return nil, fmt.Errorf("negative outlier")
+	}
+
+	if qc.Filter.Updated != "" {
+		return nil, fmt.Errorf("filter takes updated from the sensors")
+	}
+	q.filter, err = newSensorFilter(qc.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %v", err)
+	}
+
+	if len(qc.Sensors) < 1 {
+		return nil, fmt.Errorf("has no sensors")
+	}
+	names := make(map[string]bool)
+	for i, sc := range qc.Sensors {
+		s := new(sensorType)
+		s.name = sc.Name
+		if s.name == "" {
+			s.name = strconv.Itoa(i + 1)
+		}
+		if names[s.name] {
+			return nil, fmt.Errorf("sensor %s listed twice", s.name)
+		}
+		names[s.name] = true
+
+		s.value = sc.Value
+		s.updated = sc.Updated
+		if s.value == "" || s.updated == "" {
+			return nil, fmt.Errorf("sensor %s needs value and updated", s.name)
+		}
+		if strings.ContainsAny(s.value+s.updated, "+#") {
+			return nil, fmt.Errorf("sensor %s topics may not have wildcards", s.name)
+		}
+
+		s.outlier = qc.Outlier
+		if sc.Outlier != nil {
+			if *sc.Outlier < 0 {
+				return nil, fmt.Errorf("sensor %s has negative outlier", s.name)
+			}
+			s.outlier = *sc.Outlier
+		}
+		s.min = sc.Min
+		s.max = sc.Max
+		q.sensors = append(q.sensors, s)
+	}
+	return q, nil
+}
+
+// The topics the quantity needs to see
+func (q *quantityType) topics() []string {
+	var topics []string
+
+	for _, s := range q.sensors {
+		topics = append(topics, s.value, s.updated)
+	}
+	return topics
+}
+
+// Does a message on this topic concern the quantity?  If so, is it a reading?
+func (q *quantityType) uses(topic string) (used, reading bool) {
+	for _, s := range q.sensors {
+		if topic == s.value {
+			return true, true
+		}
+		if topic == s.updated {
+			used = true
+		}
+	}
+	return used, false
+}
+
+// The readings that may be used: numbers, in range, and fresh
+func (q *quantityType) candidates(e *engineType, now time.Time) []candidateType {
+	var candidates []candidateType
+
+	for _, s := range q.sensors {
+		v, err := strconv.ParseFloat(e.values[s.value], 64)
+		if err != nil {
+			continue
+		}
+		if (s.min != nil && v < *s.min) || (s.max != nil && v > *s.max) {
+			continue
+		}
+		updated := e.deviceTime(s.updated)
+		if q.filter.stale > 0 && (updated.IsZero() || now.Sub(updated) > q.filter.stale) {
+			continue
+		}
+		candidates = append(candidates, candidateType{sensor: s, value: v, updated: updated})
+	}
+	return candidates
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Leave out sensors too far from the median
+func (q *quantityType) rejectOutliers(candidates []candidateType) []candidateType {
+	var (
+		kept   []candidateType
+		values []float64
+	)
+
+	if len(candidates) < 3 {
+		for _, c := range candidates {
+			c.sensor.rejected = false
+		}
+		return candidates
+	}
+
+	for _, c := range candidates {
+		values = append(values, c.value)
+	}
+	m := median(values)
+
+	for _, c := range candidates {
+		rejected := false
+		if c.sensor.outlier > 0 {
+			rejected = math.Abs(c.value-m) > c.sensor.outlier
+			if rejected && !c.sensor.rejected {
+				logMessage(fmt.Sprintf("Quantity %s: sensor %s reading %v is an outlier, median %v",
+					q.name, c.sensor.name, c.value, m))
+			}
+		}
+		if !rejected && c.sensor.rejected {
+			logMessage(fmt.Sprintf("Quantity %s: sensor %s back in line", q.name, c.sensor.name))
+		}
+		c.sensor.rejected = rejected
+		if !rejected {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+/*
+ * Combine the sensors.  Returns the value, the sensors used, and the
+ * newest time-last-update among them.
+ */
+func (q *quantityType) aggregate(e *engineType, now time.Time) (float64, []string, time.Time, bool) {
+	var (
+		used    []candidateType
+		value   float64
+		names   []string
+		updated time.Time
+	)
+
+	candidates := q.rejectOutliers(q.candidates(e, now))
+	if len(candidates) < 1 {
+		return 0, nil, updated, false
+	}
+
+	switch q.policy {
+	case "median":
+		var values []float64
+		for _, c := range candidates {
+			values = append(values, c.value)
+		}
+		value = median(values)
+		used = candidates
+	case "min", "max":
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if (q.policy == "min" && c.value < best.value) || (q.policy == "max" && c.value > best.value) {
+				best = c
+			}
+		}
+		value = best.value
+		used = []candidateType{best}
+	case "primary":
+		// candidates are in the order listed
+		value = candidates[0].value
+		used = candidates[:1]
+	}
+
+	for _, c := range used {
+		names = append(names, c.sensor.name)
+		if c.updated.After(updated) {
+			updated = c.updated
+		}
+	}
+	return value, names, updated, true
+}
+
+// The newest time-last-update of any sensor
+func (q *quantityType) newest(e *engineType) time.Time {
+	var newest time.Time
+
+	for _, s := range q.sensors {
+		if t := e.deviceTime(s.updated); t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+/*
+ * A sensor reading or time-last-update has arrived.  A time-last-update
+ * only matters if it changes the result, as when a sensor comes back.
+ */
+func (q *quantityType) handleMessage(e *engineType, reading bool, now time.Time) {
+	value, names, updated, ok := q.aggregate(e, now)
+	if !ok {
+		return
+	}
+
+	sources := strings.Join(names, ",")
+	if !reading && q.valid && value == q.last && sources == q.sources {
+		return
+	}
+	q.last = value
+	q.sources = sources
+	q.valid = true
+
+	if out, ok := q.filter.reading(value, updated, now); ok {
+		q.output(e, out, sources)
+	}
+}
+
+func (q *quantityType) tick(e *engineType, now time.Time) {
+	out, ok := q.filter.tick(q.newest(e), now)
+	if !ok {
+		return
+	}
+	if out == "unknown" {
+		logMessage(fmt.Sprintf("Quantity %s: no sensor updated in %v, now unknown", q.name, q.filter.unknown))
+		q.valid = false
+		q.output(e, out, "")
+		return
+	}
+	q.output(e, out, q.sources)
+}
+
+// Publish the result, and the sources if they changed
+func (q *quantityType) output(e *engineType, out, sources string) {
+	if v, err := strconv.ParseFloat(out, 64); err == nil {
+		out = fmt.Sprintf(q.format, v)
+	}
+	e.publish(q.publish, out, true)
+
+	sourcesTopic := q.publish + "/$sources"
+	if e.values[sourcesTopic] != sources {
+		e.publish(sourcesTopic, sources, true)
+	}
+}
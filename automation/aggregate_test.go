@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+const testQuantities = `
+quantities:
+  - name: temp
+    publish: environment/temp
+    policy: %s
+    outlier: 3
+    filter: {stale: 3m, unknown: 10m}
+    sensors:
+      - {name: east, value: east/temp, updated: east/updated}
+      - {name: north, value: north/temp, updated: north/updated, max: 60}
+      - {name: south, value: south/temp, updated: south/updated}
+rules: []
+`
+
+func testQuantity(t *testing.T, policy string) (*engineType, *fakeClient) {
+	fullLogFileName = os.DevNull
+
+	config, err := parseRules([]byte(fmt.Sprintf(testQuantities, policy)))
+	if err != nil {
+		t.Fatalf("Cannot parse quantities: %v", err)
+	}
+	c := new(fakeClient)
+	e := newEngine(c, config)
+	if err := e.subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return e, c
+}
+
+// send a reading and its time-last-update
+func sendReading(e *engineType, c *fakeClient, sensor, value string, updated, now time.Time) {
+	send(e, c, sensor+"/updated", iotTime(updated), now)
+	send(e, c, sensor+"/temp", value, now)
+}
+
+func TestAggregatePolicies(t *testing.T) {
+	var tests = []struct {
+		policy  string
+		value   string
+		sources string
+	}{
+		{"median", "20.0", "east,north,south"},
+		{"min", "19.0", "north"},
+		{"max", "21.0", "south"},
+		{"primary", "20.0", "east"},
+	}
+
+	for _, test := range tests {
+		e, c := testQuantity(t, test.policy)
+		now := time.Now().Truncate(time.Second)
+
+		sendReading(e, c, "east", "20", now, now)
+		sendReading(e, c, "north", "19", now, now)
+		sendReading(e, c, "south", "21", now, now)
+		expect(t, c, "environment/temp", test.value)
+		expect(t, c, "environment/temp/$sources", test.sources)
+	}
+}
+
+func TestAggregateFailover(t *testing.T) {
+	e, c := testQuantity(t, "primary")
+	start := time.Now().Truncate(time.Second)
+
+	sendReading(e, c, "east", "20", start, start)
+	sendReading(e, c, "north", "19", start, start)
+	expect(t, c, "environment/temp", "20.0")
+	expect(t, c, "environment/temp/$sources", "east")
+
+	// east stops updating
+	now := start.Add(4 * time.Minute)
+	sendReading(e, c, "north", "18", now, now)
+	expect(t, c, "environment/temp", "18.0")
+	expect(t, c, "environment/temp/$sources", "north")
+
+	// and comes back
+	sendReading(e, c, "east", "21", now, now)
+	expect(t, c, "environment/temp", "21.0")
+	expect(t, c, "environment/temp/$sources", "east")
+}
+
+func TestAggregateOutliers(t *testing.T) {
+	e, c := testQuantity(t, "median")
+	now := time.Now().Truncate(time.Second)
+
+	sendReading(e, c, "east", "20", now, now)
+	sendReading(e, c, "north", "21", now, now)
+	sendReading(e, c, "south", "35", now, now)
+	expect(t, c, "environment/temp", "20.5")
+	expect(t, c, "environment/temp/$sources", "east,north")
+
+	// out of north's range
+	sendReading(e, c, "south", "22", now, now)
+	sendReading(e, c, "north", "99", now, now)
+	expect(t, c, "environment/temp", "21.0")
+	expect(t, c, "environment/temp/$sources", "east,south")
+
+	// with only two sensors, neither can be called an outlier
+	sendReading(e, c, "east", "10", now, now)
+	expect(t, c, "environment/temp", "16.0")
+}
+
+func TestAggregateUnknown(t *testing.T) {
+	e, c := testQuantity(t, "median")
+	start := time.Now().Truncate(time.Second)
+
+	sendReading(e, c, "east", "20", start, start)
+	sendReading(e, c, "south", "22", start.Add(time.Minute), start.Add(time.Minute))
+	expect(t, c, "environment/temp", "21.0")
+
+	e.tick(start.Add(11 * time.Minute))
+	expect(t, c, "environment/temp", "21.0")
+	e.tick(start.Add(11*time.Minute + time.Second))
+	expect(t, c, "environment/temp", "unknown")
+	expect(t, c, "environment/temp/$sources", "")
+}
+
+func TestBadQuantities(t *testing.T) {
+	var tests = []string{
+		"quantities: [{name: a, sensors: [{value: a, updated: b}]}]",
+		"quantities: [{name: a, publish: x, sensors: []}]",
+		"quantities: [{name: a, publish: x, policy: mean, sensors: [{value: a, updated: b}]}]",
+		"quantities: [{name: a, publish: x, sensors: [{value: a}]}]",
+		"quantities: [{name: a, publish: x, sensors: [{value: a/+, updated: b}]}]",
+		"quantities: [{name: a, publish: x, sensors: [{name: s, value: a, updated: b}, {name: s, value: c, updated: d}]}]",
+		"quantities: [{name: a, publish: x, filter: {updated: u}, sensors: [{value: a, updated: b}]}]",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("Quantity should have been rejected: %s", test)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * R1: the alarm state machine.
+ *
+ * The alarm panel's state is passed on to the environment, but only
+ * while the alarm detector is on line.  When the detector goes off line
+ * the environment state is "unknown".  When it comes back, the last
+ * state the panel reported is passed on.
+ *
+ * Panel and detector messages are both handled by the engine go routine,
+ * so they can never race.
+ *
+ * The alarm: section of the rules file has
+ *	state:		topic of the panel's alarm state
+ *	detector:	topic of the detector's homie $state
+ *	publish:	topic for the environment alarm state
+ *
+ * With each state published, these are published too, all retained:
+ *	<publish>/$reason:	reported, the panel reported a new state
+ *				detector-offline, the detector went off line
+ *				detector-online, the detector came back
+ *	<publish>/$detector:	the detector's homie state
+ *	<publish>/$changed:	when, e.g. 2026-10-18T23:01:02-04:00
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type alarmConfig struct {
+	State    string `yaml:"state"`
+	Detector string `yaml:"detector"`
+	Publish  string `yaml:"publish"`
+}
+
+const (
+	DET_UNKNOWN int = 1 + iota
+	DET_ONLINE
+	DET_OFFLINE
+)
+
+// The alarm states the panel may report
+var alarmStates = map[string]bool{
+	"disarmed":        true,
+	"armed-stay":      true,
+	"armed-away":      true,
+	"alarmed-burglar": true,
+	"alarmed-fire":    true,
+	"unknown":         true,
+}
+
+// Homie device states
+var stateMap = map[string]int{
+	"init":         DET_OFFLINE,
+	"ready":        DET_ONLINE,
+	"disconnected": DET_OFFLINE,
+	"sleeping":     DET_OFFLINE,
+	"lost":         DET_OFFLINE,
+	"alert":        DET_OFFLINE,
+}
+
+type alarmType struct {
+	stateTopic    string
+	detectorTopic string
+	publish       string
+
+	detState         int
+	detStateDetailed string
+	lastAlarmState   string
+}
+
+func compileAlarm(ac alarmConfig) (*alarmType, error) {
+	if ac.State == "" || ac.Detector == "" || ac.Publish == "" {
+		return nil, fmt.Errorf("needs state, detector and publish")
+	}
+
+	a := new(alarmType)
+	a.stateTopic = ac.State
+	a.detectorTopic = ac.Detector
+	a.publish = ac.Publish
+	a.detState = DET_UNKNOWN
+	a.detStateDetailed = "unknown"
+	a.lastAlarmState = "unknown"
+	return a, nil
+}
+
+func (a *alarmType) topics() []string {
+	return []string{a.stateTopic, a.detectorTopic}
+}
+
+func (a *alarmType) handleMessage(e *engineType, topic, payload string, now time.Time) {
+	switch topic {
+	case a.stateTopic:
+		a.alarmMessage(e, payload, now)
+	case a.detectorTopic:
+		a.detectorMessage(e, payload, now)
+	}
+}
+
+// The panel reported a state
+func (a *alarmType) alarmMessage(e *engineType, payload string, now time.Time) {
+	if !alarmStates[payload] {
+		logMessage("Invalid device alarm state: " + payload)
+		return
+	}
+
+	logMessage("Alarm state: " + payload)
+	a.lastAlarmState = payload
+	if a.detState == DET_ONLINE {
+		a.output(e, payload, "reported", now)
+	}
+}
+
+// The detector's homie state changed
+func (a *alarmType) detectorMessage(e *engineType, payload string, now time.Time) {
+	if a.detStateDetailed != payload {
+		a.detStateDetailed = payload
+		logMessage("Alarm Detector online state: " + payload)
+	}
+
+	newState, ok := stateMap[payload]
+	if !ok {
+		newState = DET_UNKNOWN
+	}
+	if newState == a.detState {
+		return
+	}
+
+	a.detState = newState
+	if newState == DET_ONLINE {
+		a.output(e, a.lastAlarmState, "detector-online", now)
+	} else {
+		a.output(e, "unknown", "detector-offline", now)
+	}
+}
+
+func (a *alarmType) output(e *engineType, state, reason string, now time.Time) {
+	e.publish(a.publish+"/$reason", reason, true)
+	e.publish(a.publish+"/$detector", a.detStateDetailed, true)
+	e.publish(a.publish+"/$changed", now.Format(time.RFC3339), true)
+	e.publish(a.publish, state, true)
+}
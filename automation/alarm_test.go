@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	stateTopic    = "devices/alarm-state-0001/alarm-state/state"
+	detectorTopic = "devices/alarm-state-0001/$state"
+)
+
+type alarmEvent struct {
+	topic   string
+	payload string
+}
+
+var alarmEvents = []alarmEvent{
+	{detectorTopic, "ready"},
+	{stateTopic, "armed-away"},
+	{detectorTopic, "lost"},
+	{stateTopic, "disarmed"},
+	{stateTopic, "bogus"},
+}
+
+// Every order of the events
+func permutations(events []alarmEvent) [][]alarmEvent {
+	if len(events) <= 1 {
+		return [][]alarmEvent{events}
+	}
+
+	var result [][]alarmEvent
+	for i := range events {
+		rest := append(append([]alarmEvent(nil), events[:i]...), events[i+1:]...)
+		for _, p := range permutations(rest) {
+			result = append(result, append([]alarmEvent{events[i]}, p...))
+		}
+	}
+	return result
+}
+
+func testAlarm(t *testing.T) (*engineType, *fakeClient) {
+	fullLogFileName = os.DevNull
+
+	config, err := parseRules([]byte(`
+alarm:
+  state: devices/alarm-state-0001/alarm-state/state
+  detector: devices/alarm-state-0001/$state
+  publish: environment/alarm-state
+rules: []
+`))
+	if err != nil {
+		t.Fatalf("Cannot parse alarm: %v", err)
+	}
+	c := new(fakeClient)
+	return newEngine(c, config), c
+}
+
+func (c *fakeClient) count(topic string) int {
+	n := 0
+	for _, p := range c.published {
+		if p.topic == topic {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+ * Run every order of the events.  After each one, what is published
+ * must be what a simple model of the rule says.
+ */
+func TestAlarmInterleaving(t *testing.T) {
+	for _, order := range permutations(alarmEvents) {
+		e, c := testAlarm(t)
+		now := time.Now()
+
+		detector := "" // the model
+		lastAlarm := "unknown"
+
+		for step, event := range order {
+			before := c.count("environment/alarm-state")
+			wasOnline := detector == "ready"
+			wasKnown := detector != ""
+			e.handleMessage(event.topic, event.payload, now)
+
+			reason := ""
+			if event.topic == detectorTopic {
+				detector = event.payload
+				if !wasKnown || wasOnline != (detector == "ready") {
+					reason = "detector-offline"
+					if detector == "ready" {
+						reason = "detector-online"
+					}
+				}
+			} else if alarmStates[event.payload] {
+				lastAlarm = event.payload
+				if detector == "ready" {
+					reason = "reported"
+				}
+			}
+
+			published := c.count("environment/alarm-state") > before
+			if published != (reason != "") {
+				t.Fatalf("Order %v step %d: published %v, expected %v", order, step, published, reason != "")
+			}
+			if !published {
+				continue
+			}
+
+			want := "unknown"
+			if detector == "ready" {
+				want = lastAlarm
+			}
+			expect(t, c, "environment/alarm-state", want)
+			expect(t, c, "environment/alarm-state/$reason", reason)
+			expect(t, c, "environment/alarm-state/$detector", detector)
+			expect(t, c, "environment/alarm-state/$changed", now.Format(time.RFC3339))
+		}
+	}
+}
+
+// The reason is published before the state, so is current when the state arrives
+func TestAlarmReasonFirst(t *testing.T) {
+	e, c := testAlarm(t)
+	now := time.Now()
+
+	e.handleMessage(detectorTopic, "ready", now)
+	e.handleMessage(stateTopic, "armed-stay", now)
+
+	reason := ""
+	for _, p := range c.published {
+		switch p.topic {
+		case "environment/alarm-state/$reason":
+			reason = p.payload
+		case "environment/alarm-state":
+			if p.payload == "armed-stay" && reason != "reported" {
+				t.Fatalf("armed-stay published with reason %s", reason)
+			}
+		}
+	}
+}
+
+// Messages from mqtt's go routines are serialized by the engine
+func TestAlarmConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	e, c := testAlarm(t)
+	con, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		e.run(con)
+		close(done)
+	}()
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			e.messages <- messageType{topic: detectorTopic, payload: "lost"}
+			e.messages <- messageType{topic: detectorTopic, payload: "ready"}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			e.messages <- messageType{topic: stateTopic, payload: "armed-away"}
+			e.messages <- messageType{topic: stateTopic, payload: "armed-stay"}
+		}
+	}()
+	wg.Wait()
+
+	for len(e.messages) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	expect(t, c, "environment/alarm-state", "armed-stay")
+}
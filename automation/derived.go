@@ -0,0 +1,375 @@
+/*
+ * Values derived from the outdoor environment.
+ *
+ * The derived: section of the rules file has
+ *	temp:		topic of the temperature
+ *	humidity:	topic of the relative humidity, in percent
+ *	pressure:	topic of the barometric pressure
+ *	wind:		topic of the wind speed
+ *	temp-units:	C or F, the units of temp.  Default F.
+ *	units:		C or F, the units of what is published.  Default F.
+ *	wind-units:	mph, kmh or ms, the units of wind.  Default mph.
+ *	publish:	prefix of the topics published, default "environment"
+ *	format:		printf format for what is published, default "%.1f"
+ *	rate-window:	temperature rate of change is over this, default 1h
+ *	trend-window:	pressure trend is over this, default 3h
+ *	steady:		a pressure change less than this is steady, default 1
+ *	frost-temp:	frost is a risk at or below this temperature, if the
+ *			dew point is at or below frost-dew-point.  Defaults
+ *			3C and 0C.  At or below freezing is always a risk.
+ *
+ * Only temp is needed.  What is published depends on what is given:
+ *	<publish>/dew-point		temp and humidity
+ *	<publish>/heat-index		temp and humidity
+ *	<publish>/wind-chill		temp and wind
+ *	<publish>/temp-rate		temp.  Degrees per hour.
+ *	<publish>/pressure-trend	pressure.  Change over the trend window.
+ *	<publish>/pressure-tendency	pressure.  rising, falling or steady.
+ *	<publish>/frost-risk		temp.  true or false.
+ *
+ * Each is retained, and published when it changes.  When an input is
+ * not a number, what depends on it is "unknown".
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type derivedConfig struct {
+	Temp          string   `yaml:"temp"`
+	Humidity      string   `yaml:"humidity"`
+	Pressure      string   `yaml:"pressure"`
+	Wind          string   `yaml:"wind"`
+	TempUnits     string   `yaml:"temp-units"`
+	Units         string   `yaml:"units"`
+	WindUnits     string   `yaml:"wind-units"`
+	Publish       string   `yaml:"publish"`
+	Format        string   `yaml:"format"`
+	RateWindow    string   `yaml:"rate-window"`
+	TrendWindow   string   `yaml:"trend-window"`
+	Steady        *float64 `yaml:"steady"`
+	FrostTemp     *float64 `yaml:"frost-temp"`
+	FrostDewPoint *float64 `yaml:"frost-dew-point"`
+}
+
+const (
+	defaultDerivedPublish = "environment"
+	defaultRateWindow     = time.Hour
+	defaultTrendWindow    = 3 * time.Hour
+	defaultSteady         = 1.
+	defaultFrostTemp      = 3. // C
+	defaultFrostDewPoint  = 0. // C
+)
+
+// wind speeds in mph
+var windFactors = map[string]float64{
+	"mph": 1,
+	"kmh": 1 / 1.609344,
+	"ms":  3600 / 1609.344,
+}
+
+type derivedType struct {
+	temp          string
+	humidity      string
+	pressure      string
+	wind          string
+	tempUnits     string
+	units         string
+	windFactor    float64
+	publish       string
+	format        string
+	rateWindow    time.Duration
+	trendWindow   time.Duration
+	steady        float64
+	frostTemp     float64 // C
+	frostDewPoint float64 // C
+
+	temps     []sampleType // C
+	pressures []sampleType
+}
+
+func compileDerived(dc derivedConfig) (*derivedType, error) {
+	var err error
+
+	d := new(derivedType)
+	if dc.Temp == "" {
+		return nil, fmt.Errorf("needs temp")
+	}
+	d.temp = dc.Temp
+	d.humidity = dc.Humidity
+	d.pressure = dc.Pressure
+	d.wind = dc.Wind
+	if strings.ContainsAny(d.temp+d.humidity+d.pressure+d.wind, "+#") {
+		return nil, fmt.Errorf("topics may not have wildcards")
+	}
+
+	d.tempUnits, err = checkUnits(dc.TempUnits)
+	if err != nil {
+		return nil, fmt.Errorf("temp-units: %v", err)
+	}
+	d.units, err = checkUnits(dc.Units)
+	if err != nil {
+		return nil, fmt.Errorf("units: %v", err)
+	}
+
+	windUnits := dc.WindUnits
+	if windUnits == "" {
+		windUnits = "mph"
+	}
+	factor, ok := windFactors[windUnits]
+	if !ok {
+		return nil, fmt.Errorf("wind-units %s is not mph, kmh or ms", windUnits)
+	}
+	d.windFactor = factor
+
+	d.publish = dc.Publish
+	if d.publish == "" {
+		d.publish = defaultDerivedPublish
+	}
+	d.format = dc.Format
+	if d.format == "" {
+		d.format = defaultQuantityFormat
+	}
+
+	d.rateWindow = defaultRateWindow
+	if dc.RateWindow != "" {
+		d.rateWindow, err = time.ParseDuration(dc.RateWindow)
+		if err != nil || d.rateWindow <= 0 {
+			return nil, fmt.Errorf("bad rate-window %s", dc.RateWindow)
+		}
+	}
+	d.trendWindow = defaultTrendWindow
+	if dc.TrendWindow != "" {
+		d.trendWindow, err = time.ParseDuration(dc.TrendWindow)
+		if err != nil || d.trendWindow <= 0 {
+			return nil, fmt.Errorf("bad trend-window %s", dc.TrendWindow)
+		}
+	}
+
+	d.steady = defaultSteady
+	if dc.Steady != nil {
+		if *dc.Steady < 0 {
+			return nil, fmt.Errorf("negative steady")
+		}
+		d.steady = *dc.Steady
+	}
+
+	// frost limits are given in the units published
+	d.frostTemp = defaultFrostTemp
+	if dc.FrostTemp != nil {
+		d.frostTemp = toCelsius(*dc.FrostTemp, d.units)
+	}
+	d.frostDewPoint = defaultFrostDewPoint
+	if dc.FrostDewPoint != nil {
+		d.frostDewPoint = toCelsius(*dc.FrostDewPoint, d.units)
+	}
+	return d, nil
+}
+
+func checkUnits(units string) (string, error) {
+	switch units {
+	case "":
+		return "F", nil
+	case "C", "F":
+		return units, nil
+	}
+	return "", fmt.Errorf("%s is not C or F", units)
+}
+
+func toCelsius(t float64, units string) float64 {
+	if units == "F" {
+		return (t - 32) * 5 / 9
+	}
+	return t
+}
+
+func fromCelsius(t float64, units string) float64 {
+	if units == "F" {
+		return t*9/5 + 32
+	}
+	return t
+}
+
+func (d *derivedType) topics() []string {
+	topics := []string{d.temp}
+
+	for _, t := range []string{d.humidity, d.pressure, d.wind} {
+		if t != "" {
+			topics = append(topics, t)
+		}
+	}
+	return topics
+}
+
+func (d *derivedType) uses(topic string) bool {
+	for _, t := range d.topics() {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Dew point by the Magnus formula, all in C
+func dewPoint(t, rh float64) float64 {
+	const b, c = 17.62, 243.12
+
+	gamma := math.Log(rh/100) + b*t/(c+t)
+	return c * gamma / (b - gamma)
+}
+
+// The NWS heat index, all in F
+func heatIndex(t, rh float64) float64 {
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return hi
+	}
+
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh - .22475541*t*rh -
+		.00683783*t*t - .05481717*rh*rh + .00122874*t*t*rh +
+		.00085282*t*rh*rh - .00000199*t*t*rh*rh
+	if rh < 13 && t >= 80 && t <= 112 {
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if rh > 85 && t >= 80 && t <= 87 {
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return hi
+}
+
+// The NWS wind chill, in F and mph.  Only defined at or below 50F and above 3 mph.
+func windChill(t, v float64) float64 {
+	if t > 50 || v <= 3 {
+		return t
+	}
+	p := math.Pow(v, 0.16)
+	return 35.74 + 0.6215*t - 35.75*p + 0.4275*t*p
+}
+
+/*
+ * The sample from at least window ago, dropping any older ones that are
+ * no longer needed.  False if there is not that much history yet.
+ */
+func past(samples *[]sampleType, window time.Duration, now time.Time) (sampleType, bool) {
+	i := -1
+	for j, s := range *samples {
+		if now.Sub(s.when) >= window {
+			i = j
+		}
+	}
+	if i < 0 {
+		return sampleType{}, false
+	}
+	*samples = (*samples)[i:]
+	return (*samples)[0], true
+}
+
+func (d *derivedType) number(e *engineType, topic string) (float64, bool) {
+	if topic == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(e.values[topic], 64)
+	return v, err == nil
+}
+
+func (d *derivedType) output(e *engineType, name, value string) {
+	topic := d.publish + "/" + name
+	if e.values[topic] != value {
+		e.publish(topic, value, true)
+	}
+}
+
+func (d *derivedType) outputNumber(e *engineType, name string, value float64, ok bool) {
+	if !ok {
+		d.output(e, name, "unknown")
+		return
+	}
+	d.output(e, name, fmt.Sprintf(d.format, value))
+}
+
+func (d *derivedType) outputTemp(e *engineType, name string, celsius float64, ok bool) {
+	d.outputNumber(e, name, fromCelsius(celsius, d.units), ok)
+}
+
+// One of the inputs changed.  Work out everything again.
+func (d *derivedType) handleMessage(e *engineType, topic string, now time.Time) {
+	raw, tempOK := d.number(e, d.temp)
+	t := toCelsius(raw, d.tempUnits)
+	rh, humidityOK := d.number(e, d.humidity)
+	humidityOK = humidityOK && rh > 0 && rh <= 100
+	dp := 0.
+	if tempOK && humidityOK {
+		dp = dewPoint(t, rh)
+	}
+
+	if topic == d.temp && tempOK {
+		d.temps = append(d.temps, sampleType{when: now, value: t})
+	}
+	if topic == d.pressure {
+		if p, ok := d.number(e, d.pressure); ok {
+			d.pressures = append(d.pressures, sampleType{when: now, value: p})
+		}
+	}
+
+	if d.humidity != "" {
+		d.outputTemp(e, "dew-point", dp, tempOK && humidityOK)
+		hi := heatIndex(fromCelsius(t, "F"), rh)
+		d.outputTemp(e, "heat-index", toCelsius(hi, "F"), tempOK && humidityOK)
+	}
+
+	if d.wind != "" {
+		v, windOK := d.number(e, d.wind)
+		wc := windChill(fromCelsius(t, "F"), v*d.windFactor)
+		d.outputTemp(e, "wind-chill", toCelsius(wc, "F"), tempOK && windOK)
+	}
+
+	if topic == d.temp {
+		then, ok := past(&d.temps, d.rateWindow, now)
+		rate := 0.
+		if ok {
+			rate = (t - then.value) / now.Sub(then.when).Hours()
+			if d.units == "F" {
+				rate = rate * 9 / 5
+			}
+		}
+		if ok || !tempOK {
+			d.outputNumber(e, "temp-rate", rate, ok && tempOK)
+		}
+	}
+
+	if d.pressure != "" && topic == d.pressure {
+		p, pressureOK := d.number(e, d.pressure)
+		then, ok := past(&d.pressures, d.trendWindow, now)
+		if ok || !pressureOK {
+			change := p - then.value
+			d.outputNumber(e, "pressure-trend", change, ok && pressureOK)
+			tendency := "unknown"
+			if ok && pressureOK {
+				tendency = "steady"
+				if change >= d.steady {
+					tendency = "rising"
+				} else if change <= -d.steady {
+					tendency = "falling"
+				}
+			}
+			d.output(e, "pressure-tendency", tendency)
+		}
+	}
+
+	frost := "unknown"
+	if tempOK {
+		risk := t <= 0
+		if humidityOK {
+			risk = risk || (t <= d.frostTemp && dp <= d.frostDewPoint)
+		} else {
+			risk = risk || t <= d.frostTemp
+		}
+		frost = strconv.FormatBool(risk)
+	}
+	d.output(e, "frost-risk", frost)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+const testDerived = `
+derived:
+  temp: environment/temp
+  humidity: environment/humidity
+  pressure: environment/pressure
+  wind: environment/wind
+  temp-units: %s
+  units: %s
+rules: []
+`
+
+func testDerivedEngine(t *testing.T, tempUnits, units string) (*engineType, *fakeClient) {
+	fullLogFileName = os.DevNull
+
+	config, err := parseRules([]byte(fmt.Sprintf(testDerived, tempUnits, units)))
+	if err != nil {
+		t.Fatalf("Cannot parse derived: %v", err)
+	}
+	c := new(fakeClient)
+	e := newEngine(c, config)
+	if err := e.subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return e, c
+}
+
+// Against the NWS tables
+func TestDerivedFormulas(t *testing.T) {
+	var tests = []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"dew point 20C 50%", dewPoint(20, 50), 9.3},
+		{"dew point 0C 100%", dewPoint(0, 100), 0},
+		{"heat index 90F 70%", heatIndex(90, 70), 106},
+		{"heat index 80F 40%", heatIndex(80, 40), 80},
+		{"heat index 70F 50%", heatIndex(70, 50), 69.3},
+		{"wind chill 0F 15mph", windChill(0, 15), -19},
+		{"wind chill 30F 5mph", windChill(30, 5), 25},
+		{"wind chill 60F 20mph", windChill(60, 20), 60},
+		{"wind chill 30F calm", windChill(30, 2), 30},
+	}
+
+	for _, test := range tests {
+		if math.Abs(test.got-test.want) > .5 {
+			t.Fatalf("%s: got %.2f, expected %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestDerivedUnits(t *testing.T) {
+	e, c := testDerivedEngine(t, "C", "F")
+	now := time.Now()
+
+	send(e, c, "environment/temp", "20", now)
+	expect(t, c, "environment/frost-risk", "false")
+	send(e, c, "environment/humidity", "50", now)
+	expect(t, c, "environment/dew-point", "48.7")
+	send(e, c, "environment/wind", "10", now)
+	expect(t, c, "environment/wind-chill", "68.0")
+
+	e, c = testDerivedEngine(t, "F", "C")
+	send(e, c, "environment/temp", "68", now)
+	send(e, c, "environment/humidity", "50", now)
+	expect(t, c, "environment/dew-point", "9.3")
+}
+
+func TestDerivedUnknown(t *testing.T) {
+	e, c := testDerivedEngine(t, "F", "F")
+	now := time.Now()
+
+	send(e, c, "environment/temp", "68", now)
+	send(e, c, "environment/humidity", "50", now)
+	send(e, c, "environment/wind", "20", now)
+	expect(t, c, "environment/dew-point", "48.7")
+
+	send(e, c, "environment/humidity", "unknown", now)
+	expect(t, c, "environment/dew-point", "unknown")
+	expect(t, c, "environment/heat-index", "unknown")
+	expect(t, c, "environment/wind-chill", "68.0")
+	expect(t, c, "environment/frost-risk", "false")
+
+	send(e, c, "environment/temp", "unknown", now)
+	expect(t, c, "environment/wind-chill", "unknown")
+	expect(t, c, "environment/frost-risk", "unknown")
+	expect(t, c, "environment/temp-rate", "unknown")
+}
+
+func TestDerivedTrends(t *testing.T) {
+	e, c := testDerivedEngine(t, "F", "F")
+	start := time.Now()
+
+	for i := 0; i <= 36; i++ {
+		now := start.Add(time.Duration(i) * 5 * time.Minute)
+		send(e, c, "environment/temp", fmt.Sprint(50-i/3), now)
+		send(e, c, "environment/pressure", fmt.Sprintf("%.1f", 1010+float64(i)/10), now)
+
+		if i < 12 {
+			if _, ok := c.last("environment/temp-rate"); ok {
+				t.Fatalf("Temperature rate published after %d minutes", i*5)
+			}
+		}
+		if i < 36 {
+			if _, ok := c.last("environment/pressure-trend"); ok {
+				t.Fatalf("Pressure trend published after %d minutes", i*5)
+			}
+		}
+	}
+
+	expect(t, c, "environment/temp-rate", "-4.0")
+	expect(t, c, "environment/pressure-trend", "3.6")
+	expect(t, c, "environment/pressure-tendency", "rising")
+
+	// a small change is steady
+	now := start.Add(6 * time.Hour)
+	send(e, c, "environment/pressure", "1013.4", start.Add(4*time.Hour))
+	send(e, c, "environment/pressure", "1013.0", now)
+	expect(t, c, "environment/pressure-trend", "-0.6")
+	expect(t, c, "environment/pressure-tendency", "steady")
+}
+
+func TestDerivedFrost(t *testing.T) {
+	var tests = []struct {
+		temp     string
+		humidity string
+		risk     string
+	}{
+		{"40", "90", "false"},
+		{"36", "90", "false"}, // dew point above freezing
+		{"36", "60", "true"},  // dew point below freezing
+		{"32", "100", "true"},
+		{"20", "100", "true"},
+	}
+
+	e, c := testDerivedEngine(t, "F", "F")
+	now := time.Now()
+	for _, test := range tests {
+		send(e, c, "environment/temp", test.temp, now)
+		send(e, c, "environment/humidity", test.humidity, now)
+		expect(t, c, "environment/frost-risk", test.risk)
+	}
+}
+
+func TestBadDerived(t *testing.T) {
+	var tests = []string{
+		"derived: {humidity: h}",
+		"derived: {temp: t, units: K}",
+		"derived: {temp: t, temp-units: kelvin}",
+		"derived: {temp: t, wind-units: knots}",
+		"derived: {temp: t, rate-window: soon}",
+		"derived: {temp: t, trend-window: -3h}",
+		"derived: {temp: t, steady: -1}",
+		"derived: {temp: t/+}",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("Derived should have been rejected: %s", test)
+		}
+	}
+}
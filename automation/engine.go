@@ -0,0 +1,582 @@
+/*
+ * The rule engine.
+ *
+ * All messages and timer ticks are fed through one go routine, so
+ * rules never run concurrently and may keep state without locking.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const engineTick = 1 // seconds between timer checks
+
+// The parts of the mqtt client the engine uses
+type mqttClient interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+}
+
+type ruleType struct {
+	name       string
+	topic      string        // trigger topic, or ""
+	every      time.Duration // trigger interval, or 0
+	cron       *cronType     // trigger schedule, or nil
+	next       time.Time     // when an interval trigger next fires
+	lastCron   time.Time     // the minute a cron trigger last fired
+	conditions []conditionType
+	transforms []transform
+	actions    []actionType
+}
+
+type conditionType struct {
+	topic   string // "" for the trigger value
+	in      map[string]bool
+	notIn   map[string]bool
+	numeric bool
+	above   *float64
+	below   *float64
+	older   time.Duration
+}
+
+type actionType struct {
+	kind     string // publish, zoneminder, log or notify
+	topic    string
+	text     string
+	retain   bool
+	title    string
+	priority string
+	to       []string
+}
+
+// A transform takes a value and returns a new value, or false to stop the rule.
+type transform interface {
+	apply(e *engineType, value string, now time.Time) (string, bool)
+}
+
+// Some transforms also produce values as time passes
+type tickingTransform interface {
+	tick(e *engineType, now time.Time) (string, bool)
+}
+
+type messageType struct {
+	topic   string
+	payload string
+}
+
+type engineType struct {
+	client     mqttClient
+	rules      []*ruleType
+	quantities []*quantityType
+	alarm      *alarmType
+	derived    *derivedType
+	iotTime    *iotTimeType
+	values     map[string]string // last value seen on each topic
+	messages   chan messageType
+	zoneState  func(state string)
+	notify     func(note notificationType)
+}
+
+func newEngine(client mqttClient, config *configType) *engineType {
+	e := new(engineType)
+	e.client = client
+	e.rules = config.rules
+	e.quantities = config.quantities
+	e.alarm = config.alarm
+	e.derived = config.derived
+	e.iotTime = config.iotTime
+	e.values = make(map[string]string)
+	e.messages = make(chan messageType, 100)
+	e.zoneState = zoneState
+	e.notify = notify
+	return e
+}
+
+// All mqtt messages for the engine come here
+func (e *engineType) handler(client mqtt.Client, msg mqtt.Message) {
+	e.messages <- messageType{topic: msg.Topic(), payload: string(msg.Payload())}
+}
+
+/*
+ * Subscribe to everything the rules look at.  Topics already covered
+ * by a wildcard subscription are skipped, as mqtt would deliver
+ * their messages twice.
+ */
+func (e *engineType) subscribe() error {
+	var wildcards, topics []string
+	var all []string
+	seen := make(map[string]bool)
+
+	if e.alarm != nil {
+		all = append(all, e.alarm.topics()...)
+	}
+	for _, q := range e.quantities {
+		all = append(all, q.topics()...)
+	}
+	if e.derived != nil {
+		all = append(all, e.derived.topics()...)
+	}
+	for _, r := range e.rules {
+		all = append(all, r.topics()...)
+	}
+
+	for _, t := range all {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if strings.ContainsAny(t, "+#") {
+			wildcards = append(wildcards, t)
+		} else {
+			topics = append(topics, t)
+		}
+	}
+
+	for _, t := range topics {
+		covered := false
+		for _, w := range wildcards {
+			if topicMatch(w, t) {
+				covered = true
+			}
+		}
+		if !covered {
+			wildcards = append(wildcards, t)
+		}
+	}
+
+	for _, t := range wildcards {
+		if token := e.client.Subscribe(t, 0, e.handler); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("Cannot subscribe to %s: %v", t, token.Error())
+		}
+	}
+	return nil
+}
+
+// The engine go routine.  Runs until the context is cancelled.
+func (e *engineType) run(con context.Context) {
+	ticker := time.NewTicker(engineTick * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-e.messages:
+			e.handleMessage(m.topic, m.payload, time.Now())
+		case now := <-ticker.C:
+			e.tick(now)
+		case <-con.Done():
+			return
+		}
+	}
+}
+
+// Update the alarm, quantities and derived values, and run every rule triggered by a message
+func (e *engineType) handleMessage(topic, payload string, now time.Time) {
+	e.values[topic] = payload
+
+	if e.alarm != nil {
+		e.alarm.handleMessage(e, topic, payload, now)
+	}
+
+	for _, q := range e.quantities {
+		if used, reading := q.uses(topic); used {
+			q.handleMessage(e, reading, now)
+		}
+	}
+
+	if e.derived != nil && e.derived.uses(topic) {
+		e.derived.handleMessage(e, topic, now)
+	}
+
+	for _, r := range e.rules {
+		if r.topic != "" && topicMatch(r.topic, topic) {
+			e.fire(r, payload, topic, now)
+		}
+	}
+}
+
+// Send the time pulse, and run rules whose time has come, and transforms and
+// quantities with something to say
+func (e *engineType) tick(now time.Time) {
+	if e.iotTime != nil {
+		e.iotTime.tick(e, now)
+	}
+
+	for _, q := range e.quantities {
+		q.tick(e, now)
+	}
+
+	for _, r := range e.rules {
+		if r.every > 0 {
+			if r.next.IsZero() {
+				r.next = now.Add(r.every)
+			} else if !now.Before(r.next) {
+				r.next = now.Add(r.every)
+				e.fire(r, "", "", now)
+			}
+		}
+
+		if r.cron != nil {
+			minute := now.Truncate(time.Minute)
+			if !minute.Equal(r.lastCron) && r.cron.matches(now) {
+				r.lastCron = minute
+				e.fire(r, "", "", now)
+			}
+		}
+
+		for i, t := range r.transforms {
+			if tt, ok := t.(tickingTransform); ok {
+				if value, ok := tt.tick(e, now); ok {
+					e.pipeline(r, i+1, value, r.topic, now)
+				}
+			}
+		}
+	}
+}
+
+// Check a rule's conditions, then run it
+func (e *engineType) fire(r *ruleType, value, trigger string, now time.Time) {
+	for _, c := range r.conditions {
+		if !e.check(c, value, now) {
+			return
+		}
+	}
+	e.pipeline(r, 0, value, trigger, now)
+}
+
+// Run a rule's transforms, starting at "first", then its actions
+func (e *engineType) pipeline(r *ruleType, first int, value, trigger string, now time.Time) {
+	var ok bool
+
+	for _, t := range r.transforms[first:] {
+		value, ok = t.apply(e, value, now)
+		if !ok {
+			return
+		}
+	}
+
+	for _, a := range r.actions {
+		text := e.expand(a.text, value, trigger, now)
+		switch a.kind {
+		case "publish":
+			e.publish(e.expand(a.topic, value, trigger, now), text, a.retain)
+		case "zoneminder":
+			e.zoneState(text)
+		case "log":
+			logMessage(text)
+		case "notify":
+			e.notify(notificationType{
+				key:      r.name,
+				title:    e.expand(a.title, value, trigger, now),
+				text:     text,
+				priority: a.priority,
+				to:       a.to,
+				when:     now,
+			})
+		}
+	}
+}
+
+// Publish, and remember what we published so later rules can see it
+func (e *engineType) publish(topic, payload string, retain bool) {
+	e.values[topic] = payload
+	e.client.Publish(topic, 0, retain, payload)
+}
+
+func (e *engineType) check(c conditionType, value string, now time.Time) bool {
+	known := true
+	if c.topic != "" {
+		value, known = e.values[c.topic]
+	}
+
+	if c.in != nil && (!known || !c.in[value]) {
+		return false
+	}
+	if c.notIn != nil && known && c.notIn[value] {
+		return false
+	}
+
+	if c.numeric || c.above != nil || c.below != nil {
+		v, err := strconv.ParseFloat(value, 64)
+		if !known || err != nil {
+			return false
+		}
+		if c.above != nil && v <= *c.above {
+			return false
+		}
+		if c.below != nil && v >= *c.below {
+			return false
+		}
+	}
+
+	if c.older > 0 {
+		t := parseDeviceTime(value)
+		if known && !t.IsZero() && now.Sub(t) <= c.older {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The device time last seen on a topic, or zero
+func (e *engineType) deviceTime(topic string) time.Time {
+	return parseDeviceTime(e.values[topic])
+}
+
+// Device times are seconds since the epoch.  The times we publish, as
+// {{time}} and $changed, are RFC3339.  Zero if neither.
+func parseDeviceTime(value string) time.Time {
+	t, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		if when, err := time.Parse(time.RFC3339, value); err == nil {
+			return when
+		}
+		return time.Time{}
+	}
+	return epoch.Add(time.Duration(t) * time.Second)
+}
+
+// Fill in a template
+func (e *engineType) expand(text, value, trigger string, now time.Time) string {
+	return templateMatch.ReplaceAllStringFunc(text, func(m string) string {
+		parts := strings.SplitN(m[2:len(m)-2], "|", 2)
+		switch parts[0] {
+		case "value":
+			return value
+		case "trigger":
+			return trigger
+		case "time":
+			return now.Format(time.RFC3339)
+		}
+		if v, ok := e.values[parts[0]]; ok {
+			return v
+		}
+		if len(parts) == 2 {
+			return parts[1]
+		}
+		return ""
+	})
+}
+
+// Does an mqtt topic match a subscription pattern?
+func topicMatch(pattern, topic string) bool {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+
+	for i, pc := range p {
+		if pc == "#" {
+			return true
+		}
+		if i >= len(t) || (pc != "+" && pc != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+/*
+ * The transforms
+ */
+
+type mapTransform struct {
+	table     map[string]string
+	otherwise *string
+}
+
+func (t *mapTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, ok := t.table[value]
+	if !ok {
+		if t.otherwise == nil {
+			return "", false
+		}
+		v = *t.otherwise
+	}
+	return e.expand(v, value, "", now), true
+}
+
+type hysteresisTransform struct {
+	band    float64
+	against string
+	last    string
+}
+
+// Numbers within the band of the last one are stopped.  Anything else passes.
+func (t *hysteresisTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	last := t.last
+	if t.against != "" {
+		last = e.values[t.against]
+	}
+
+	v, err1 := strconv.ParseFloat(value, 64)
+	l, err2 := strconv.ParseFloat(last, 64)
+	if err1 == nil && err2 == nil && math.Abs(v-l) < t.band {
+		return "", false
+	}
+
+	t.last = value
+	return value, true
+}
+
+type sampleType struct {
+	when  time.Time
+	value float64
+}
+
+// A rolling average over the last window
+type averageTransform struct {
+	window  time.Duration
+	samples []sampleType
+}
+
+// Numbers are added to the average, which is passed on.  Anything else is ignored.
+func (t *averageTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	t.expire(now)
+	t.samples = append(t.samples, sampleType{when: now, value: v})
+	return t.average(), true
+}
+
+// As samples age out, the average changes
+func (t *averageTransform) tick(e *engineType, now time.Time) (string, bool) {
+	if !t.expire(now) || len(t.samples) < 1 {
+		return "", false
+	}
+	return t.average(), true
+}
+
+// Drop samples older than the window.  Returns true if any were dropped.
+func (t *averageTransform) expire(now time.Time) bool {
+	i := 0
+	for i < len(t.samples) && now.Sub(t.samples[i].when) >= t.window {
+		i++
+	}
+	t.samples = t.samples[i:]
+	return i > 0
+}
+
+func (t *averageTransform) average() string {
+	sum := 0.0
+	for _, s := range t.samples {
+		sum += s.value
+	}
+	return strconv.FormatFloat(sum/float64(len(t.samples)), 'f', -1, 64)
+}
+
+type lookupEntry struct {
+	max   float64
+	value string
+}
+
+type lookupTransform struct {
+	table     []lookupEntry
+	otherwise *string
+}
+
+func (t *lookupTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	for _, l := range t.table {
+		if v <= l.max {
+			return l.value, true
+		}
+	}
+	if t.otherwise == nil {
+		return "", false
+	}
+	return *t.otherwise, true
+}
+
+type formatTransform struct {
+	format string
+}
+
+// Numbers are formatted.  Anything else passes unchanged.
+func (t *formatTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value, true
+	}
+	return fmt.Sprintf(t.format, v), true
+}
+
+type changesTransform struct {
+	last  string
+	valid bool
+}
+
+func (t *changesTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	if t.valid && value == t.last {
+		return "", false
+	}
+	t.last = value
+	t.valid = true
+	return value, true
+}
+
+type afterTransform struct {
+	from  map[string]bool
+	last  string
+	valid bool
+}
+
+func (t *afterTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	prior, valid := t.last, t.valid
+	t.last = value
+	t.valid = true
+	return value, valid && t.from[prior]
+}
+
+type edgeTransform struct {
+	fallBelow float64
+	riseAbove float64
+	falling   string
+	rising    string
+	state     int // -1 below, +1 above, 0 not yet known
+}
+
+/*
+ * Passes on "falling" when a number drops below fallBelow after being
+ * above riseAbove, and "rising" the other way.  Numbers in between
+ * change nothing.  The first number only sets which side we are on.
+ */
+func (t *edgeTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+
+	state := t.state
+	switch {
+	case v < t.fallBelow:
+		state = -1
+	case v > t.riseAbove:
+		state = 1
+	}
+	if state == t.state {
+		return "", false
+	}
+
+	previous := t.state
+	t.state = state
+	if previous == 0 {
+		return "", false
+	}
+	if state < 0 {
+		return t.falling, true
+	}
+	return t.rising, true
+}
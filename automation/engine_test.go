@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// A token that is always done
+type fakeToken struct{}
+
+func (fakeToken) Wait() bool                     { return true }
+func (fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeToken) Error() error                   { return nil }
+func (fakeToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+type fakePublish struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+/*
+ * A fake mqtt client.  Publishes are recorded, and those the client
+ * is subscribed to are held for delivery back to the engine, as the
+ * broker would.
+ */
+type fakeClient struct {
+	subscriptions []string
+	published     []fakePublish
+	pending       []fakePublish
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := fakePublish{topic: topic, payload: payload.(string), retain: retained}
+	c.published = append(c.published, p)
+	for _, s := range c.subscriptions {
+		if topicMatch(s, topic) {
+			c.pending = append(c.pending, p)
+			break
+		}
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.subscriptions = append(c.subscriptions, topic)
+	return fakeToken{}
+}
+
+// the last payload published to a topic
+func (c *fakeClient) last(topic string) (string, bool) {
+	for i := len(c.published) - 1; i >= 0; i-- {
+		if c.published[i].topic == topic {
+			return c.published[i].payload, true
+		}
+	}
+	return "", false
+}
+
+// hand a message to the engine, then everything it publishes that it listens to
+func send(e *engineType, c *fakeClient, topic, payload string, now time.Time) {
+	e.handleMessage(topic, payload, now)
+	deliver(e, c, now)
+}
+
+// the same for a timer tick
+func tick(e *engineType, c *fakeClient, now time.Time) {
+	e.tick(now)
+	deliver(e, c, now)
+}
+
+func deliver(e *engineType, c *fakeClient, now time.Time) {
+	for len(c.pending) > 0 {
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		e.handleMessage(p.topic, p.payload, now)
+	}
+}
+
+func testEngine(t *testing.T) (*engineType, *fakeClient, *[]string) {
+	var zoneStates []string
+
+	fullLogFileName = os.DevNull
+
+	config, err := loadRules("rules.yaml")
+	if err != nil {
+		t.Fatalf("Cannot load rules: %v", err)
+	}
+
+	c := new(fakeClient)
+	e := newEngine(c, config)
+	e.zoneState = func(state string) {
+		zoneStates = append(zoneStates, state)
+	}
+	if err := e.subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return e, c, &zoneStates
+}
+
+func expect(t *testing.T, c *fakeClient, topic, want string) {
+	t.Helper()
+	got, ok := c.last(topic)
+	if !ok {
+		t.Fatalf("Nothing published to %s, expected %s", topic, want)
+	}
+	if got != want {
+		t.Fatalf("Published %s to %s, expected %s", got, topic, want)
+	}
+}
+
+func TestAlarmRules(t *testing.T) {
+	e, c, zoneStates := testEngine(t)
+	now := time.Now()
+
+	// detector not yet on line, so nothing goes to the environment
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "armed-away", now)
+	if _, ok := c.last("environment/alarm-state"); ok {
+		t.Fatal("Alarm state published while detector off line")
+	}
+
+	send(e, c, "devices/alarm-state-0001/$state", "ready", now)
+	expect(t, c, "environment/alarm-state", "armed-away")
+	expect(t, c, "devices/led-0001/led/on/set", "1")
+	if len(*zoneStates) != 1 || (*zoneStates)[0] != "armed-away" {
+		t.Fatalf("Expected ZoneMinder to get armed-away, got %v", *zoneStates)
+	}
+
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "disarmed", now)
+	expect(t, c, "environment/alarm-state", "disarmed")
+	expect(t, c, "devices/led-0001/led/on/set", "0")
+	if (*zoneStates)[len(*zoneStates)-1] != "disarmed" {
+		t.Fatalf("Expected ZoneMinder to get disarmed, got %v", *zoneStates)
+	}
+
+	// detector lost, then back
+	n := len(c.published)
+	send(e, c, "devices/alarm-state-0001/$state", "lost", now)
+	expect(t, c, "environment/alarm-state", "unknown")
+	send(e, c, "devices/alarm-state-0001/$state", "sleeping", now)
+	send(e, c, "devices/alarm-state-0001/$state", "ready", now)
+	expect(t, c, "environment/alarm-state", "disarmed")
+
+	count := 0
+	for _, p := range c.published[n:] {
+		if p.topic == "environment/alarm-state" {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 alarm state changes, got %d", count)
+	}
+
+	// garbage is ignored
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "bogus", now)
+	expect(t, c, "environment/alarm-state", "disarmed")
+}
+
+func TestSensorRules(t *testing.T) {
+	e, c, _ := testEngine(t)
+	start := time.Now().Truncate(time.Second) // device times are in seconds
+	now := start
+
+	send(e, c, "devices/environ-0001/temp/time-last-update", iotTime(now), now)
+	send(e, c, "devices/environ-0001/temp/temp", "20.04", now)
+	expect(t, c, "environment/outdoor-temp", "20.0")
+	send(e, c, "devices/environ-0001/temp/temp", "20.3", now)
+	expect(t, c, "environment/outdoor-temp", "20.0")
+	send(e, c, "devices/environ-0001/temp/temp", "20.6", now)
+	expect(t, c, "environment/outdoor-temp", "20.6")
+	send(e, c, "devices/environ-0001/temp/temp", "20.7", now)
+	expect(t, c, "environment/outdoor-temp", "20.7")
+	send(e, c, "devices/environ-0001/temp/temp", "20.4", now)
+	expect(t, c, "environment/outdoor-temp", "20.7")
+	send(e, c, "devices/environ-0001/temp/temp", "not-a-number", now)
+	expect(t, c, "environment/outdoor-temp", "20.7")
+
+	// sensor stops updating.  Readings that arrive are held back.
+	now = start.Add(4 * time.Minute)
+	e.tick(now)
+	send(e, c, "devices/environ-0001/temp/temp", "25", now)
+	expect(t, c, "environment/outdoor-temp", "20.7")
+	now = start.Add(10 * time.Minute)
+	e.tick(now)
+	expect(t, c, "environment/outdoor-temp", "20.7")
+	now = now.Add(time.Second)
+	e.tick(now)
+	expect(t, c, "environment/outdoor-temp", "unknown")
+
+	// and comes back, the reading before the time-last-update
+	send(e, c, "devices/environ-0001/temp/temp", "20.8", now)
+	expect(t, c, "environment/outdoor-temp", "unknown")
+	send(e, c, "devices/environ-0001/temp/time-last-update", iotTime(now), now)
+	e.tick(now)
+	expect(t, c, "environment/outdoor-temp", "20.8")
+}
+
+func TestLightRule(t *testing.T) {
+	e, c, _ := testEngine(t)
+	start := time.Now().Truncate(time.Second)
+
+	// published from the first reading
+	send(e, c, "environment/outdoor-lux", "100", start)
+	expect(t, c, "environment/outdoor-light", "1")
+	send(e, c, "environment/outdoor-lux", "300", start.Add(time.Minute))
+	expect(t, c, "environment/outdoor-light", "2")
+	if _, ok := c.last("environment/dawn"); ok {
+		t.Fatal("Dawn before it got light")
+	}
+
+	// the first reading drops out of the average.  Only the time pulse goes out.
+	n := len(c.published)
+	tick(e, c, start.Add(4*time.Minute))
+	for _, p := range c.published[n:] {
+		if !strings.HasPrefix(p.topic, "environment/IOTtime") {
+			t.Fatalf("Published %v with nothing changed", c.published[n:])
+		}
+	}
+	tick(e, c, start.Add(5*time.Minute))
+	expect(t, c, "environment/outdoor-light", "3")
+	expect(t, c, "environment/dawn", start.Add(5*time.Minute).Format(time.RFC3339))
+
+	// dark again
+	send(e, c, "environment/outdoor-lux", "150", start.Add(6*time.Minute))
+	expect(t, c, "environment/outdoor-light", "2")
+	if _, ok := c.last("environment/dusk"); ok {
+		t.Fatal("Dusk while still in the band")
+	}
+	send(e, c, "environment/outdoor-lux", "1", start.Add(7*time.Minute))
+	expect(t, c, "environment/outdoor-light", "1")
+	expect(t, c, "environment/dusk", start.Add(7*time.Minute).Format(time.RFC3339))
+
+	// unknown is not a reading
+	send(e, c, "environment/outdoor-lux", "unknown", start.Add(8*time.Minute))
+	expect(t, c, "environment/outdoor-light", "1")
+	tick(e, c, start.Add(11*time.Minute))
+	expect(t, c, "environment/outdoor-light", "0")
+	expect(t, c, "environment/dusk", start.Add(7*time.Minute).Format(time.RFC3339))
+}
+
+func TestBadRules(t *testing.T) {
+	var tests = []string{
+		"rules: [{name: no-actions, trigger: {topic: a}}]",
+		"rules: [{name: two-triggers, trigger: {topic: a, every: 1m}, actions: [{log: x}]}]",
+		"rules: [{name: bad-every, trigger: {every: soon}, actions: [{log: x}]}]",
+		"rules: [{name: bad-cron, trigger: {cron: '61 * * * *'}, actions: [{log: x}]}]",
+		"rules: [{name: two-kinds, trigger: {topic: a}, transforms: [{changes: true, format: '%f'}], actions: [{log: x}]}]",
+		"rules: [{name: empty-if, trigger: {topic: a}, if: [{topic: b}], actions: [{log: x}]}]",
+		"rules: [{name: typo, trigger: {topic: a}, actions: [{logg: x}]}]",
+		"rules: [{name: half-edge, trigger: {topic: a}, transforms: [{edge: {fall-below: 1, falling: x}}], actions: [{log: x}]}]",
+		"rules: [{name: edge-crossed, trigger: {topic: a}, transforms: [{edge: {fall-below: 3, rise-above: 2, falling: x, rising: y}}], actions: [{log: x}]}]",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("Rules should have been rejected: %s", test)
+		}
+	}
+}
+
+func TestCron(t *testing.T) {
+	c, err := parseCron("0 23 * * 1-5")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	monday := time.Date(2026, time.October, 19, 23, 0, 30, 0, time.Local)
+	if !c.matches(monday) {
+		t.Fatalf("Should match %v", monday)
+	}
+	if c.matches(monday.Add(time.Minute)) {
+		t.Fatalf("Should not match %v", monday.Add(time.Minute))
+	}
+	if c.matches(monday.AddDate(0, 0, -1)) {
+		t.Fatalf("Should not match Sunday")
+	}
+
+	c, err = parseCron("*/15 * 1 * 0")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	// day of month or day of week
+	if !c.matches(time.Date(2026, time.October, 18, 10, 45, 0, 0, time.Local)) {
+		t.Fatal("Should match a Sunday")
+	}
+	if !c.matches(time.Date(2026, time.October, 1, 10, 30, 0, 0, time.Local)) {
+		t.Fatal("Should match the first of the month")
+	}
+	if c.matches(time.Date(2026, time.October, 1, 10, 31, 0, 0, time.Local)) {
+		t.Fatal("Should not match minute 31")
+	}
+}
+
+func TestCronStep(t *testing.T) {
+	var tests = []struct {
+		field string
+		want  []int
+	}{
+		{"5/10", []int{5, 15, 25, 35, 45, 55}},
+		{"*/15", []int{0, 15, 30, 45}},
+		{"10-30/10", []int{10, 20, 30}},
+		{"7", []int{7}},
+	}
+
+	for _, test := range tests {
+		var minutes [60]bool
+		if err := parseCronField(test.field, minutes[:], 0); err != nil {
+			t.Fatalf("Parse of %s failed: %v", test.field, err)
+		}
+		var got []int
+		for m, set := range minutes {
+			if set {
+				got = append(got, m)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Fatalf("%s matches minutes %v, expected %v", test.field, got, test.want)
+		}
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/+/c", "a/x/c", true},
+		{"a/+", "a/x/c", false},
+		{"a/#", "a/x/c", true},
+		{"#", "a", true},
+		{"a/b", "a/b/c", false},
+	}
+
+	for _, test := range tests {
+		if got := topicMatch(test.pattern, test.topic); got != test.want {
+			t.Fatalf("%s matching %s: expected %v", test.pattern, test.topic, test.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * The sensor filter pipeline.
+ *
+ * Readings from a sensor pass through, in order,
+ *	a staleness gate: readings whose time-last-update is more than
+ *		stale old are held back.  Once time-last-update is more than
+ *		unknown old, "unknown" is passed on, once.
+ *	a deadband: readings within deadband of the last value passed
+ *		are dropped.
+ *	hysteresis: a reading that keeps going the way the value last
+ *		moved passes.  One that turns back must move at least
+ *		hysteresis from the last value passed.
+ *	a rate limit: at most one value per rate-limit.  The latest value
+ *		held back is passed on when the period is up.
+ *
+ * Any step may be left out.  Ages are measured from the device's own
+ * time-last-update, not from when readings arrive, so a device that
+ * replays old readings after a reconnect is gated as it should be.
+ *
+ * In the rules file this is the sensor: transform, e.g.
+ *	- sensor:
+ *	    updated: devices/environ-0001/lux/time-last-update
+ *	    hysteresis: 2
+ *	    stale: 3m
+ *	    unknown: 10m
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+type sensorFilterConfig struct {
+	Updated    string  `yaml:"updated"`
+	Hysteresis float64 `yaml:"hysteresis"`
+	Deadband   float64 `yaml:"deadband"`
+	Stale      string  `yaml:"stale"`
+	Unknown    string  `yaml:"unknown"`
+	RateLimit  string  `yaml:"rate-limit"`
+}
+
+type sensorFilterType struct {
+	hysteresis float64
+	deadband   float64
+	stale      time.Duration
+	unknown    time.Duration
+	rateLimit  time.Duration
+
+	started   time.Time // when the filter first saw anything
+	last      float64   // the last value passed the deadband and hysteresis
+	valid     bool      // last means something
+	direction int       // the way last moved, +1 up, -1 down, 0 not yet known
+	isUnknown bool      // "unknown" has been passed on
+	held      *float64  // held back by the staleness gate
+	pending   *float64  // held back by the rate limit
+	lastSent  time.Time
+}
+
+func newSensorFilter(sc sensorFilterConfig) (*sensorFilterType, error) {
+	var err error
+
+	f := new(sensorFilterType)
+	if sc.Hysteresis < 0 || sc.Deadband < 0 {
+		return nil, fmt.Errorf("negative hysteresis or deadband")
+	}
+	f.hysteresis = sc.Hysteresis
+	f.deadband = sc.Deadband
+
+	durations := []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"stale", sc.Stale, &f.stale},
+		{"unknown", sc.Unknown, &f.unknown},
+		{"rate-limit", sc.RateLimit, &f.rateLimit},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		*d.d, err = time.ParseDuration(d.value)
+		if err != nil || *d.d <= 0 {
+			return nil, fmt.Errorf("bad %s duration %s", d.name, d.value)
+		}
+	}
+
+	if f.stale > 0 && f.unknown > 0 && f.unknown < f.stale {
+		return nil, fmt.Errorf("unknown is sooner than stale")
+	}
+	return f, nil
+}
+
+/*
+ * How old the sensor's data is.  A sensor that has never said when it
+ * last updated is as old as the filter.
+ */
+func (f *sensorFilterType) age(updated, now time.Time) time.Duration {
+	if f.started.IsZero() {
+		f.started = now
+	}
+	if updated.IsZero() {
+		return now.Sub(f.started)
+	}
+	return now.Sub(updated)
+}
+
+func (f *sensorFilterType) isStale(updated, now time.Time) bool {
+	if f.stale <= 0 {
+		return false
+	}
+	return updated.IsZero() || f.age(updated, now) > f.stale
+}
+
+// A reading, with the device's time-last-update.  Returns what to pass on, if anything.
+func (f *sensorFilterType) reading(value float64, updated, now time.Time) (string, bool) {
+	f.age(updated, now)
+	if f.isStale(updated, now) {
+		f.held = &value
+		return "", false
+	}
+	f.held = nil
+	return f.pass(value, now)
+}
+
+/*
+ * Called as time passes.  Publishes "unknown", readings the staleness
+ * gate held until time-last-update caught up, and readings the rate
+ * limit held.
+ */
+func (f *sensorFilterType) tick(updated, now time.Time) (string, bool) {
+	age := f.age(updated, now)
+
+	if f.unknown > 0 && age > f.unknown {
+		f.held = nil
+		f.pending = nil
+		if f.isUnknown {
+			return "", false
+		}
+		f.isUnknown = true
+		return "unknown", true
+	}
+
+	if f.held != nil && !f.isStale(updated, now) {
+		value := *f.held
+		f.held = nil
+		return f.pass(value, now)
+	}
+
+	if f.pending != nil && now.Sub(f.lastSent) >= f.rateLimit {
+		value := *f.pending
+		f.pending = nil
+		f.lastSent = now
+		return formatReading(value), true
+	}
+	return "", false
+}
+
+// The deadband, hysteresis and rate limit
+func (f *sensorFilterType) pass(value float64, now time.Time) (string, bool) {
+	// coming back from unknown, the first reading always passes
+	if f.isUnknown {
+		f.isUnknown = false
+		f.valid = false
+		f.direction = 0
+	}
+
+	if f.valid {
+		change := value - f.last
+		if math.Abs(change) < f.deadband {
+			return "", false
+		}
+
+		direction := 0
+		if change > 0 {
+			direction = 1
+		} else if change < 0 {
+			direction = -1
+		}
+		if direction != 0 && direction != f.direction && math.Abs(change) < f.hysteresis {
+			return "", false
+		}
+		if direction != 0 {
+			f.direction = direction
+		}
+	}
+	f.last = value
+	f.valid = true
+
+	if f.rateLimit > 0 && !f.lastSent.IsZero() && now.Sub(f.lastSent) < f.rateLimit {
+		f.pending = &value
+		return "", false
+	}
+	f.pending = nil
+	f.lastSent = now
+	return formatReading(value), true
+}
+
+func formatReading(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// The filter as a rule transform
+type sensorTransform struct {
+	updated string // topic of the sensor's time-last-update
+	filter  *sensorFilterType
+}
+
+func (t *sensorTransform) apply(e *engineType, value string, now time.Time) (string, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	return t.report(t.filter.reading(v, e.deviceTime(t.updated), now))
+}
+
+func (t *sensorTransform) tick(e *engineType, now time.Time) (string, bool) {
+	return t.report(t.filter.tick(e.deviceTime(t.updated), now))
+}
+
+// Log when the sensor goes unknown
+func (t *sensorTransform) report(value string, ok bool) (string, bool) {
+	if ok && value == "unknown" {
+		logMessage(fmt.Sprintf("Sensor %s not updated in %v, now unknown", t.updated, t.filter.unknown))
+	}
+	return value, ok
+}
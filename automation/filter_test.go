@@ -0,0 +1,179 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, time.October, 18, 12, 0, 0, 0, time.Local)}
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func testFilter(t *testing.T, sc sensorFilterConfig) *sensorFilterType {
+	f, err := newSensorFilter(sc)
+	if err != nil {
+		t.Fatalf("Cannot make filter: %v", err)
+	}
+	return f
+}
+
+type filterStep struct {
+	value float64
+	want  string // "" if nothing should pass
+}
+
+func runSteps(t *testing.T, f *sensorFilterType, clock *fakeClock, steps []filterStep) {
+	t.Helper()
+	for i, step := range steps {
+		got, ok := f.reading(step.value, clock.now, clock.now)
+		if !ok {
+			got = ""
+		}
+		if got != step.want {
+			t.Fatalf("Step %d, reading %v: expected %q, got %q", i, step.value, step.want, got)
+		}
+	}
+}
+
+func TestFilterHysteresis(t *testing.T) {
+	clock := newFakeClock()
+	f := testFilter(t, sensorFilterConfig{Hysteresis: 2})
+
+	runSteps(t, f, clock, []filterStep{
+		{100, "100"},
+		{101, ""}, // within the band, direction not known
+		{99, ""},  // within the band
+		{102.5, "102.5"},
+		{103, "103"}, // still going up
+		{103, "103"}, // no change is not turning back
+		{101.5, ""},  // turned back, within the band
+		{101, "101"}, // turned back far enough
+		{100.5, "100.5"},
+	})
+}
+
+func TestFilterDeadband(t *testing.T) {
+	clock := newFakeClock()
+	f := testFilter(t, sensorFilterConfig{Deadband: 0.5})
+
+	runSteps(t, f, clock, []filterStep{
+		{20, "20"},
+		{20.2, ""},
+		{20.4, ""},
+		{20.5, "20.5"},
+		{20.1, ""},
+		{19.9, "19.9"},
+	})
+}
+
+func TestFilterStaleness(t *testing.T) {
+	clock := newFakeClock()
+	f := testFilter(t, sensorFilterConfig{Hysteresis: 2, Stale: "3m", Unknown: "10m"})
+	updated := clock.now
+
+	if v, ok := f.reading(100, updated, clock.now); !ok || v != "100" {
+		t.Fatalf("Fresh reading should pass, got %s %v", v, ok)
+	}
+
+	// a reading arriving now, but the device says it last updated 4 minutes ago
+	clock.advance(4 * time.Minute)
+	if v, ok := f.reading(150, updated, clock.now); ok {
+		t.Fatalf("Stale reading passed: %s", v)
+	}
+	if v, ok := f.tick(updated, clock.now); ok {
+		t.Fatalf("Tick passed %s while stale", v)
+	}
+
+	// the time-last-update catches up, and the held reading passes
+	updated = clock.advance(time.Second)
+	if v, ok := f.tick(updated, clock.now); !ok || v != "150" {
+		t.Fatalf("Held reading should pass once fresh, got %s %v", v, ok)
+	}
+
+	// nothing for ten minutes
+	clock.advance(10 * time.Minute)
+	if v, ok := f.tick(updated, clock.now); ok {
+		t.Fatalf("Tick passed %s at exactly ten minutes", v)
+	}
+	clock.advance(time.Second)
+	if v, ok := f.tick(updated, clock.now); !ok || v != "unknown" {
+		t.Fatalf("Expected unknown, got %s %v", v, ok)
+	}
+	if v, ok := f.tick(updated, clock.advance(time.Minute)); ok {
+		t.Fatalf("Unknown should only pass once, got %s", v)
+	}
+
+	// back again.  The first reading passes, even within the band.
+	updated = clock.now
+	if v, ok := f.reading(151, updated, clock.now); !ok || v != "151" {
+		t.Fatalf("First reading after unknown should pass, got %s %v", v, ok)
+	}
+}
+
+func TestFilterNeverUpdated(t *testing.T) {
+	clock := newFakeClock()
+	f := testFilter(t, sensorFilterConfig{Stale: "3m", Unknown: "10m"})
+
+	if v, ok := f.reading(5, time.Time{}, clock.now); ok {
+		t.Fatalf("Reading without time-last-update passed: %s", v)
+	}
+	if v, ok := f.tick(time.Time{}, clock.advance(10*time.Minute+time.Second)); !ok || v != "unknown" {
+		t.Fatalf("Expected unknown, got %s %v", v, ok)
+	}
+}
+
+func TestFilterRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	f := testFilter(t, sensorFilterConfig{RateLimit: "1m"})
+
+	if v, ok := f.reading(1, clock.now, clock.now); !ok || v != "1" {
+		t.Fatalf("First reading should pass, got %s %v", v, ok)
+	}
+	clock.advance(10 * time.Second)
+	if _, ok := f.reading(2, clock.now, clock.now); ok {
+		t.Fatal("Reading inside the rate limit passed")
+	}
+	clock.advance(10 * time.Second)
+	if _, ok := f.reading(3, clock.now, clock.now); ok {
+		t.Fatal("Reading inside the rate limit passed")
+	}
+	if _, ok := f.tick(clock.now, clock.advance(30*time.Second)); ok {
+		t.Fatal("Held reading passed before the period was up")
+	}
+	if v, ok := f.tick(clock.now, clock.advance(10*time.Second)); !ok || v != "3" {
+		t.Fatalf("Expected the latest held reading, got %s %v", v, ok)
+	}
+	if _, ok := f.tick(clock.now, clock.advance(time.Minute)); ok {
+		t.Fatal("Held reading passed twice")
+	}
+}
+
+func TestBadFilter(t *testing.T) {
+	var tests = []sensorFilterConfig{
+		{Hysteresis: -1},
+		{Deadband: -1},
+		{Stale: "soon"},
+		{Stale: "10m", Unknown: "3m"},
+		{RateLimit: "0s"},
+	}
+
+	for _, test := range tests {
+		if _, err := newSensorFilter(test); err == nil {
+			t.Fatalf("Filter should have been rejected: %+v", test)
+		}
+	}
+
+	if _, err := parseRules([]byte("rules: [{name: x, trigger: {topic: a}, transforms: [{sensor: {stale: 3m}}], actions: [{log: x}]}]")); err == nil {
+		t.Fatal("Stale without updated should have been rejected")
+	}
+}
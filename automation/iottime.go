@@ -0,0 +1,107 @@
+/*
+ * The IOT time pulse.
+ *
+ * Devices keep time as seconds since the epoch, 2018-Nov-01.  This
+ * publishes that time so firmware can set its clock without NTP.
+ *
+ * The iottime: section of the rules file has
+ *	publish:	topic for the time, default environment/IOTtime
+ *	every:		how often, default 1m.  Pulses fall on multiples of
+ *			this, e.g. on the minute.
+ *	zone:		time zone for the local time, e.g. America/New_York.
+ *			By default, the zone of this machine.
+ *
+ * Each pulse publishes, none of them retained, as a stale time is
+ * worse than none:
+ *	<publish>/$local:	local date and time, e.g. 2026-10-18T23:01:02
+ *	<publish>/$offset:	seconds east of UTC, e.g. -14400
+ *	<publish>/$dst:		seconds of daylight saving in the offset, 0 or 3600
+ *	<publish>:		seconds since the epoch
+ * The time itself comes last, so the rest is current when it arrives.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultIOTTimePublish = "environment/IOTtime"
+	defaultIOTTimeEvery   = time.Minute
+	localTimeFormat       = "2006-01-02T15:04:05"
+)
+
+type iotTimeConfig struct {
+	Publish string `yaml:"publish"`
+	Every   string `yaml:"every"`
+	Zone    string `yaml:"zone"`
+}
+
+type iotTimeType struct {
+	publish  string
+	every    time.Duration
+	location *time.Location
+	next     time.Time // when the next pulse is due
+}
+
+func compileIOTTime(ic iotTimeConfig) (*iotTimeType, error) {
+	var err error
+
+	p := new(iotTimeType)
+	p.publish = ic.Publish
+	if p.publish == "" {
+		p.publish = defaultIOTTimePublish
+	}
+
+	p.every = defaultIOTTimeEvery
+	if ic.Every != "" {
+		p.every, err = time.ParseDuration(ic.Every)
+		if err != nil || p.every < time.Second {
+			return nil, fmt.Errorf("bad every %s", ic.Every)
+		}
+	}
+
+	p.location = time.Local
+	if ic.Zone != "" {
+		p.location, err = time.LoadLocation(ic.Zone)
+		if err != nil {
+			return nil, fmt.Errorf("bad zone %s: %v", ic.Zone, err)
+		}
+	}
+	return p, nil
+}
+
+// Seconds since the epoch, as devices keep time
+func iotTime(t time.Time) string {
+	return strconv.FormatInt(int64(t.Sub(epoch)/time.Second), 10)
+}
+
+// How much of the offset at t is daylight saving
+func dstOffset(t time.Time) int {
+	_, offset := t.Zone()
+	_, january := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location()).Zone()
+	_, july := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, t.Location()).Zone()
+
+	standard := january
+	if july < standard {
+		standard = july
+	}
+	return offset - standard
+}
+
+func (p *iotTimeType) tick(e *engineType, now time.Time) {
+	if now.Before(p.next) {
+		return
+	}
+	p.next = now.Truncate(p.every).Add(p.every)
+
+	local := now.In(p.location)
+	_, offset := local.Zone()
+	e.publish(p.publish+"/$local", local.Format(localTimeFormat), false)
+	e.publish(p.publish+"/$offset", strconv.Itoa(offset), false)
+	e.publish(p.publish+"/$dst", strconv.Itoa(dstOffset(local)), false)
+	e.publish(p.publish, iotTime(now), false)
+}
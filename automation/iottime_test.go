@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testIOTTime(t *testing.T, section string) (*engineType, *fakeClient) {
+	fullLogFileName = os.DevNull
+
+	config, err := parseRules([]byte(section + "\nrules: []\n"))
+	if err != nil {
+		t.Fatalf("Cannot parse iottime: %v", err)
+	}
+	c := new(fakeClient)
+	return newEngine(c, config), c
+}
+
+func TestIOTTimePulse(t *testing.T) {
+	e, c := testIOTTime(t, "iottime: {every: 1m}")
+	start := time.Date(2026, time.October, 18, 23, 1, 2, 0, time.Local)
+
+	for i := 0; i <= 120; i++ {
+		e.tick(start.Add(time.Duration(i) * time.Second))
+	}
+
+	// at the start, then on each minute
+	var pulses []string
+	for _, p := range c.published {
+		if p.topic == "environment/IOTtime" {
+			pulses = append(pulses, p.payload)
+			if p.retain {
+				t.Fatal("Time pulse retained")
+			}
+		}
+	}
+	want := []string{
+		iotTime(start),
+		iotTime(start.Truncate(time.Minute).Add(time.Minute)),
+		iotTime(start.Truncate(time.Minute).Add(2 * time.Minute)),
+	}
+	if len(pulses) != len(want) {
+		t.Fatalf("Pulses %v, expected %v", pulses, want)
+	}
+	for i := range want {
+		if pulses[i] != want[i] {
+			t.Fatalf("Pulses %v, expected %v", pulses, want)
+		}
+	}
+}
+
+// What is published decodes back to the time it was published
+func TestIOTTimeRoundTrip(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+
+	var tests = []struct {
+		when   time.Time
+		local  string
+		offset string
+		dst    string
+	}{
+		{time.Date(2026, time.October, 19, 3, 1, 2, 0, time.UTC), "2026-10-18T23:01:02", "-14400", "3600"},
+		{time.Date(2026, time.December, 25, 12, 0, 0, 0, time.UTC), "2026-12-25T07:00:00", "-18000", "0"},
+		{time.Date(2018, time.November, 1, 4, 0, 0, 0, time.UTC), "2018-11-01T00:00:00", "-14400", "3600"},
+	}
+
+	for _, test := range tests {
+		e, c := testIOTTime(t, "iottime: {zone: America/New_York}")
+		e.tick(test.when)
+
+		payload, _ := c.last("environment/IOTtime")
+		if got := parseDeviceTime(payload); !got.Equal(test.when) {
+			t.Fatalf("Published %s for %v, which decodes to %v", payload, test.when, got)
+		}
+		expect(t, c, "environment/IOTtime/$local", test.local)
+		expect(t, c, "environment/IOTtime/$offset", test.offset)
+		expect(t, c, "environment/IOTtime/$dst", test.dst)
+	}
+}
+
+func TestBadIOTTime(t *testing.T) {
+	var tests = []string{
+		"iottime: {every: often}",
+		"iottime: {every: 10ms}",
+		"iottime: {zone: Nowhere/Special}",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("Iottime should have been rejected: %s", test)
+		}
+	}
+}
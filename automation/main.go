@@ -1,8 +1,9 @@
 /*
  * First generation automation daemon.
  *
- * Ideally this is all driven by rules and such.
- * For now these items will be hard-coded:
+ * The rules are in a rules file, by default /etc/automation/rules.yaml.
+ * See rules.go for the format and rules.yaml for the rules themselves.
+ * These are the rules we run:
 
  * 	R1: The alarm state is propagated to an environmental state
  		Subscribe to: devices/alarm-state-0001/alarm-state/state
@@ -35,12 +36,55 @@
 		If the data is more than 10 minutes old, publish "unknown" as the temp value
 
  *	R6: Generate a usable value for how light it is outside.  0=dark, 7=bright.
- 		Create this value by averaging lux for 5 minutes, then converting.
+ 		Create this value from a rolling 5 minute average of lux.
 		Subscribe to:
 			environment/outdoor-lux
-			(not really, just uses value computed here)
 		Publish to:
 			environment/outdoor-light
+
+ *	R7: Dusk and dawn events, when the light level crosses 2.
+		Subscribe to:
+			environment/outdoor-light
+		Publish to:
+			environment/dusk
+			environment/dawn
+		The time of the event, retained.
+
+ *	R8: Values derived from the outdoor temperature, humidity and pressure
+		Subscribe to:
+			environment/outdoor-temp
+			environment/outdoor-humidity
+			environment/outdoor-pressure
+		Publish to:
+			environment/dew-point
+			environment/heat-index
+			environment/temp-rate
+			environment/pressure-trend
+			environment/pressure-tendency
+			environment/frost-risk
+		See derived.go.
+
+ *	R9: Notify when the alarm goes off
+		Subscribe to: environment/alarm-state
+		Publish to: the notifiers in the notify: section, see notify.go
+
+ *	R10: Notify when the alarm detector has been off line for 15 minutes
+		Look at:
+			environment/alarm-state/$reason
+			environment/alarm-state/$changed
+
+ *	R11: Notify when the alarm is still disarmed at 23:00
+		Look at: environment/alarm-state
+
+ *	R12: The time pulse, so devices can set their clocks without NTP
+		Publish to:
+			environment/IOTtime, seconds since the epoch, every minute
+			environment/IOTtime/$local, $offset and $dst
+		See iottime.go.
+
+ *	R13: Notify when the alarm is disarmed after going off
+		Subscribe to: environment/alarm-state
+		Publish to: the notifiers in the notify: section, see notify.go
  *
 */
 
@@ -52,51 +96,24 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/duke1swd/iotgo/zoneMinderAPI"
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
 const defaultLogDirectory = "/var/log"
 const logFileName = "HomeAutomationLog"
+const defaultRulesFileName = "/etc/automation/rules.yaml"
 
 var (
 	client          mqtt.Client
 	logDirectory    string
 	fullLogFileName string
-	sensorTime      map[string]time.Time
+	rulesFileName   string
 	epoch           time.Time
-	updateChan      chan interface{}
-	sensorExpire    time.Duration
-	sumLux          float64
-	nLux            int
 )
 
-type sensorStateType struct {
-	hysteresis float64
-	lastValue  float64
-	updateTime time.Time
-	valueKnown bool
-}
-
-type sensorUpdateValueType struct {
-	name  string
-	value float64
-}
-
-type sensorUpdateTimeType struct {
-	name       string
-	updateTime time.Time
-}
-
-// This is the list of sensors.
-var sensorStates = map[string]sensorStateType{
-	"lux":  {2., 0., *new(time.Time), false},
-	"temp": {.5, 0., *new(time.Time), false},
-}
-
 func init() {
 	logDirectory = os.Getenv("LOGDIR")
 	if len(logDirectory) < 1 {
@@ -104,261 +121,17 @@ func init() {
 	}
 	fullLogFileName = filepath.Join(logDirectory, logFileName)
 
-	// set the time to a long time ago.
-	for k, s := range sensorStates {
-		s.updateTime, _ = time.Parse("2006-Jan-02 MST", "2000-Jan-01 EST")
-		sensorStates[k] = s
+	rulesFileName = os.Getenv("RULESFILE")
+	if len(rulesFileName) < 1 {
+		rulesFileName = defaultRulesFileName
 	}
 
 	epoch, _ = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
-
-	sensorExpire, _ = time.ParseDuration("120s") // sensor data invalide if not refreshed every minute or so
-	updateChan = make(chan interface{})
-
-	sumLux = 0
-	nLux = 0
-}
-
-/*
- * Rule 1: subscribe to the device level alarm state
- * and publish to the environment level.
- *
- * The value of each alarm state is a code sent to the LED controller
- */
-var alarmStates = map[string]int{
-	"disarmed":        0,
-	"armed-stay":      10,
-	"alarmed-burglar": 5,
-	"alarmed-fire":    5,
-	"armed-away":      1,
-	"unknown":         0,
 }
 
-const (
-	DET_UNKNOWN int = 1 + iota
-	DET_ONLINE
-	DET_OFFLINE
-)
-
-var (
-	detState         int    = DET_UNKNOWN
-	detStateDetailed string = "unknown"
-	lastAlarmState   string = "unknown"
-)
-
-var stateMap = map[string]int{
-	"init":         DET_OFFLINE,
-	"ready":        DET_ONLINE,
-	"disconnected": DET_OFFLINE,
-	"sleeping":     DET_OFFLINE,
-	"lost":         DET_OFFLINE,
-	"alert":        DET_OFFLINE,
-}
-
-// Since both r1a and r1b can happen simultaneously there are race conditions her.
-// Right thing to do would be to push the detector state changes and the alarm state
-// changes to a go routine to serialize them. Maybe next version.
-
-// Changes in the alarm state come here.
-var r1ahandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	payload := string(msg.Payload())
-
-	if _, ok := alarmStates[payload]; ok {
-		if detState == DET_ONLINE {
-			client.Publish("environment/alarm-state", 0, true, payload)
-		}
-		logMessage("Alarm state: " + payload)
-		lastAlarmState = payload
-	} else {
-		logMessage("Invalid device alarm state: " + payload)
-	}
-}
-
-// Changes in whether the alarm detector is on line come here
-var r1bhandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	var newState int
-
-	payload := string(msg.Payload())
-
-	if detStateDetailed != payload {
-		detStateDetailed = payload
-		logMessage("Alarm Detector online state: " + payload)
-	}
-
-	newState, ok := stateMap[payload]
-	if !ok {
-		newState = DET_UNKNOWN
-	}
-
-	if newState != detState {
-		detState = newState
-		if newState == DET_ONLINE {
-			client.Publish("environment/alarm-state", 0, true, lastAlarmState)
-		} else {
-			client.Publish("environment/alarm-state", 0, true, "unknown")
-		}
-	}
-
-}
-
-var r23handler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-
-	payload := string(msg.Payload())
-	ledValue, ok := alarmStates[payload]
-	if !ok {
-		logMessage("Invalid environment alarm state: " + payload)
-		return
-	}
-
-	// Rule 2: Interior cameras are on if unless the alarm is off
-	if payload == "disarmed" {
-		zoneHome()
-	} else {
-		zoneAway()
-	}
-
-	// Rule 3: Display alarm state on the LED.
-	client.Publish("devices/led-0001/led/on/set", 0, true, strconv.Itoa(ledValue))
-}
-
-// Changes in the outdoor environment come here
-
-var r45subscriptions = []string{
-	"devices/environ-0001/lux/lux",
-	"devices/environ-0001/lux/time-last-update",
-	"devices/environ-0001/temp/temp",
-	"devices/environ-0001/temp/time-last-update",
-}
-
-var r45handler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	var (
-		updateValue sensorUpdateValueType
-		updateTime  sensorUpdateTimeType
-	)
-	topic := string(msg.Topic())
-	payload := string(msg.Payload())
-
-	topicComponents := strings.Split(topic, "/")
-	sensor := topicComponents[2]
-
-	switch topicComponents[3] {
-	case sensor:
-		// convert sensor value to a float64 and send it to the updater go routine
-		t, err := strconv.ParseFloat(payload, 64)
-		if err == nil {
-			updateValue.name = sensor
-			updateValue.value = t
-			updateChan <- updateValue
-		}
-	case "time-last-update":
-		// convert sensor last update time to a time.Time and send it to the updater go routine
-		t, err := strconv.ParseInt(payload, 10, 64)
-		if err == nil {
-			updateTime.name = sensor
-			updateTime.updateTime = epoch.Add(time.Duration(t) * time.Second)
-			updateChan <- updateTime
-		}
-	}
-}
-
-/*
- * Convert a lux value into a "light" value.
- * Conversion is by the table seen here
- */
-type luxLightType struct {
-	maxLux int
-	light  int
-}
-
-var luxConversion []luxLightType = []luxLightType{
-	{2, 0},
-	{100 * 1, 1},  //  100
-	{100 * 2, 2},  //  200
-	{100 * 4, 3},  //  400
-	{100 * 8, 4},  //  800
-	{100 * 16, 5}, // 1600
-	{100 * 32, 6}, // 3200
-}
-
-func luxToLight(lux float64) int64 {
-	for _, c := range luxConversion {
-		if lux <= float64(c.maxLux) {
-			return int64(c.light)
-		}
-	}
-	return int64(len(luxConversion))
-}
-
-/*
- * This function is a go routine that serializes updates to the sensorStates map.
- * It also implements a periodic timeout looking for sensors that have not updated in a while.
- */
-func sensorUpdateHandler(con context.Context, client mqtt.Client) {
-
-	// every so often wake up whether we've recieved any thing to do or not.
-	timeoutDuration, _ := time.ParseDuration("1m")
-	timeoutContext, _ := context.WithTimeout(con, timeoutDuration)
-	averageDuration, _ := time.ParseDuration("5m")
-	averageContext, _ := context.WithTimeout(con, averageDuration)
-	for {
-		select {
-		case data := <-updateChan:
-			switch update := data.(type) {
-			case sensorUpdateValueType:
-				s := sensorStates[update.name]
-				s.lastValue = update.value
-				s.valueKnown = true
-				sensorStates[update.name] = s
-				payload := strconv.FormatFloat(update.value, 'f', 1, 64)
-				client.Publish("environment/outdoor-"+update.name, 0, true, payload)
-				// Rule 6, compute average LUX
-				if update.name == "lux" {
-					nLux++
-					sumLux += update.value
-				}
-
-			case sensorUpdateTimeType:
-				s := sensorStates[update.name]
-				s.updateTime = update.updateTime
-				sensorStates[update.name] = s
-			}
-		case <-timeoutContext.Done():
-			// once a minute we come here and look for sensors who's last update time
-			// is too old and mark them as unknown.
-			for name, s := range sensorStates {
-				if time.Since(s.updateTime) > sensorExpire && s.valueKnown {
-					s.valueKnown = false
-					log.Printf("Sensor %s off line. Last update %v\n", name, s.updateTime)
-					sensorStates[name] = s
-					client.Publish("environment/outdoor-"+name, 0, true, "offline")
-				}
-			}
-			timeoutContext, _ = context.WithTimeout(con, timeoutDuration)
-		case <-averageContext.Done():
-			if nLux > 0 {
-				averageLight := luxToLight(sumLux / float64(nLux))
-				client.Publish("environment/outdoor-light", 0, true,
-					strconv.FormatInt(averageLight, 10))
-				averageContext, _ = context.WithTimeout(con, averageDuration)
-				nLux = 0
-				sumLux = 0
-			}
-		}
-	}
-}
-
-// Turn on the interior cameras
-func zoneAway() {
-	zoneState("Away")
-}
-
-// Turn off the interior cameras
-func zoneHome() {
-	zoneState("Home")
-}
-
-// Set a run state in Zoneminder
-func zoneState(state string) {
+// Used when there is no zoneminder: section in the rules file
+func zoneState(alarmState string) {
+	logMessage(fmt.Sprintf("ZoneMinder not configured, alarm state %s ignored", alarmState))
 }
 
 func main() {
@@ -376,28 +149,40 @@ func main() {
 
 	logMessage("Home Automation Daemon started")
 
-	if token := client.Subscribe("devices/alarm-state-0001/alarm-state/state", 0, r1ahandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
+	config, err := loadRules(rulesFileName)
+	if err != nil {
+		logMessage(err.Error())
+		log.Fatal(err)
 	}
 
-	if token := client.Subscribe("devices/alarm-state-0001/$state", 0, r1bhandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
+	engine := newEngine(client, config)
+
+	if config.zoneMinder != nil {
+		zmClient, err := zoneMinderAPI.NewFromCredentials(config.zoneMinder.url, config.zoneMinder.credentials)
+		if err != nil {
+			logMessage(err.Error())
+		} else {
+			zoneMinder := newZoneMinder(zmClient, config.zoneMinder)
+			go zoneMinder.run(context.Background())
+			engine.zoneState = zoneMinder.request
+		}
 	}
 
-	if token := client.Subscribe("environment/alarm-state", 0, r23handler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
+	if config.notify != nil {
+		notifier, err := newNotify(config.notify)
+		if err != nil {
+			logMessage(err.Error())
+		} else {
+			go notifier.run(context.Background())
+			engine.notify = notifier.request
+		}
 	}
 
-	go sensorUpdateHandler(context.Background(), client)
+	go engine.run(context.Background())
 
-	for _, s := range r45subscriptions {
-		if token := client.Subscribe(s, 0, r45handler); token.Wait() && token.Error() != nil {
-			fmt.Println(token.Error())
-			os.Exit(1)
-		}
+	if err := engine.subscribe(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	// sleep forever
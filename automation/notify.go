@@ -0,0 +1,446 @@
+/*
+ * Notifications to phones and people.
+ *
+ * Rules send notifications with the notify: action.  The notify: section
+ * of the rules file says where they go.  It has
+ *	rate-limit:	the same notification from the same rule is not sent
+ *			again within this, default 10m
+ *	max-per-hour:	at most this many notifications go to each notifier
+ *			in any hour, default 20
+ *	notifiers:	list of places notifications go, each with
+ *			  name: for the to: of a notify action, and the log
+ *			  kind: one of
+ *				ntfy: an ntfy style push.  The text is POSTed
+ *					to url:, with Title and Priority headers.
+ *				gotify: a Gotify push.  JSON is POSTed to
+ *					url:/message.
+ *				webhook: JSON with title, message, priority
+ *					and time is POSTed to url:
+ *				smtp: email to the to: list, from from:, by way
+ *					of the mail server at server:, host:port
+ *			  credentials: optional json file with any of user,
+ *				pass and token.  A token goes in the
+ *				Authorization header for ntfy, and X-Gotify-Key
+ *				for gotify.  User and pass are basic auth, or
+ *				smtp auth.
+ *
+ * Notifications are sent by their own go routine, so a slow server does
+ * not hold up the rule engine.  Rate limiting is done as a notification
+ * is asked for, in the engine go routine.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNotifyRateLimit  = 10 * time.Minute
+	defaultNotifyMaxPerHour = 20
+	notifyTimeout           = 30 * time.Second
+	notifyQueue             = 20
+)
+
+type notifyConfig struct {
+	RateLimit  string           `yaml:"rate-limit"`
+	MaxPerHour *int             `yaml:"max-per-hour"`
+	Notifiers  []notifierConfig `yaml:"notifiers"`
+}
+
+type notifierConfig struct {
+	Name        string   `yaml:"name"`
+	Kind        string   `yaml:"kind"`
+	URL         string   `yaml:"url"`
+	Server      string   `yaml:"server"`
+	From        string   `yaml:"from"`
+	To          []string `yaml:"to"`
+	Credentials string   `yaml:"credentials"`
+}
+
+type notifySettings struct {
+	rateLimit  time.Duration
+	maxPerHour int
+	notifiers  []notifierConfig
+}
+
+// What a notify action asks for
+type notificationType struct {
+	key      string // the rule
+	title    string
+	text     string
+	priority string // low, normal or high
+	to       []string
+	when     time.Time
+}
+
+// Something notifications can be sent to
+type notifier interface {
+	send(n notificationType) error
+}
+
+type deliveryType struct {
+	notification notificationType
+	to           []string
+}
+
+type notifyType struct {
+	settings  *notifySettings
+	names     []string // in the order listed
+	notifiers map[string]notifier
+	requests  chan deliveryType
+
+	lastSent map[string]time.Time   // by rule and text
+	sent     map[string][]time.Time // by notifier, in the last hour
+}
+
+var notifierKinds = map[string]bool{
+	"ntfy":    true,
+	"gotify":  true,
+	"webhook": true,
+	"smtp":    true,
+}
+
+var notifyPriorities = map[string]bool{
+	"low":    true,
+	"normal": true,
+	"high":   true,
+}
+
+func compileNotify(nc notifyConfig) (*notifySettings, error) {
+	var err error
+
+	s := new(notifySettings)
+	s.rateLimit = defaultNotifyRateLimit
+	if nc.RateLimit != "" {
+		s.rateLimit, err = time.ParseDuration(nc.RateLimit)
+		if err != nil || s.rateLimit < 0 {
+			return nil, fmt.Errorf("bad rate-limit %s", nc.RateLimit)
+		}
+	}
+
+	s.maxPerHour = defaultNotifyMaxPerHour
+	if nc.MaxPerHour != nil {
+		if *nc.MaxPerHour < 1 {
+			return nil, fmt.Errorf("max-per-hour must be at least 1")
+		}
+		s.maxPerHour = *nc.MaxPerHour
+	}
+
+	if len(nc.Notifiers) < 1 {
+		return nil, fmt.Errorf("no notifiers")
+	}
+	names := make(map[string]bool)
+	for _, c := range nc.Notifiers {
+		if c.Name == "" {
+			return nil, fmt.Errorf("notifier with no name")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("notifier %s listed twice", c.Name)
+		}
+		names[c.Name] = true
+
+		if !notifierKinds[c.Kind] {
+			return nil, fmt.Errorf("notifier %s kind %s is not ntfy, gotify, webhook or smtp", c.Name, c.Kind)
+		}
+		if c.Kind == "smtp" {
+			if c.Server == "" || c.From == "" || len(c.To) < 1 {
+				return nil, fmt.Errorf("notifier %s needs server, from and to", c.Name)
+			}
+		} else if c.URL == "" {
+			return nil, fmt.Errorf("notifier %s needs url", c.Name)
+		}
+	}
+	s.notifiers = nc.Notifiers
+	return s, nil
+}
+
+// Does the notify: section have this notifier?
+func (s *notifySettings) has(name string) bool {
+	for _, c := range s.notifiers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type credentialsType struct {
+	User  string `json:"user"`
+	Pass  string `json:"pass"`
+	Token string `json:"token"`
+}
+
+func readCredentials(fileName string) (credentialsType, error) {
+	var credentials credentialsType
+
+	if fileName == "" {
+		return credentials, nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return credentials, fmt.Errorf("Cannot read credentials file %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(content, &credentials); err != nil {
+		return credentials, fmt.Errorf("Cannot parse credentials in file %s: %v", fileName, err)
+	}
+	return credentials, nil
+}
+
+// Make the notifiers, reading their credentials
+func newNotify(settings *notifySettings) (*notifyType, error) {
+	n := new(notifyType)
+	n.settings = settings
+	n.notifiers = make(map[string]notifier)
+	n.requests = make(chan deliveryType, notifyQueue)
+	n.lastSent = make(map[string]time.Time)
+	n.sent = make(map[string][]time.Time)
+
+	httpClient := &http.Client{Timeout: notifyTimeout}
+	for _, c := range settings.notifiers {
+		credentials, err := readCredentials(c.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("Notifier %s: %v", c.Name, err)
+		}
+
+		switch c.Kind {
+		case "ntfy":
+			n.notifiers[c.Name] = &ntfyNotifier{client: httpClient, url: c.URL, credentials: credentials}
+		case "gotify":
+			n.notifiers[c.Name] = &gotifyNotifier{client: httpClient, url: c.URL, credentials: credentials}
+		case "webhook":
+			n.notifiers[c.Name] = &webhookNotifier{client: httpClient, url: c.URL, credentials: credentials}
+		case "smtp":
+			n.notifiers[c.Name] = &smtpNotifier{server: c.Server, from: c.From, to: c.To, credentials: credentials}
+		}
+		n.names = append(n.names, c.Name)
+	}
+	return n, nil
+}
+
+/*
+ * Ask for a notification.  Called by the engine, so never blocks.
+ * Notifications over the rate limits are logged and dropped.
+ */
+func (n *notifyType) request(note notificationType) {
+	key := note.key + "\n" + note.text
+	if last, ok := n.lastSent[key]; ok && note.when.Sub(last) < n.settings.rateLimit {
+		logMessage(fmt.Sprintf("Notification %q rate limited", note.text))
+		return
+	}
+
+	to := note.to
+	if len(to) < 1 {
+		to = n.names
+	}
+	var d deliveryType
+	d.notification = note
+	for _, name := range to {
+		var recent []time.Time
+		for _, t := range n.sent[name] {
+			if note.when.Sub(t) < time.Hour {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) >= n.settings.maxPerHour {
+			logMessage(fmt.Sprintf("Notifier %s: over %d an hour, %q dropped", name, n.settings.maxPerHour, note.text))
+			n.sent[name] = recent
+			continue
+		}
+		n.sent[name] = append(recent, note.when)
+		d.to = append(d.to, name)
+	}
+	if len(d.to) < 1 {
+		return
+	}
+	n.lastSent[key] = note.when
+
+	select {
+	case n.requests <- d:
+	default:
+		logMessage(fmt.Sprintf("Notification queue full, %q dropped", note.text))
+	}
+}
+
+// The notification go routine.  Runs until the context is cancelled.
+func (n *notifyType) run(con context.Context) {
+	for {
+		select {
+		case d := <-n.requests:
+			n.deliver(d)
+		case <-con.Done():
+			return
+		}
+	}
+}
+
+func (n *notifyType) deliver(d deliveryType) {
+	for _, name := range d.to {
+		if err := n.notifiers[name].send(d.notification); err != nil {
+			logMessage(fmt.Sprintf("Notifier %s: cannot send %q: %v", name, d.notification.text, err))
+		} else {
+			logMessage(fmt.Sprintf("Notifier %s: sent %q", name, d.notification.text))
+		}
+	}
+}
+
+func post(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+func postJSON(client *http.Client, url string, credentials credentialsType, body interface{}) (*http.Request, error) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if credentials.User != "" {
+		req.SetBasicAuth(credentials.User, credentials.Pass)
+	}
+	return req, nil
+}
+
+type ntfyNotifier struct {
+	client      *http.Client
+	url         string
+	credentials credentialsType
+}
+
+var ntfyPriorities = map[string]string{
+	"low":    "2",
+	"normal": "3",
+	"high":   "5",
+}
+
+func (p *ntfyNotifier) send(n notificationType) error {
+	req, err := http.NewRequest("POST", p.url, strings.NewReader(n.text))
+	if err != nil {
+		return err
+	}
+	if n.title != "" {
+		req.Header.Set("Title", n.title)
+	}
+	req.Header.Set("Priority", ntfyPriorities[n.priority])
+	if p.credentials.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.credentials.Token)
+	} else if p.credentials.User != "" {
+		req.SetBasicAuth(p.credentials.User, p.credentials.Pass)
+	}
+	return post(p.client, req)
+}
+
+type gotifyNotifier struct {
+	client      *http.Client
+	url         string
+	credentials credentialsType
+}
+
+var gotifyPriorities = map[string]int{
+	"low":    2,
+	"normal": 5,
+	"high":   8,
+}
+
+func (p *gotifyNotifier) send(n notificationType) error {
+	body := struct {
+		Title    string `json:"title,omitempty"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}{n.title, n.text, gotifyPriorities[n.priority]}
+
+	req, err := postJSON(p.client, strings.TrimSuffix(p.url, "/")+"/message", p.credentials, body)
+	if err != nil {
+		return err
+	}
+	if p.credentials.Token != "" {
+		req.Header.Set("X-Gotify-Key", p.credentials.Token)
+	}
+	return post(p.client, req)
+}
+
+type webhookNotifier struct {
+	client      *http.Client
+	url         string
+	credentials credentialsType
+}
+
+func (p *webhookNotifier) send(n notificationType) error {
+	body := struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority string `json:"priority"`
+		Time     string `json:"time"`
+	}{n.title, n.text, n.priority, n.when.Format(time.RFC3339)}
+
+	req, err := postJSON(p.client, p.url, p.credentials, body)
+	if err != nil {
+		return err
+	}
+	if p.credentials.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.credentials.Token)
+	}
+	return post(p.client, req)
+}
+
+type smtpNotifier struct {
+	server      string
+	from        string
+	to          []string
+	credentials credentialsType
+}
+
+func (p *smtpNotifier) send(n notificationType) error {
+	var auth smtp.Auth
+
+	if p.credentials.User != "" {
+		host, _, err := net.SplitHostPort(p.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", p.credentials.User, p.credentials.Pass, host)
+	}
+
+	subject := n.title
+	if subject == "" {
+		subject = n.text
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", p.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(p.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.when.Format(time.RFC1123Z))
+	if n.priority == "high" {
+		msg.WriteString("X-Priority: 1\r\n")
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(n.text + "\r\n")
+
+	return smtp.SendMail(p.server, auth, p.from, p.to, msg.Bytes())
+}
+
+// Used when there is no notify: section in the rules file
+func notify(note notificationType) {
+	logMessage(fmt.Sprintf("Notifications not configured, %q not sent", note.text))
+}
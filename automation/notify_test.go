@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A request as the fake push server saw it
+type pushType struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+func fakePushServer(t *testing.T) (*httptest.Server, chan pushType) {
+	pushes := make(chan pushType, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes <- pushType{path: r.URL.Path, header: r.Header, body: string(body)}
+	}))
+	t.Cleanup(server.Close)
+	return server, pushes
+}
+
+/*
+ * Just enough of an SMTP server for net/smtp.  Each message's data is
+ * sent down the channel.
+ */
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	messages := make(chan string, 10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := textproto.NewConn(conn)
+				defer c.Close()
+				c.PrintfLine("220 localhost fake")
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "EHLO", "HELO":
+						c.PrintfLine("250 localhost")
+					case "DATA":
+						c.PrintfLine("354 go ahead")
+						data, err := c.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						messages <- string(data)
+						c.PrintfLine("250 OK")
+					case "QUIT":
+						c.PrintfLine("221 bye")
+						return
+					default:
+						c.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func testNotify(t *testing.T, section string) *notifyType {
+	fullLogFileName = os.DevNull
+
+	config, err := parseRules([]byte(section + "\nrules: []\n"))
+	if err != nil {
+		t.Fatalf("Cannot parse notify: %v", err)
+	}
+	n, err := newNotify(config.notify)
+	if err != nil {
+		t.Fatalf("Cannot make notifiers: %v", err)
+	}
+	return n
+}
+
+func receive(t *testing.T, pushes chan pushType) pushType {
+	t.Helper()
+	select {
+	case p := <-pushes:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing pushed")
+	}
+	return pushType{}
+}
+
+func TestNotifiers(t *testing.T) {
+	server, pushes := fakePushServer(t)
+	mailServer, mail := fakeSMTPServer(t)
+
+	credentials := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(credentials, []byte(`{"token": "secret"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := testNotify(t, fmt.Sprintf(`
+notify:
+  notifiers:
+    - {name: phone, kind: ntfy, url: %s/alarm, credentials: %s}
+    - {name: gotify, kind: gotify, url: %s/, credentials: %s}
+    - {name: hook, kind: webhook, url: %s/hook}
+    - {name: email, kind: smtp, server: %s, from: a@localhost, to: [b@localhost, c@localhost]}
+`, server.URL, credentials, server.URL, credentials, server.URL, mailServer))
+
+	when := time.Date(2026, time.October, 18, 23, 1, 2, 0, time.UTC)
+	n.request(notificationType{key: "R9", title: "Alarm", text: "alarmed-fire", priority: "high", when: when})
+	n.deliver(<-n.requests)
+
+	p := receive(t, pushes)
+	if p.path != "/alarm" || p.body != "alarmed-fire" || p.header.Get("Title") != "Alarm" ||
+		p.header.Get("Priority") != "5" || p.header.Get("Authorization") != "Bearer secret" {
+		t.Fatalf("Bad ntfy push %v", p)
+	}
+
+	p = receive(t, pushes)
+	if p.path != "/message" || p.header.Get("X-Gotify-Key") != "secret" ||
+		p.body != `{"title":"Alarm","message":"alarmed-fire","priority":8}` {
+		t.Fatalf("Bad gotify push %v", p)
+	}
+
+	p = receive(t, pushes)
+	if p.path != "/hook" || p.header.Get("Content-Type") != "application/json" ||
+		p.body != `{"title":"Alarm","message":"alarmed-fire","priority":"high","time":"2026-10-18T23:01:02Z"}` {
+		t.Fatalf("Bad webhook push %v", p)
+	}
+
+	select {
+	case m := <-mail:
+		for _, want := range []string{"Subject: Alarm", "To: b@localhost, c@localhost", "X-Priority: 1", "\nalarmed-fire"} {
+			if !strings.Contains(m, want) {
+				t.Fatalf("Mail lacks %q: %s", want, m)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No mail")
+	}
+}
+
+func TestNotifyFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	p := &webhookNotifier{client: http.DefaultClient, url: server.URL}
+	if err := p.send(notificationType{text: "x"}); err == nil {
+		t.Fatal("Send should have failed")
+	}
+}
+
+// Records what would have been sent
+type fakeNotifier struct {
+	sent []string
+}
+
+func (f *fakeNotifier) send(n notificationType) error {
+	f.sent = append(f.sent, n.text)
+	return nil
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	n := testNotify(t, `
+notify:
+  rate-limit: 10m
+  max-per-hour: 3
+  notifiers:
+    - {name: a, kind: webhook, url: http://localhost/a}
+    - {name: b, kind: webhook, url: http://localhost/b}
+`)
+	a, b := new(fakeNotifier), new(fakeNotifier)
+	n.notifiers["a"] = a
+	n.notifiers["b"] = b
+
+	start := time.Now()
+	var tests = []struct {
+		after time.Duration
+		key   string
+		text  string
+		to    []string
+	}{
+		{0, "R1", "one", nil},
+		{time.Minute, "R1", "one", nil},        // rate limited
+		{time.Minute, "R2", "one", nil},        // another rule
+		{2 * time.Minute, "R1", "two", nil},    // another message
+		{11 * time.Minute, "R1", "three", nil}, // the fourth this hour
+		{61 * time.Minute, "R1", "four", []string{"a"}},
+	}
+	for _, test := range tests {
+		n.request(notificationType{key: test.key, text: test.text, to: test.to, when: start.Add(test.after)})
+		for len(n.requests) > 0 {
+			n.deliver(<-n.requests)
+		}
+	}
+
+	if got := strings.Join(a.sent, ","); got != "one,one,two,four" {
+		t.Fatalf("a sent %s", got)
+	}
+	if got := strings.Join(b.sent, ","); got != "one,one,two" {
+		t.Fatalf("b sent %s", got)
+	}
+}
+
+// R9 to R11 and R13 in rules.yaml
+func TestNotifyRules(t *testing.T) {
+	var notes []notificationType
+
+	e, c, _ := testEngine(t)
+	e.notify = func(note notificationType) {
+		notes = append(notes, note)
+	}
+	now := time.Date(2026, time.October, 18, 22, 0, 0, 0, time.Local)
+
+	send(e, c, "devices/alarm-state-0001/$state", "ready", now)
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "alarmed-burglar", now)
+	if len(notes) != 1 || notes[0].priority != "high" || notes[0].title != "Alarm" ||
+		notes[0].text != "Alarm: alarmed-burglar" {
+		t.Fatalf("Expected an alarm notification, got %v", notes)
+	}
+
+	// disarmed after the alarm, and then again, which is no news
+	notes = nil
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "disarmed", now)
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "armed-away", now)
+	send(e, c, "devices/alarm-state-0001/alarm-state/state", "disarmed", now)
+	if len(notes) != 1 || notes[0].key != "R13 disarmed after alarm" || notes[0].text != "Alarm disarmed" {
+		t.Fatalf("Expected one disarmed notification, got %v", notes)
+	}
+
+	// the detector goes off line
+	notes = nil
+	send(e, c, "devices/alarm-state-0001/$state", "lost", now)
+	for i := 0; i <= 15; i++ {
+		tick(e, c, now.Add(time.Duration(i)*time.Minute))
+	}
+	if len(notes) != 0 {
+		t.Fatalf("Notified too soon: %v", notes)
+	}
+	tick(e, c, now.Add(16*time.Minute))
+	if len(notes) != 1 || notes[0].text != "Alarm detector off line since "+now.Format(time.RFC3339) {
+		t.Fatalf("Expected a detector notification, got %v", notes)
+	}
+
+	// back, and still disarmed at 23:00
+	notes = nil
+	send(e, c, "devices/alarm-state-0001/$state", "ready", now.Add(30*time.Minute))
+	tick(e, c, now.Add(59*time.Minute))
+	if len(notes) != 0 {
+		t.Fatalf("Notified too soon: %v", notes)
+	}
+	tick(e, c, now.Add(time.Hour))
+	if len(notes) != 1 || notes[0].text != "The alarm is still disarmed" {
+		t.Fatalf("Expected a reminder, got %v", notes)
+	}
+}
+
+// An alarm the panel keeps reporting is notified once per rate-limit
+func TestNotifyRepeatedAlarm(t *testing.T) {
+	n := testNotify(t, `
+notify:
+  rate-limit: 10m
+  notifiers:
+    - {name: a, kind: webhook, url: http://localhost/a}
+`)
+	a := new(fakeNotifier)
+	n.notifiers["a"] = a
+
+	e, c, _ := testEngine(t)
+	e.notify = n.request
+	now := time.Date(2026, time.October, 18, 22, 0, 0, 0, time.Local)
+
+	send(e, c, "devices/alarm-state-0001/$state", "ready", now)
+	for i := 0; i < 5; i++ {
+		send(e, c, "devices/alarm-state-0001/alarm-state/state", "alarmed-burglar",
+			now.Add(time.Duration(i)*time.Minute))
+	}
+	for len(n.requests) > 0 {
+		n.deliver(<-n.requests)
+	}
+	if got := strings.Join(a.sent, ","); got != "Alarm: alarmed-burglar" {
+		t.Fatalf("a sent %s", got)
+	}
+}
+
+func TestBadNotify(t *testing.T) {
+	var tests = []string{
+		"notify: {notifiers: []}",
+		"notify: {notifiers: [{kind: ntfy, url: x}]}",
+		"notify: {notifiers: [{name: a, kind: pager, url: x}]}",
+		"notify: {notifiers: [{name: a, kind: ntfy}]}",
+		"notify: {notifiers: [{name: a, kind: smtp, server: x, from: y}]}",
+		"notify: {notifiers: [{name: a, kind: ntfy, url: x}, {name: a, kind: ntfy, url: y}]}",
+		"notify: {rate-limit: often, notifiers: [{name: a, kind: ntfy, url: x}]}",
+		"notify: {max-per-hour: 0, notifiers: [{name: a, kind: ntfy, url: x}]}",
+		"rules: [{trigger: {topic: a}, actions: [{notify: x, priority: urgent}]}]",
+		"rules: [{trigger: {topic: a}, actions: [{notify: x, to: [a]}]}]",
+		"rules: [{trigger: {topic: a}, actions: [{log: x, title: y}]}]",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("Notify should have been rejected: %s", test)
+		}
+	}
+}
@@ -0,0 +1,615 @@
+/*
+ * Loading of the rules file.
+ *
+ * The rules file is YAML.  It holds optional alarm:, zoneminder: and
+ * notify: sections, described in alarm.go, zoneminder.go and notify.go,
+ * an optional list of
+ * quantities, described in aggregate.go, optional derived: and iottime:
+ * sections, described in derived.go and iottime.go, and a list of rules,
+ * each of which has
+ *	name:		for the log
+ *	trigger:	what runs the rule.  One of
+ *			  topic: an mqtt topic.  May use the + and # wildcards.
+ *			  every: a duration, e.g. 1m
+ *			  cron: "minute hour day-of-month month day-of-week"
+ *	if:		a list of conditions, all of which must hold.  Each looks at
+ *			the trigger value, or at the last value seen on "topic:", and
+ *			is one of
+ *			  in: [list of values]
+ *			  not-in: [list of values]
+ *			  numeric: true
+ *			  above: number
+ *			  below: number
+ *			  older: duration.  The value is a device time, in seconds
+ *				since the epoch, or a time such as
+ *				2026-10-18T23:01:02-04:00, and is older than this.
+ *	transforms:	a list of steps the value goes through.  A step may stop
+ *			the rule.  Each is one of
+ *			  map: {from: to, ...}, with optional default:.  Values
+ *				not mapped, and with no default, stop the rule.
+ *			  hysteresis: band.  Stops values within band of the last
+ *				value passed, or of the value on "against:" if given.
+ *			  average: duration.  Passes on the average of the
+ *				values seen in the last period, each time a
+ *				value arrives or an old one drops out.
+ *			  lookup: [{max: number, value: v}, ...], with optional
+ *				default:.  The value of the first entry whose max
+ *				is at least the incoming value.
+ *			  format: a printf format for a number, e.g. "%.1f"
+ *			  changes: true.  Stops values that are the same as the
+ *				last one passed.
+ *			  after: [list of values].  Stops values unless the one
+ *				that came before was in the list.
+ *			  sensor: the sensor filter described in filter.go
+ *			  edge: {fall-below: n, rise-above: m, falling: x,
+ *				rising: y}.  Passes on x when the value drops
+ *				below n, having been above m, and y when it goes
+ *				back above m.  Anything else stops the rule.
+ *	actions:	a list of things to do with the value.  Each is one of
+ *			  publish: topic, with optional payload: and retain:.
+ *				The topic may be a template.
+ *			  zoneminder: alarm state.  ZoneMinder is changed to
+ *				the run state the zoneminder: section maps it to.
+ *			  log: message
+ *			  notify: message, with optional title:, priority: of
+ *				low, normal or high, and to:, a list of
+ *				notifiers.  By default, all of them.
+ *
+ * Map values, payloads, alarm states, log messages, and notification
+ * messages and titles may refer to
+ * {{value}}, the value coming out of the transforms, {{trigger}}, the
+ * topic that triggered the rule, {{time}}, the time now, or
+ * {{some/topic}}, the last value seen on some/topic.  {{some/topic|x}}
+ * is x if nothing has been seen.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type rulesFileType struct {
+	Alarm      *alarmConfig      `yaml:"alarm"`
+	ZoneMinder *zoneMinderConfig `yaml:"zoneminder"`
+	Notify     *notifyConfig     `yaml:"notify"`
+	Quantities []quantityConfig  `yaml:"quantities"`
+	Derived    *derivedConfig    `yaml:"derived"`
+	IOTTime    *iotTimeConfig    `yaml:"iottime"`
+	Rules      []ruleConfig      `yaml:"rules"`
+}
+
+type ruleConfig struct {
+	Name       string            `yaml:"name"`
+	Trigger    triggerConfig     `yaml:"trigger"`
+	If         []conditionConfig `yaml:"if"`
+	Transforms []transformConfig `yaml:"transforms"`
+	Actions    []actionConfig    `yaml:"actions"`
+}
+
+type triggerConfig struct {
+	Topic string `yaml:"topic"`
+	Every string `yaml:"every"`
+	Cron  string `yaml:"cron"`
+}
+
+type conditionConfig struct {
+	Topic   string   `yaml:"topic"`
+	In      []string `yaml:"in"`
+	NotIn   []string `yaml:"not-in"`
+	Numeric bool     `yaml:"numeric"`
+	Above   *float64 `yaml:"above"`
+	Below   *float64 `yaml:"below"`
+	Older   string   `yaml:"older"`
+}
+
+type transformConfig struct {
+	Map        map[string]string   `yaml:"map"`
+	Default    *string             `yaml:"default"`
+	Hysteresis *float64            `yaml:"hysteresis"`
+	Against    string              `yaml:"against"`
+	Average    string              `yaml:"average"`
+	Lookup     []lookupConfig      `yaml:"lookup"`
+	Format     string              `yaml:"format"`
+	Changes    bool                `yaml:"changes"`
+	After      []string            `yaml:"after"`
+	Sensor     *sensorFilterConfig `yaml:"sensor"`
+	Edge       *edgeConfig         `yaml:"edge"`
+}
+
+type edgeConfig struct {
+	FallBelow *float64 `yaml:"fall-below"`
+	RiseAbove *float64 `yaml:"rise-above"`
+	Falling   string   `yaml:"falling"`
+	Rising    string   `yaml:"rising"`
+}
+
+type lookupConfig struct {
+	Max   float64 `yaml:"max"`
+	Value string  `yaml:"value"`
+}
+
+type actionConfig struct {
+	Publish    string   `yaml:"publish"`
+	Payload    string   `yaml:"payload"`
+	Retain     bool     `yaml:"retain"`
+	Zoneminder string   `yaml:"zoneminder"`
+	Log        string   `yaml:"log"`
+	Notify     string   `yaml:"notify"`
+	Title      string   `yaml:"title"`
+	Priority   string   `yaml:"priority"`
+	To         []string `yaml:"to"`
+}
+
+// A compiled rules file
+type configType struct {
+	rules      []*ruleType
+	quantities []*quantityType
+	alarm      *alarmType          // nil if there is no alarm: section
+	zoneMinder *zoneMinderSettings // nil if there is no zoneminder: section
+	notify     *notifySettings     // nil if there is no notify: section
+	derived    *derivedType        // nil if there is no derived: section
+	iotTime    *iotTimeType        // nil if there is no iottime: section
+}
+
+var templateMatch *regexp.Regexp = regexp.MustCompile("{{([^}]*)}}")
+
+// Read and compile a rules file
+func loadRules(fileName string) (*configType, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read rules file %s: %v", fileName, err)
+	}
+	return parseRules(content)
+}
+
+func parseRules(content []byte) (*configType, error) {
+	var rulesFile rulesFileType
+
+	err := yaml.UnmarshalStrict(content, &rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse rules: %v", err)
+	}
+
+	config := new(configType)
+	if rulesFile.Alarm != nil {
+		config.alarm, err = compileAlarm(*rulesFile.Alarm)
+		if err != nil {
+			return nil, fmt.Errorf("alarm: %v", err)
+		}
+	}
+	if rulesFile.ZoneMinder != nil {
+		config.zoneMinder, err = compileZoneMinder(*rulesFile.ZoneMinder)
+		if err != nil {
+			return nil, fmt.Errorf("zoneminder: %v", err)
+		}
+	}
+	if rulesFile.Notify != nil {
+		config.notify, err = compileNotify(*rulesFile.Notify)
+		if err != nil {
+			return nil, fmt.Errorf("notify: %v", err)
+		}
+	}
+
+	for i, qc := range rulesFile.Quantities {
+		q, err := compileQuantity(qc)
+		if err != nil {
+			name := qc.Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			return nil, fmt.Errorf("Quantity %s: %v", name, err)
+		}
+		config.quantities = append(config.quantities, q)
+	}
+
+	if rulesFile.Derived != nil {
+		config.derived, err = compileDerived(*rulesFile.Derived)
+		if err != nil {
+			return nil, fmt.Errorf("derived: %v", err)
+		}
+	}
+	if rulesFile.IOTTime != nil {
+		config.iotTime, err = compileIOTTime(*rulesFile.IOTTime)
+		if err != nil {
+			return nil, fmt.Errorf("iottime: %v", err)
+		}
+	}
+
+	rules := make([]*ruleType, 0, len(rulesFile.Rules))
+	for i, rc := range rulesFile.Rules {
+		r, err := compileRule(rc)
+		if err != nil {
+			name := rc.Name
+			if name == "" {
+				name = strconv.Itoa(i + 1)
+			}
+			return nil, fmt.Errorf("Rule %s: %v", name, err)
+		}
+		for _, a := range r.actions {
+			for _, to := range a.to {
+				if config.notify == nil || !config.notify.has(to) {
+					return nil, fmt.Errorf("Rule %s: no notifier %s", r.name, to)
+				}
+			}
+		}
+		rules = append(rules, r)
+	}
+	config.rules = rules
+	return config, nil
+}
+
+func compileRule(rc ruleConfig) (*ruleType, error) {
+	var err error
+
+	r := new(ruleType)
+	r.name = rc.Name
+
+	triggers := 0
+	if rc.Trigger.Topic != "" {
+		triggers++
+		r.topic = rc.Trigger.Topic
+	}
+	if rc.Trigger.Every != "" {
+		triggers++
+		r.every, err = time.ParseDuration(rc.Trigger.Every)
+		if err != nil || r.every <= 0 {
+			return nil, fmt.Errorf("bad trigger interval %s", rc.Trigger.Every)
+		}
+	}
+	if rc.Trigger.Cron != "" {
+		triggers++
+		r.cron, err = parseCron(rc.Trigger.Cron)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if triggers != 1 {
+		return nil, fmt.Errorf("needs exactly one of topic, every or cron in its trigger")
+	}
+
+	for _, cc := range rc.If {
+		c, err := compileCondition(cc)
+		if err != nil {
+			return nil, err
+		}
+		r.conditions = append(r.conditions, c)
+	}
+
+	for _, tc := range rc.Transforms {
+		t, err := compileTransform(tc)
+		if err != nil {
+			return nil, err
+		}
+		r.transforms = append(r.transforms, t)
+	}
+
+	if len(rc.Actions) < 1 {
+		return nil, fmt.Errorf("has no actions")
+	}
+	for _, ac := range rc.Actions {
+		kinds := 0
+		var a actionType
+		if ac.Publish != "" {
+			kinds++
+			a.kind = "publish"
+			a.topic = ac.Publish
+			a.text = ac.Payload
+			if a.text == "" {
+				a.text = "{{value}}"
+			}
+			a.retain = ac.Retain
+		}
+		if ac.Zoneminder != "" {
+			kinds++
+			a.kind = "zoneminder"
+			a.text = ac.Zoneminder
+		}
+		if ac.Log != "" {
+			kinds++
+			a.kind = "log"
+			a.text = ac.Log
+		}
+		if ac.Notify != "" {
+			kinds++
+			a.kind = "notify"
+			a.text = ac.Notify
+			a.title = ac.Title
+			a.priority = ac.Priority
+			if a.priority == "" {
+				a.priority = "normal"
+			}
+			if !notifyPriorities[a.priority] {
+				return nil, fmt.Errorf("priority %s is not low, normal or high", a.priority)
+			}
+			a.to = ac.To
+		} else if ac.Title != "" || ac.Priority != "" || ac.To != nil {
+			return nil, fmt.Errorf("title, priority and to go with notify")
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("each action must be exactly one of publish, zoneminder, log or notify")
+		}
+		r.actions = append(r.actions, a)
+	}
+
+	return r, nil
+}
+
+func compileCondition(cc conditionConfig) (c conditionType, err error) {
+	c.topic = cc.Topic
+	c.numeric = cc.Numeric
+	c.above = cc.Above
+	c.below = cc.Below
+
+	if cc.In != nil {
+		c.in = make(map[string]bool)
+		for _, v := range cc.In {
+			c.in[v] = true
+		}
+	}
+	if cc.NotIn != nil {
+		c.notIn = make(map[string]bool)
+		for _, v := range cc.NotIn {
+			c.notIn[v] = true
+		}
+	}
+	if cc.Older != "" {
+		c.older, err = time.ParseDuration(cc.Older)
+		if err != nil || c.older <= 0 {
+			return c, fmt.Errorf("bad duration %s in condition", cc.Older)
+		}
+	}
+
+	if c.in == nil && c.notIn == nil && !c.numeric && c.above == nil && c.below == nil && c.older == 0 {
+		return c, fmt.Errorf("condition tests nothing")
+	}
+	return c, nil
+}
+
+func compileTransform(tc transformConfig) (transform, error) {
+	var t transform
+
+	kinds := 0
+	if tc.Map != nil {
+		kinds++
+		t = &mapTransform{table: tc.Map, otherwise: tc.Default}
+	}
+	if tc.Hysteresis != nil {
+		kinds++
+		if *tc.Hysteresis < 0 {
+			return nil, fmt.Errorf("negative hysteresis")
+		}
+		t = &hysteresisTransform{band: *tc.Hysteresis, against: tc.Against}
+	}
+	if tc.Average != "" {
+		kinds++
+		window, err := time.ParseDuration(tc.Average)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("bad average period %s", tc.Average)
+		}
+		t = &averageTransform{window: window}
+	}
+	if tc.Lookup != nil {
+		kinds++
+		table := make([]lookupEntry, len(tc.Lookup))
+		for i, l := range tc.Lookup {
+			if i > 0 && l.Max < tc.Lookup[i-1].Max {
+				return nil, fmt.Errorf("lookup table is not in increasing order")
+			}
+			table[i] = lookupEntry{max: l.Max, value: l.Value}
+		}
+		t = &lookupTransform{table: table, otherwise: tc.Default}
+	}
+	if tc.Format != "" {
+		kinds++
+		t = &formatTransform{format: tc.Format}
+	}
+	if tc.Changes {
+		kinds++
+		t = &changesTransform{}
+	}
+	if tc.After != nil {
+		kinds++
+		from := make(map[string]bool)
+		for _, v := range tc.After {
+			from[v] = true
+		}
+		t = &afterTransform{from: from}
+	}
+	if tc.Sensor != nil {
+		kinds++
+		filter, err := newSensorFilter(*tc.Sensor)
+		if err != nil {
+			return nil, fmt.Errorf("sensor: %v", err)
+		}
+		if tc.Sensor.Updated == "" && (filter.stale > 0 || filter.unknown > 0) {
+			return nil, fmt.Errorf("sensor: stale and unknown need updated")
+		}
+		t = &sensorTransform{updated: tc.Sensor.Updated, filter: filter}
+	}
+
+	if tc.Edge != nil {
+		kinds++
+		ec := tc.Edge
+		if ec.FallBelow == nil || ec.RiseAbove == nil || ec.Falling == "" || ec.Rising == "" {
+			return nil, fmt.Errorf("edge needs fall-below, rise-above, falling and rising")
+		}
+		if *ec.FallBelow > *ec.RiseAbove {
+			return nil, fmt.Errorf("edge fall-below is above rise-above")
+		}
+		t = &edgeTransform{fallBelow: *ec.FallBelow, riseAbove: *ec.RiseAbove, falling: ec.Falling, rising: ec.Rising}
+	}
+
+	if kinds != 1 {
+		return nil, fmt.Errorf("each transform must be exactly one of map, hysteresis, average, lookup, format, changes, after, sensor or edge")
+	}
+	if tc.Default != nil && tc.Map == nil && tc.Lookup == nil {
+		return nil, fmt.Errorf("default only applies to map and lookup")
+	}
+	if tc.Against != "" && tc.Hysteresis == nil {
+		return nil, fmt.Errorf("against only applies to hysteresis")
+	}
+	return t, nil
+}
+
+// The topics a rule needs to see: its trigger, and any it looks at
+func (r *ruleType) topics() []string {
+	var topics []string
+
+	if r.topic != "" {
+		topics = append(topics, r.topic)
+	}
+	for _, c := range r.conditions {
+		if c.topic != "" {
+			topics = append(topics, c.topic)
+		}
+	}
+	for _, t := range r.transforms {
+		switch tt := t.(type) {
+		case *mapTransform:
+			for _, v := range tt.table {
+				topics = append(topics, templateTopics(v)...)
+			}
+			if tt.otherwise != nil {
+				topics = append(topics, templateTopics(*tt.otherwise)...)
+			}
+		case *hysteresisTransform:
+			if tt.against != "" {
+				topics = append(topics, tt.against)
+			}
+		case *sensorTransform:
+			if tt.updated != "" {
+				topics = append(topics, tt.updated)
+			}
+		}
+	}
+	for _, a := range r.actions {
+		topics = append(topics, templateTopics(a.topic)...)
+		topics = append(topics, templateTopics(a.text)...)
+	}
+	return topics
+}
+
+// The topics a template refers to
+func templateTopics(text string) []string {
+	var topics []string
+
+	for _, m := range templateMatch.FindAllStringSubmatch(text, -1) {
+		name := strings.SplitN(m[1], "|", 2)[0]
+		if name != "value" && name != "trigger" && name != "time" {
+			topics = append(topics, name)
+		}
+	}
+	return topics
+}
+
+/*
+ * A cron spec is five fields: minute, hour, day of month, month and
+ * day of week (0 is Sunday).  Each is "*", a number, a range "a-b",
+ * any of those followed by "/step", or a comma separated list of them.
+ * A number followed by "/step" runs from the number to the maximum.
+ */
+type cronType struct {
+	minutes     [60]bool
+	hours       [24]bool
+	daysOfMonth [32]bool
+	months      [13]bool
+	daysOfWeek  [7]bool
+	anyDOM      bool
+	anyDOW      bool
+}
+
+func parseCron(spec string) (*cronType, error) {
+	var err error
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec \"%s\" does not have five fields", spec)
+	}
+
+	c := new(cronType)
+	if err = parseCronField(fields[0], c.minutes[:], 0); err != nil {
+		return nil, fmt.Errorf("cron spec \"%s\" minutes: %v", spec, err)
+	}
+	if err = parseCronField(fields[1], c.hours[:], 0); err != nil {
+		return nil, fmt.Errorf("cron spec \"%s\" hours: %v", spec, err)
+	}
+	if err = parseCronField(fields[2], c.daysOfMonth[:], 1); err != nil {
+		return nil, fmt.Errorf("cron spec \"%s\" days of month: %v", spec, err)
+	}
+	if err = parseCronField(fields[3], c.months[:], 1); err != nil {
+		return nil, fmt.Errorf("cron spec \"%s\" months: %v", spec, err)
+	}
+	if err = parseCronField(fields[4], c.daysOfWeek[:], 0); err != nil {
+		return nil, fmt.Errorf("cron spec \"%s\" days of week: %v", spec, err)
+	}
+	c.anyDOM = fields[2] == "*"
+	c.anyDOW = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, set []bool, min int) error {
+	max := len(set) - 1
+
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return fmt.Errorf("bad step in \"%s\"", part)
+			}
+			step, stepped = s, true
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			l, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return fmt.Errorf("bad value \"%s\"", part)
+			}
+			low, high = l, l
+			if len(bounds) == 2 {
+				h, err := strconv.Atoi(bounds[1])
+				if err != nil {
+					return fmt.Errorf("bad range \"%s\"", part)
+				}
+				high = h
+			} else if stepped {
+				// as cron does, "n/step" is "n-max/step"
+				high = max
+			}
+			if low < min || high > max || low > high {
+				return fmt.Errorf("\"%s\" out of range", part)
+			}
+		}
+
+		for i := low; i <= high; i += step {
+			set[i] = true
+		}
+	}
+	return nil
+}
+
+// Does the minute containing t match the spec?
+func (c *cronType) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[t.Month()] {
+		return false
+	}
+
+	dom := c.daysOfMonth[t.Day()]
+	dow := c.daysOfWeek[t.Weekday()]
+	// as in cron, if both days are restricted either one will do
+	if !c.anyDOM && !c.anyDOW {
+		return dom || dow
+	}
+	return dom && dow
+}
@@ -0,0 +1,202 @@
+/*
+ * Changing the ZoneMinder run state.
+ *
+ * The zoneminder: section of the rules file has
+ *	url:		the ZoneMinder, by default http://192.168.1.99:108/zm
+ *	credentials:	json file with the API user and pass.  By default
+ *			$CREDENTIALS, or /usr/local/credentials/zoneminderapi.json
+ *	retries:	how many more times to try a failed change, default 3
+ *	retry-delay:	how long to wait between tries, default 10s
+ *	states:		map of alarm state to run state.  An alarm state
+ *			ending in "*" matches any alarm state starting with
+ *			what comes before it, e.g. alarmed-*.
+ *
+ * Changes are made by their own go routine, so a slow or dead
+ * ZoneMinder does not hold up the rule engine.  Only the latest request
+ * matters.  One that arrives while an earlier one is being retried
+ * replaces it.  A request for the run state last set is still sent, as
+ * ZoneMinder may have been changed by hand since.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/duke1swd/iotgo/zoneMinderAPI"
+)
+
+const (
+	defaultZoneMinderRetries    = 3
+	defaultZoneMinderRetryDelay = 10 * time.Second
+)
+
+type zoneMinderConfig struct {
+	URL         string            `yaml:"url"`
+	Credentials string            `yaml:"credentials"`
+	Retries     *int              `yaml:"retries"`
+	RetryDelay  string            `yaml:"retry-delay"`
+	States      map[string]string `yaml:"states"`
+}
+
+type zoneMinderSettings struct {
+	url         string
+	credentials string
+	retries     int
+	retryDelay  time.Duration
+	states      map[string]string
+}
+
+// The part of the ZoneMinder API we use
+type stateChanger interface {
+	ChangeState(state string) error
+}
+
+type zoneMinderType struct {
+	client   stateChanger
+	settings *zoneMinderSettings
+	requests chan string
+}
+
+func compileZoneMinder(zc zoneMinderConfig) (*zoneMinderSettings, error) {
+	var err error
+
+	s := new(zoneMinderSettings)
+	s.url = zc.URL
+	if s.url == "" {
+		s.url = zoneMinderAPI.DefaultURL
+	}
+	s.credentials = zc.Credentials
+
+	s.retries = defaultZoneMinderRetries
+	if zc.Retries != nil {
+		if *zc.Retries < 0 {
+			return nil, fmt.Errorf("negative retries")
+		}
+		s.retries = *zc.Retries
+	}
+
+	s.retryDelay = defaultZoneMinderRetryDelay
+	if zc.RetryDelay != "" {
+		s.retryDelay, err = time.ParseDuration(zc.RetryDelay)
+		if err != nil || s.retryDelay < 0 {
+			return nil, fmt.Errorf("bad retry-delay %s", zc.RetryDelay)
+		}
+	}
+
+	if len(zc.States) < 1 {
+		return nil, fmt.Errorf("no states")
+	}
+	s.states = zc.States
+	for alarmState, runState := range s.states {
+		if runState == "" {
+			return nil, fmt.Errorf("alarm state %s has no run state", alarmState)
+		}
+	}
+	return s, nil
+}
+
+func newZoneMinder(client stateChanger, settings *zoneMinderSettings) *zoneMinderType {
+	z := new(zoneMinderType)
+	z.client = client
+	z.settings = settings
+	z.requests = make(chan string, 1)
+	return z
+}
+
+/*
+ * The run state for an alarm state.  An exact match wins, then the
+ * longest matching pattern.
+ */
+func (z *zoneMinderType) runState(alarmState string) (string, bool) {
+	if runState, ok := z.settings.states[alarmState]; ok {
+		return runState, true
+	}
+
+	best := ""
+	runState := ""
+	for pattern, r := range z.settings.states {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if prefix != pattern && strings.HasPrefix(alarmState, prefix) && len(pattern) > len(best) {
+			best = pattern
+			runState = r
+		}
+	}
+	return runState, best != ""
+}
+
+/*
+ * Ask for the run state that goes with an alarm state.  Called by the
+ * engine, so never blocks.  Any request not yet started is replaced.
+ */
+func (z *zoneMinderType) request(alarmState string) {
+	runState, ok := z.runState(alarmState)
+	if !ok {
+		logMessage(fmt.Sprintf("ZoneMinder: no run state for alarm state %s", alarmState))
+		return
+	}
+
+	for {
+		select {
+		case z.requests <- runState:
+			return
+		default:
+		}
+		select {
+		case <-z.requests:
+		default:
+		}
+	}
+}
+
+// The ZoneMinder go routine.  Runs until the context is cancelled.
+func (z *zoneMinderType) run(con context.Context) {
+	for {
+		select {
+		case runState := <-z.requests:
+			z.change(con, runState)
+		case <-con.Done():
+			return
+		}
+	}
+}
+
+/*
+ * Change the run state, retrying on failure.  Gives up early if a new
+ * request comes in, and hands that request back for the next go around.
+ */
+func (z *zoneMinderType) change(con context.Context, runState string) {
+	for attempt := 0; ; attempt++ {
+		err := z.client.ChangeState(runState)
+		if err == nil {
+			logMessage(fmt.Sprintf("ZoneMinder run state changed to %s", runState))
+			return
+		}
+
+		if attempt >= z.settings.retries {
+			logMessage(fmt.Sprintf("ZoneMinder run state change to %s failed after %d tries: %v",
+				runState, attempt+1, err))
+			return
+		}
+		logMessage(fmt.Sprintf("ZoneMinder run state change to %s failed, will retry: %v", runState, err))
+
+		timer := time.NewTimer(z.settings.retryDelay)
+		select {
+		case <-timer.C:
+		case newer := <-z.requests:
+			timer.Stop()
+			logMessage(fmt.Sprintf("ZoneMinder run state change to %s abandoned for %s", runState, newer))
+			select {
+			case z.requests <- newer:
+			default: // something newer still
+			}
+			return
+		case <-con.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
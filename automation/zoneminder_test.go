@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/iotgo/zoneMinderAPI"
+)
+
+// A fake ZoneMinder that fails the first "failures" state changes
+type fakeZoneMinder struct {
+	mutex    sync.Mutex
+	failures int
+	attempts int
+	state    string
+}
+
+func (z *fakeZoneMinder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.URL.Path == "/zm/api/host/login.json":
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+	case strings.HasPrefix(r.URL.Path, "/zm/api/states/change/"):
+		z.attempts++
+		if z.attempts <= z.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		z.state = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/zm/api/states/change/"), ".json")
+		json.NewEncoder(w).Encode(map[string]string{"result": "ok"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (z *fakeZoneMinder) status() (int, string) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.attempts, z.state
+}
+
+func testZoneMinder(t *testing.T, failures, retries int) (*fakeZoneMinder, *zoneMinderType) {
+	fullLogFileName = os.DevNull
+
+	config, err := loadRules("rules.yaml")
+	if err != nil {
+		t.Fatalf("Cannot load rules: %v", err)
+	}
+	settings := *config.zoneMinder
+	settings.retries = retries
+	settings.retryDelay = time.Millisecond
+
+	fake := &fakeZoneMinder{failures: failures}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, newZoneMinder(zoneMinderAPI.New(server.URL+"/zm", "user", "pass"), &settings)
+}
+
+func TestZoneMinderStates(t *testing.T) {
+	var tests = []struct {
+		alarmState string
+		runState   string
+	}{
+		{"disarmed", "Home"},
+		{"armed-stay", "Away"},
+		{"armed-away", "Away"},
+		{"alarmed-burglar", "Away"},
+		{"alarmed-fire", "Away"},
+		{"unknown", "Away"},
+		{"bogus", ""},
+	}
+
+	_, z := testZoneMinder(t, 0, 0)
+	for _, test := range tests {
+		runState, ok := z.runState(test.alarmState)
+		if runState != test.runState || ok != (test.runState != "") {
+			t.Fatalf("Alarm state %s: expected run state %s, got %s", test.alarmState, test.runState, runState)
+		}
+	}
+}
+
+func TestZoneMinderRetry(t *testing.T) {
+	fake, z := testZoneMinder(t, 2, 3)
+
+	z.change(context.Background(), "Away")
+	if attempts, state := fake.status(); attempts != 3 || state != "Away" {
+		t.Fatalf("Expected 3 attempts and state Away, got %d and %s", attempts, state)
+	}
+
+	// changed by hand, and put back when the alarm state is heard again
+	fake.mutex.Lock()
+	fake.state = "Home"
+	fake.mutex.Unlock()
+	z.change(context.Background(), "Away")
+	if attempts, state := fake.status(); attempts != 4 || state != "Away" {
+		t.Fatalf("Expected 4 attempts and state Away, got %d and %s", attempts, state)
+	}
+}
+
+func TestZoneMinderGivesUp(t *testing.T) {
+	fake, z := testZoneMinder(t, 100, 2)
+
+	z.change(context.Background(), "Away")
+	if attempts, state := fake.status(); attempts != 3 || state != "" {
+		t.Fatalf("Expected 3 attempts and no state, got %d and %s", attempts, state)
+	}
+}
+
+func TestZoneMinderRun(t *testing.T) {
+	fake, z := testZoneMinder(t, 1, 3)
+	con, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		z.run(con)
+		close(done)
+	}()
+
+	// run, and any retry it is in, must be over before the next test
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	wait := func(want string) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			if _, state := fake.status(); state == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, state := fake.status()
+		t.Fatalf("Expected run state %s, got %s", want, state)
+	}
+
+	z.request("alarmed-fire")
+	wait("Away")
+	z.request("bogus")
+	z.request("disarmed")
+	wait("Home")
+}
+
+func TestBadZoneMinder(t *testing.T) {
+	var tests = []string{
+		"zoneminder: {states: {}}\nrules: []",
+		"zoneminder: {retries: -1, states: {disarmed: Home}}\nrules: []",
+		"zoneminder: {retry-delay: soon, states: {disarmed: Home}}\nrules: []",
+		"zoneminder: {states: {disarmed: ''}}\nrules: []",
+	}
+
+	for _, test := range tests {
+		if _, err := parseRules([]byte(test)); err == nil {
+			t.Fatalf("ZoneMinder settings should have been rejected: %s", test)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Where the log messages go.
+ *
+ * LOGBACKEND picks the way: pubsub (the default), mqtt, file or http.
+ * LOGTARGET is where, for all but pubsub: the broker, the file or the
+ * URL.  Messages that cannot be sent, as while the link is down, wait
+ * in a logQueue in LOGQUEUEDIR to be sent later.
+ *
+ * A run of the same message, as "No IP Address Change" every poll, is
+ * sent once and then summarized every LOGHEARTBEAT minutes.  Zero sends
+ * every message.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/duke1swd/iotgo/logCatalog"
+	"github.com/duke1swd/iotgo/logQueue"
+	"github.com/duke1swd/iotgo/logSimple"
+)
+
+const (
+	defaultLogBackend   = "pubsub"
+	defaultQueueDir     = "/var/spool/ipupdate"
+	defaultLogHeartbeat = "60" // in minutes
+	defaultLogMQTTTopic = "logs/ipupdate"
+	service             = "IPUpdate"
+
+	maxQueuedMessages = 10000
+)
+
+var (
+	logger  logSimple.Logger
+	logSeqn int
+	logLast int64
+)
+
+func logInit(ctx context.Context) error {
+	var (
+		backend logSimple.Logger
+		err     error
+	)
+
+	kind := os.Getenv("LOGBACKEND")
+	if len(kind) < 1 {
+		kind = defaultLogBackend
+	}
+	target := os.Getenv("LOGTARGET")
+	if kind != "pubsub" && len(target) < 1 {
+		return fmt.Errorf("LOGBACKEND %s needs LOGTARGET", kind)
+	}
+
+	switch kind {
+	case "pubsub":
+		backend, err = logSimple.NewPubSub(ctx, "", location, service)
+	case "mqtt":
+		backend, err = logSimple.NewMQTT(target, defaultLogMQTTTopic, location, service)
+	case "file":
+		backend, err = logSimple.NewFile(target, location, service)
+	case "http":
+		backend, err = logSimple.NewHTTP(target, location, service)
+	default:
+		return fmt.Errorf("LOGBACKEND %s unknown", kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	queueDir := os.Getenv("LOGQUEUEDIR")
+	if len(queueDir) < 1 {
+		queueDir = defaultQueueDir
+	}
+	heartbeatS := os.Getenv("LOGHEARTBEAT")
+	if len(heartbeatS) < 1 {
+		heartbeatS = defaultLogHeartbeat
+	}
+	heartbeat, err := strconv.Atoi(heartbeatS)
+	if err != nil || heartbeat < 0 {
+		backend.Close()
+		return fmt.Errorf("LOGHEARTBEAT %s is not a number of minutes", heartbeatS)
+	}
+
+	spooled, err := logSimple.NewSpooled(backend, queueDir, logQueue.Options{
+		MaxMessages: maxQueuedMessages,
+		Policy:      logQueue.Summarize,
+	})
+	if err != nil {
+		backend.Close()
+		return err
+	}
+	logger = spooled
+	if heartbeat > 0 {
+		logger = logSimple.NewSuppressing(spooled, time.Duration(heartbeat)*time.Minute)
+	}
+	return nil
+}
+
+/*
+ * Log message msgNum of the catalog, its human readable version made
+ * with args.  It is sent now or, if it cannot be, later.
+ */
+func logEvent(msgNum, msgVal int, args ...interface{}) {
+	e, ok := logCatalog.Lookup(service, msgNum)
+	if !ok {
+		log.Printf("IP Update: log message %d is not in the catalog", msgNum)
+		return
+	}
+	human := e.Human(args...)
+
+	now := logSimple.Now()
+	if now != logLast {
+		logSeqn = 0
+		logLast = now
+	}
+	m := logSimple.Message{When: now, Seqn: logSeqn, MsgNum: msgNum, MsgVal: msgVal, Human: human}
+	logSeqn++
+
+	if err := logger.Log(ctx, m); err != nil {
+		log.Printf("IP Update: cannot log %q: %v", human, err)
+	}
+}
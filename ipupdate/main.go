@@ -18,7 +18,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/duke1swd/iotgo/logSimple"
+	"github.com/duke1swd/iotgo/logCatalog"
 )
 
 const defaultHost = "canyonranch.linkpc.net"
@@ -100,8 +100,12 @@ func main() {
 		}
 
 		log.Println("IP Update Daemon started.  IP = ", myIP.String())
-		logSimple.LogInit(ctx, location, "IPUpdate")
-		logSimple.Log(ctx, 0, 1, 0, "Startup. IP Address: "+myIP.String())
+		if err := logInit(ctx); err != nil {
+			log.Printf("IP Update: Cannot start logging: %v", err)
+			daemonExit()
+		}
+		defer logger.Close()
+		logEvent(logCatalog.IPUpdateStartup, 0, myIP.String())
 		ipValid = true
 		nextLoopTime = lastUpdateTime.Add(pollInterval)
 		updateLoop()
@@ -139,7 +143,7 @@ func updateLoop() {
 				lastUpdateTime = time.Now()
 			}
 			howLong = int(time.Since(lastUpdateTime) / time.Second)
-			logSimple.Log(ctx, 0, 2, howLong, "Failed to get IP address")
+			logEvent(logCatalog.IPUpdateGetFailed, howLong)
 			continue
 		}
 
@@ -147,14 +151,14 @@ func updateLoop() {
 			ipValid = true
 		} else if newIP.Equal(myIP) {
 			howLong = int(time.Since(lastUpdateTime) / time.Second)
-			logSimple.Log(ctx, 0, 0, howLong, "No IP Address Change")
+			logEvent(logCatalog.IPUpdateNoChange, howLong)
 			continue
 		}
 
 		howLong = int(time.Since(lastUpdateTime) / time.Second)
-		logSimple.Log(ctx, 0, 3, howLong, "New IP address: "+myIP.String())
+		logEvent(logCatalog.IPUpdateNewAddress, howLong, myIP.String())
 		if !postIP(newIP) {
-			logSimple.Log(ctx, 0, 4, 0, "Failed to update IP address")
+			logEvent(logCatalog.IPUpdateUpdateFailed, 0)
 		} else {
 			myIP = newIP
 			lastUpdateTime = time.Now()
@@ -10,6 +10,7 @@ package main
 
 import (
 	"context"
+	"github.com/duke1swd/iotgo/logCatalog"
 	"github.com/duke1swd/iotgo/logQueue"
 	"log"
 	"time"
@@ -22,47 +23,63 @@ const defaultRouter = "192.168.1.1"
 const defaultProjectID = "iot-services-274518" // This is the IOT Services project
 const defaultPollInterval = 300                // 5 minutes
 
+// Caps on the messages waiting.  Past these, the oldest are summarized.
+const maxQueuedMessages = 10000
+const maxQueuedBytes = 10 << 20
+const maxQueuedAge = 30 * 24 * time.Hour
+
 const version = 1
 
 var (
 	oldNow int64
 	seqn   int
 	epoch  time.Time
+	queue  *logQueue.Queue
 )
 
 /*
- Declare the various log messages we use
+Declare the various log messages we use.  Their numbers, and what they
+say, are in the shared catalog.
 */
 type logMessage int
 
 const (
-	logLifeIsGood logMessage = iota
-	logHelloWorld
-	logInternetDown
-	logWiFiDown
-	logWiFiReset
-	logModemReset
-	logStateInternetUp
-	logStateInternetDown
-	logStateWiFiDown
-	logContactFailed
-	logNoRouter
+	logLifeIsGood        logMessage = logCatalog.ISPLifeIsGood
+	logHelloWorld        logMessage = logCatalog.ISPHelloWorld
+	logInternetDown      logMessage = logCatalog.ISPInternetDown
+	logWiFiDown          logMessage = logCatalog.ISPWiFiDown
+	logWiFiReset         logMessage = logCatalog.ISPWiFiReset
+	logModemReset        logMessage = logCatalog.ISPModemReset
+	logStateInternetUp   logMessage = logCatalog.ISPStateInternetUp
+	logStateInternetDown logMessage = logCatalog.ISPStateInternetDown
+	logStateWiFiDown     logMessage = logCatalog.ISPStateWiFiDown
+	logContactFailed     logMessage = logCatalog.ISPContactFailed
+	logNoRouter          logMessage = logCatalog.ISPNoRouter
+	logMessagesDropped   logMessage = logCatalog.ISPMessagesDropped
 )
 
+func (m logMessage) entry() logCatalog.Entry {
+	e, ok := logCatalog.Lookup(service, int(m))
+	if !ok {
+		log.Fatalf("log message %d is not in the catalog", int(m))
+	}
+	return e
+}
+
 func (m logMessage) String() string {
-	return [...]string{
-		"Internet Up for %d seconds",
-		"Hello World! Version=%d",
-		"Internet Down for %d seconds",
-		"WiFi Down for %d seconds",
-		"Router Reset try %d",
-		"Modem Reset try %d",
-		"Internet Up",
-		"Internet Down",
-		"WiFi Down",
-		"Contact Failed",
-		"Contact with Router Failed",
-	}[m]
+	return m.entry().Format
+}
+
+// The human readable version of the message
+func (m logMessage) human(msgVal int) string {
+	return m.entry().Human(msgVal)
+}
+
+/*
+The messages that say the state changed matter more than the chatter
+*/
+func (m logMessage) stateChange() bool {
+	return m == logStateInternetUp || m == logStateInternetDown || m == logStateWiFiDown
 }
 
 func main() {
@@ -76,10 +93,20 @@ func main() {
 
 	myPublishInit(ctx)
 
-	err = logQueue.Start(ctx, publishDeferredMessage)
+	// Messages waiting for the Internet are kept in $LOGQUEUEDIR, else
+	// logQueue.DefaultDir, where the logqueue command looks for them.
+	queue, err = logQueue.New(logQueue.Options{
+		BatchSender: publishDeferredMessages,
+		MaxMessages: maxQueuedMessages,
+		MaxBytes:    maxQueuedBytes,
+		MaxAge:      maxQueuedAge,
+		Policy:      logQueue.Summarize,
+		Summary:     droppedSummary,
+	})
 	if err != nil {
 		log.Fatalf("failed to start log queue. Err = %v", err)
 	}
+	defer queue.Close()
 
 	log.Print("Entering deamon loop")
 	mainLoop(ctx)
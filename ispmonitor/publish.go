@@ -11,6 +11,8 @@ import (
 
 	"cloud.google.com/go/pubsub"
 	"github.com/duke1swd/iotgo/logQueue"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const publishDeadline = 30 // timeout on publishing, in seconds
@@ -27,6 +29,11 @@ const publishDeadline = 30 // timeout on publishing, in seconds
 var (
 	topic    *pubsub.Topic
 	location string
+
+	// How the client is made.  Tests make one of a fake server.
+	newClient = func(ctx context.Context, projectID string) (*pubsub.Client, error) {
+		return pubsub.NewClient(ctx, projectID)
+	}
 )
 
 func init() {
@@ -51,7 +58,7 @@ func myPublishInit(ctx context.Context) {
 	}
 
 	// Creates a client.
-	client, err := pubsub.NewClient(ctx, projectID)
+	client, err := newClient(ctx, projectID)
 	if err != nil {
 		log.Fatalf("ISP Monitor: Failed to create client: %v", err)
 	}
@@ -72,6 +79,7 @@ func myPublishInit(ctx context.Context) {
      This routine generates the sequence number
   Returns true of it was able to publish.
   Uses a 10 second timeout on the publish.
+  If it worked, the way is open, so the queue is told to send what it has.
 */
 func myPublishNow(ctx context.Context, msg logMessage, msgVal int) (retval bool) {
 	now := int64(time.Since(epoch) / time.Second)
@@ -79,30 +87,69 @@ func myPublishNow(ctx context.Context, msg logMessage, msgVal int) (retval bool)
 		seqn = 0
 		oldNow = now
 	}
-	human := msg.String()
-	if strings.Count(human, "%") > 0 {
-		human = fmt.Sprintf(human, msgVal)
-	}
-	retval = myPublish(ctx, now, seqn, int(msg), msgVal, human)
+	retval = myPublish(ctx, now, seqn, int(msg), msgVal, msg.human(msgVal))
 	seqn++
+	if retval && queue != nil {
+		queue.Kick()
+	}
 	return
 }
 
 /*
  This routine sees to it that a log message gets published, eventually.
+ State changes go ahead of the rest, and are the last to be dropped.
 */
 func myPublishEventually(msg logMessage, msgVal int) {
-	human := msg.String()
-	if strings.Count(human, "%") > 0 {
-		human = fmt.Sprintf(human, msgVal)
+	prio := logQueue.Normal
+	if msg.stateChange() {
+		prio = logQueue.High
+	}
+	attributes, human := queuedMessage(msg, msgVal)
+	err := queue.LogPriority(prio, attributes, human)
+	if err != nil {
+		log.Printf("cannot queue log message: %v", err)
 	}
-	logQueue.Log(fmt.Sprintf("%d,%d,%s", int(msg), msgVal, human))
+}
+
+/*
+ A log message as it is kept in the queue: the message number and value
+ as attributes, and the human readable version as the body
+*/
+func queuedMessage(msg logMessage, msgVal int) (map[string]string, string) {
+	return map[string]string{
+		"MsgNum": strconv.Itoa(int(msg)),
+		"MsgVal": strconv.Itoa(msgVal),
+	}, msg.human(msgVal)
+}
+
+/*
+ The queue's record of messages it had to drop
+*/
+func droppedSummary(dropped int) (map[string]string, string) {
+	return queuedMessage(logMessagesDropped, dropped)
 }
 
 /*
    This routine actually publishes messages, whether directly or delayed.
 */
 func myPublish(ctx context.Context, when int64, seqn, msgNum, msgVal int, human string) bool {
+	ctxd, cancelFn := context.WithDeadline(ctx, time.Now().Add(publishDeadline*time.Second))
+	defer cancelFn()
+
+	result := topic.Publish(ctxd, newMessage(when, seqn, msgNum, msgVal, human))
+	_, err := result.Get(ctxd)
+	if err != nil {
+		log.Printf("publish get result returns error: %v", err)
+		return false
+	}
+
+	return true
+}
+
+/*
+   A log message, as published
+*/
+func newMessage(when int64, seqn, msgNum, msgVal int, human string) *pubsub.Message {
 	var myMsg pubsub.Message
 
 	myMsg.Attributes = make(map[string]string)
@@ -113,42 +160,67 @@ func myPublish(ctx context.Context, when int64, seqn, msgNum, msgVal int, human
 	myMsg.Attributes["MsgNum"] = strconv.Itoa(msgNum)
 	myMsg.Attributes["MsgVal"] = strconv.Itoa(msgVal)
 	myMsg.Attributes["Human"] = human
+	return &myMsg
+}
 
+/*
+   Publish log messages that got deferred until now.  They are all
+   published at once, then each is waited for.  A message that cannot be
+   made sense of, or that Pub/Sub says is invalid, is never going to be
+   published, so the queue is told to give up on it.
+*/
+func publishDeferredMessages(ctx context.Context, records []logQueue.Record) []error {
 	ctxd, cancelFn := context.WithDeadline(ctx, time.Now().Add(publishDeadline*time.Second))
 	defer cancelFn()
 
-	result := topic.Publish(ctxd, &myMsg)
-	_, err := result.Get(ctxd)
-	if err != nil {
-		log.Printf("publish get result returns error: %v", err)
-		return false
+	errs := make([]error, len(records))
+	results := make([]*pubsub.PublishResult, len(records))
+	for i, r := range records {
+		msgNum, msgVal, human, err := parseQueuedMessage(r)
+		if err != nil {
+			errs[i] = logQueue.Permanent(err)
+			continue
+		}
+		results[i] = topic.Publish(ctxd, newMessage(r.When, r.Seqn, msgNum, msgVal, human))
 	}
 
-	return true
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+		_, err := result.Get(ctxd)
+		if err != nil {
+			log.Printf("publish get result returns error: %v", err)
+			if status.Code(err) == codes.InvalidArgument {
+				err = logQueue.Permanent(err)
+			}
+			errs[i] = err
+		}
+	}
+	return errs
 }
 
 /*
-   Publish a log message that got deferred until now.
+   Convert a message as it is kept in the queue into its pieces.
+   Messages queued before there were attributes are "msgNum,msgVal,human".
 */
-func publishDeferredMessage(ctx context.Context, t, s string) bool {
-
-	// convert the file name into its pieces
-	f := strings.SplitN(t, "_", 2)
-	when, _ := strconv.ParseInt(f[0], 10, 64)
-
-	k, _ := strconv.ParseInt(f[1], 10, 32)
-	seqn := int(k)
-
-	// convert the message number into its pieces
-	f = strings.SplitN(s, ",", 3)
-
-	k, _ = strconv.ParseInt(f[0], 10, 32)
-	msgNum := int(k)
-
-	k, _ = strconv.ParseInt(f[1], 10, 32)
-	msgVal := int(k)
-
-	human := f[2]
+func parseQueuedMessage(r logQueue.Record) (msgNum, msgVal int, human string, err error) {
+	num, val, human := r.Attributes["MsgNum"], r.Attributes["MsgVal"], r.Body
+	if r.Attributes == nil {
+		f := strings.SplitN(r.Body, ",", 3)
+		if len(f) != 3 {
+			return 0, 0, "", fmt.Errorf("queued message %s is malformed: %q", r.Name, r.Body)
+		}
+		num, val, human = f[0], f[1], f[2]
+	}
 
-	return myPublish(ctx, when, seqn, msgNum, msgVal, human)
+	msgNum, err = strconv.Atoi(num)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("queued message %s has a bad message number: %v", r.Name, err)
+	}
+	msgVal, err = strconv.Atoi(val)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("queued message %s has a bad message value: %v", r.Name, err)
+	}
+	return msgNum, msgVal, human, nil
 }
@@ -2,15 +2,112 @@ package main
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/duke1swd/iotgo/logQueue"
+	"github.com/duke1swd/iotgo/pubsubTest"
 )
 
+const testProjectID = "test-project"
+
+// Publishes to a fake server, with a subscription "Test" to what is published
+func publishToFake(t *testing.T, ctx context.Context) *pubsubTest.Server {
+	srv := pubsubTest.New(t)
+	srv.Topic(testProjectID, topicID, "Test")
+
+	t.Setenv("PROJECTID", testProjectID)
+	newClient = srv.Client
+	t.Cleanup(func() {
+		newClient = func(ctx context.Context, projectID string) (*pubsub.Client, error) {
+			return pubsub.NewClient(ctx, projectID)
+		}
+	})
+	myPublishInit(ctx)
+	return srv
+}
+
+// Receives n messages from subscription "Test", by their IOTTime
+func receive(t *testing.T, srv *pubsubTest.Server, n int) map[string]map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := srv.Client(ctx, testProjectID)
+	if err != nil {
+		t.Fatalf("Cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	var (
+		mu  sync.Mutex
+		got []*pubsub.Message
+	)
+	err = client.Subscription("Test").Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, msg)
+		if len(got) == n {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if len(got) != n {
+		t.Fatalf("Received %d messages, want %d", len(got), n)
+	}
+
+	attributes := make(map[string]map[string]string)
+	for _, msg := range got {
+		attributes[msg.Attributes["IOTTime"]] = msg.Attributes
+	}
+	return attributes
+}
+
 func TestPublish1(t *testing.T) {
 	ctx, cxf := context.WithCancel(context.Background())
 	defer cxf()
 
-	myPublishInit(ctx)
-	if !myPublishNow(ctx, logMessage(0), 0) {
-		t.Fatal("Immediate publish failed.  Credentials set?")
+	srv := publishToFake(t, ctx)
+	if !myPublishNow(ctx, logInternetDown, 60) {
+		t.Fatal("Immediate publish failed.")
+	}
+
+	for _, a := range receive(t, srv, 1) {
+		if a["Service"] != service || a["MsgNum"] != "2" || a["MsgVal"] != "60" || a["Human"] != "Internet Down for 60 seconds" {
+			t.Fatalf("Published %v", a)
+		}
+	}
+}
+
+func TestPublishDeferred(t *testing.T) {
+	ctx, cxf := context.WithCancel(context.Background())
+	defer cxf()
+
+	srv := publishToFake(t, ctx)
+
+	attributes, human := queuedMessage(logStateInternetDown, 0)
+	records := []logQueue.Record{
+		{Name: "a", When: 1000, Seqn: 0, Attributes: attributes, Body: human},
+		{Name: "b", When: 1001, Seqn: 3, Body: "2,120,Internet Down for 120 seconds"},
+		{Name: "c", When: 1002, Body: "not a message"},
+	}
+	errs := publishDeferredMessages(ctx, records)
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("publishDeferredMessages returned %v", errs)
+	}
+	if !logQueue.IsPermanent(errs[2]) {
+		t.Fatalf("malformed message returned %v", errs[2])
+	}
+
+	got := receive(t, srv, 2)
+	if a := got["1000"]; a["MsgNum"] != "7" || a["Human"] != "Internet Down" {
+		t.Fatalf("first published %v", a)
+	}
+	if a := got["1001"]; a["Seqn"] != "3" || a["MsgVal"] != "120" {
+		t.Fatalf("second published %v", a)
 	}
 }
@@ -0,0 +1,497 @@
+/*
+ * Seasons and calendars.
+ *
+ * A season is a range of days, start and end inclusive, during which a
+ * region's lights are run.  A calendar is a named list of seasons.
+ *
+ * Dates are written without spaces so they survive config.sh:
+ *	11/1		November 1st
+ *	2/29		February 29th (February 28th in other years)
+ *	11/4thu		the fourth Thursday of November
+ *	5/lastmon	the last Monday of May
+ *
+ * A season is "start-end" or a single date, and a list of seasons is
+ * comma separated, e.g. "11/4thu-1/6,7/1-7/5".  A season whose end comes
+ * before its start wraps into the next year.
+ *
+ * Calendars may also be loaded from iCalendar (.ics) files.  Each VEVENT
+ * becomes a season.  Yearly RRULEs are understood, including BYMONTH and
+ * BYDAY, so "fourth Thursday of November" events recur correctly.
+ * A recurring event keeps the length of its first occurrence.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCalendarDirectory = "/etc/lighting"
+const defaultSeasonGrace = 9 // hours into the morning after the last day of a season
+
+type dateRule struct {
+	month   time.Month
+	day     int // day of the month, or 0 for a weekday rule
+	nth     int // 1 through 5 for first through fifth weekday, -1 for last
+	weekday time.Weekday
+}
+
+type seasonType struct {
+	year  int // 0 if the season recurs every year
+	start dateRule
+	end   dateRule // last day of the season
+	days  int      // if non-zero, length of the season in days and end is unused
+}
+
+var calendarDirectory string
+var calendarMap = make(map[string][]seasonType) // map calendar name to its seasons
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var icsWeekdayNames = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func init() {
+	calendarDirectory = os.Getenv("CALENDARDIR")
+	if len(calendarDirectory) < 1 {
+		calendarDirectory = defaultCalendarDirectory
+	}
+}
+
+// number of days in a month of a given year
+func daysIn(month time.Month, year int) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// date returns midnight of the day the rule falls on in the given year.
+func (r dateRule) date(year int) time.Time {
+	if r.day > 0 {
+		day := r.day
+		if last := daysIn(r.month, year); day > last {
+			day = last
+		}
+		return time.Date(year, r.month, day, 0, 0, 0, 0, loc)
+	}
+
+	if r.nth < 0 {
+		last := time.Date(year, r.month, daysIn(r.month, year), 0, 0, 0, 0, loc)
+		back := (int(last.Weekday()) - int(r.weekday) + 7) % 7
+		return last.AddDate(0, 0, -back)
+	}
+
+	first := time.Date(year, r.month, 1, 0, 0, 0, 0, loc)
+	forward := (int(r.weekday) - int(first.Weekday()) + 7) % 7
+	d := first.AddDate(0, 0, forward+7*(r.nth-1))
+	// not every month has a fifth weekday.  Use the last one.
+	if d.Month() != r.month {
+		d = d.AddDate(0, 0, -7)
+	}
+	return d
+}
+
+// contains decides whether "now" is in the season.  The season runs from
+// midnight of its first day until midnight after its last day plus grace.
+func (s seasonType) contains(now time.Time, grace time.Duration) bool {
+	for year := now.Year() - 1; year <= now.Year(); year++ {
+		if s.year != 0 && s.year != year {
+			continue
+		}
+
+		start := s.start.date(year)
+		var end time.Time
+		if s.days > 0 {
+			end = start.AddDate(0, 0, s.days)
+		} else {
+			last := s.end.date(year)
+			if last.Before(start) {
+				last = s.end.date(year + 1)
+			}
+			end = last.AddDate(0, 0, 1)
+		}
+
+		if !now.Before(start) && now.Before(end.Add(grace)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse "mm/dd", "mm/<n><day>" or "mm/last<day>"
+func parseDateRule(spec string) (r dateRule, err error) {
+	mc := strings.Split(strings.TrimSpace(spec), "/")
+	if len(mc) != 2 {
+		return r, fmt.Errorf("date \"%s\" is not of the form mm/dd", spec)
+	}
+
+	month, err := strconv.ParseInt(mc[0], 10, 32)
+	if err != nil || month < 1 || month > 12 {
+		return r, fmt.Errorf("date \"%s\" has a bad month", spec)
+	}
+	r.month = time.Month(month)
+
+	// a plain day of the month.  Allow Feb 29, it is clamped in other years.
+	if day, err := strconv.ParseInt(mc[1], 10, 32); err == nil {
+		if day < 1 || int(day) > daysIn(r.month, 2000) {
+			return r, fmt.Errorf("date \"%s\" has a bad day", spec)
+		}
+		r.day = int(day)
+		return r, nil
+	}
+
+	// nth weekday of the month
+	rule := strings.ToLower(mc[1])
+	if len(rule) < 4 {
+		return r, fmt.Errorf("date \"%s\" has a bad day", spec)
+	}
+	weekday, ok := weekdayNames[rule[len(rule)-3:]]
+	if !ok {
+		return r, fmt.Errorf("date \"%s\" has a bad weekday", spec)
+	}
+	r.weekday = weekday
+
+	nth := rule[:len(rule)-3]
+	if nth == "last" {
+		r.nth = -1
+		return r, nil
+	}
+	n, err := strconv.ParseInt(nth, 10, 32)
+	if err != nil || n < 1 || n > 5 {
+		return r, fmt.Errorf("date \"%s\" has a bad week number", spec)
+	}
+	r.nth = int(n)
+	return r, nil
+}
+
+// parse "start-end" or a single date
+func parseSeason(spec string) (s seasonType, err error) {
+	dates := strings.Split(spec, "-")
+	if len(dates) > 2 {
+		return s, fmt.Errorf("season \"%s\" is not of the form start-end", spec)
+	}
+
+	s.start, err = parseDateRule(dates[0])
+	if err != nil {
+		return
+	}
+
+	s.end = s.start
+	if len(dates) == 2 {
+		s.end, err = parseDateRule(dates[1])
+	}
+	return
+}
+
+// parse a comma separated list of seasons
+func parseSeasons(spec string) ([]seasonType, error) {
+	var seasons []seasonType
+
+	for _, seasonSpec := range strings.Split(spec, ",") {
+		if strings.TrimSpace(seasonSpec) == "" {
+			continue
+		}
+		s, err := parseSeason(seasonSpec)
+		if err != nil {
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+
+	if len(seasons) < 1 {
+		return nil, fmt.Errorf("no seasons in \"%s\"", spec)
+	}
+	return seasons, nil
+}
+
+// parse an iCalendar DATE or DATE-TIME value.
+// Returns midnight of the day, and whether there was a time past midnight.
+func parseICSDate(value string) (time.Time, bool, error) {
+	if len(value) < 8 {
+		return time.Time{}, false, fmt.Errorf("bad iCalendar date \"%s\"", value)
+	}
+
+	d, err := time.ParseInLocation("20060102", value[:8], loc)
+	if err != nil {
+		return d, false, fmt.Errorf("bad iCalendar date \"%s\"", value)
+	}
+
+	clock := strings.TrimSuffix(value[8:], "Z")
+	pastMidnight := len(clock) > 1 && strings.Trim(clock[1:], "0") != ""
+	return d, pastMidnight, nil
+}
+
+// parse an iCalendar RRULE.  Only yearly rules are supported.
+func parseICSRule(value string, start time.Time) (r dateRule, err error) {
+	r.month = start.Month()
+	r.day = start.Day()
+	yearly := false
+	byDay := ""
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "FREQ":
+			yearly = kv[1] == "YEARLY"
+		case "BYMONTH":
+			month, err := strconv.ParseInt(kv[1], 10, 32)
+			if err != nil || month < 1 || month > 12 {
+				return r, fmt.Errorf("bad BYMONTH in RRULE \"%s\"", value)
+			}
+			r.month = time.Month(month)
+		case "BYDAY":
+			byDay = kv[1]
+		}
+	}
+
+	if !yearly {
+		return r, fmt.Errorf("unsupported RRULE \"%s\", only FREQ=YEARLY is understood", value)
+	}
+
+	if byDay == "" {
+		return r, nil
+	}
+
+	// BYDAY is something like "4TH" or "-1MO"
+	if len(byDay) < 3 {
+		return r, fmt.Errorf("bad BYDAY in RRULE \"%s\"", value)
+	}
+	weekday, ok := icsWeekdayNames[byDay[len(byDay)-2:]]
+	if !ok {
+		return r, fmt.Errorf("bad BYDAY in RRULE \"%s\"", value)
+	}
+	n, err := strconv.ParseInt(byDay[:len(byDay)-2], 10, 32)
+	if err != nil || n == 0 || n < -1 || n > 5 {
+		return r, fmt.Errorf("unsupported BYDAY in RRULE \"%s\"", value)
+	}
+
+	r.day = 0
+	r.nth = int(n)
+	r.weekday = weekday
+	return r, nil
+}
+
+// Load the seasons from an iCalendar file.  Each VEVENT is a season.
+func loadCalendarFile(fileName string) ([]seasonType, error) {
+	var (
+		seasons         []seasonType
+		lines           []string
+		inEvent         bool
+		start, end      time.Time
+		endPastMidnight bool
+		rrule           string
+		haveStart       bool
+		haveEnd         bool
+		eventCounter    int
+	)
+
+	if !filepath.IsAbs(fileName) {
+		fileName = filepath.Join(calendarDirectory, fileName)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open calendar %s: %v", fileName, err)
+	}
+	defer f.Close()
+
+	// unfold continuation lines
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read calendar %s: %v", fileName, err)
+	}
+
+	for _, line := range lines {
+		nv := strings.SplitN(line, ":", 2)
+		if len(nv) != 2 {
+			continue
+		}
+		name := strings.ToUpper(strings.SplitN(nv[0], ";", 2)[0])
+		value := strings.TrimSpace(nv[1])
+
+		switch name {
+		case "BEGIN":
+			if value == "VEVENT" {
+				inEvent = true
+				haveStart = false
+				haveEnd = false
+				rrule = ""
+			}
+		case "DTSTART":
+			if inEvent {
+				start, _, err = parseICSDate(value)
+				if err != nil {
+					return nil, fmt.Errorf("calendar %s: %v", fileName, err)
+				}
+				haveStart = true
+			}
+		case "DTEND":
+			if inEvent {
+				end, endPastMidnight, err = parseICSDate(value)
+				if err != nil {
+					return nil, fmt.Errorf("calendar %s: %v", fileName, err)
+				}
+				haveEnd = true
+			}
+		case "RRULE":
+			if inEvent {
+				rrule = value
+			}
+		case "END":
+			if value != "VEVENT" || !inEvent {
+				continue
+			}
+			inEvent = false
+			eventCounter++
+			if !haveStart {
+				return nil, fmt.Errorf("calendar %s: event %d has no DTSTART", fileName, eventCounter)
+			}
+
+			// DTEND is exclusive.  An event with no DTEND lasts one day.
+			var s seasonType
+			s.days = 1
+			if haveEnd {
+				s.days = int(end.Sub(start).Hours()+12) / 24
+				if endPastMidnight {
+					s.days++
+				}
+				if s.days < 1 {
+					s.days = 1
+				}
+			}
+
+			if rrule == "" {
+				s.year = start.Year()
+				s.start = dateRule{month: start.Month(), day: start.Day()}
+			} else {
+				s.start, err = parseICSRule(rrule, start)
+				if err != nil {
+					return nil, fmt.Errorf("calendar %s: event %d: %v", fileName, eventCounter, err)
+				}
+			}
+			seasons = append(seasons, s)
+		}
+	}
+
+	if len(seasons) < 1 {
+		return nil, fmt.Errorf("calendar %s has no events", fileName)
+	}
+	return seasons, nil
+}
+
+/*
+ * Define a calendar.  The spec is either a list of seasons
+ * or the name of an iCalendar file.
+ *
+ * Runs in the updater gothread, so is OK to manipulate calendarMap
+ */
+func updateCalendar(name, spec string) {
+	var (
+		seasons []seasonType
+		err     error
+	)
+
+	if strings.HasSuffix(strings.ToLower(spec), ".ics") {
+		seasons, err = loadCalendarFile(spec)
+	} else {
+		seasons, err = parseSeasons(spec)
+	}
+
+	if err != nil {
+		logMessage(fmt.Sprintf("Calendar %s rejected: %v", name, err))
+		if _, ok := calendarMap[name]; ok {
+			publishCalendarError(name, fmt.Sprintf("%v, previous definition kept", err))
+		} else {
+			publishCalendarError(name, fmt.Sprintf("%v, calendar not defined", err))
+		}
+		return
+	}
+
+	calendarMap[name] = seasons
+	logMessage(fmt.Sprintf("Calendar %s loaded with %d seasons", name, len(seasons)))
+	publishCalendarError(name, "")
+	recheckCalendars()
+}
+
+/*
+ * Decide whether a region is in season.
+ *
+ * The seasons of a region are the union of its season/start and season/end
+ * pair, its "seasons" list, and the seasons of every calendar it names.
+ * A region with none of these is in season all year.
+ */
+func regionInSeason(now time.Time, region map[string]string) bool {
+	var seasons []seasonType
+	seasonal := false
+
+	seasonStartString, ok1 := region["season/start"]
+	seasonEndString, ok2 := region["season/end"]
+	if ok1 && ok2 {
+		seasonal = true
+		s, err := parseSeason(seasonStartString + "-" + seasonEndString)
+		if err == nil {
+			seasons = append(seasons, s)
+		}
+	}
+
+	if spec, ok := region["seasons"]; ok {
+		seasonal = true
+		s, err := parseSeasons(spec)
+		if err == nil {
+			seasons = append(seasons, s...)
+		}
+	}
+
+	if names, ok := region["calendar"]; ok {
+		seasonal = true
+		for _, name := range strings.Split(names, ",") {
+			s, ok := calendarMap[strings.TrimSpace(name)]
+			if !ok && debug {
+				fmt.Printf("\tNo calendar named %s\n", name)
+			}
+			seasons = append(seasons, s...)
+		}
+	}
+
+	if !seasonal {
+		return true
+	}
+
+	grace := parsehhmm(region["season/grace"], defaultSeasonGrace)
+	for _, s := range seasons {
+		if s.contains(now, grace) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testGrace = time.Duration(defaultSeasonGrace) * time.Hour
+
+func at(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, loc)
+}
+
+func TestDateRules(t *testing.T) {
+	var tests = []struct {
+		spec string
+		year int
+		want time.Time
+	}{
+		{"11/4thu", 2026, at(2026, time.November, 26, 0)},
+		{"11/4thu", 2027, at(2027, time.November, 25, 0)},
+		{"5/lastmon", 2026, at(2026, time.May, 25, 0)},
+		{"9/1mon", 2026, at(2026, time.September, 7, 0)},
+		{"2/5fri", 2026, at(2026, time.February, 27, 0)},
+		{"2/29", 2028, at(2028, time.February, 29, 0)},
+		{"2/29", 2027, at(2027, time.February, 28, 0)},
+		{"12/25", 2026, at(2026, time.December, 25, 0)},
+	}
+
+	for _, test := range tests {
+		r, err := parseDateRule(test.spec)
+		if err != nil {
+			t.Fatalf("Parsing %s: %v", test.spec, err)
+		}
+		if got := r.date(test.year); !got.Equal(test.want) {
+			t.Fatalf("%s in %d: expected %v got %v", test.spec, test.year, test.want, got)
+		}
+	}
+}
+
+func TestBadSeasons(t *testing.T) {
+	for _, spec := range []string{"13/1", "0/1", "2/30", "4/31", "11/6thu", "11/4xyz", "11", "1/1-2/2-3/3", ""} {
+		if _, err := parseSeasons(spec); err == nil {
+			t.Fatalf("Season %s should have been rejected", spec)
+		}
+	}
+}
+
+func TestSeasonYearWrap(t *testing.T) {
+	seasons, err := parseSeasons("11/4thu-1/6")
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+	s := seasons[0]
+
+	var tests = []struct {
+		when time.Time
+		want bool
+	}{
+		{at(2026, time.November, 25, 20), false},
+		{at(2026, time.November, 26, 0), true},
+		{at(2026, time.December, 31, 23), true},
+		{at(2027, time.January, 1, 1), true},
+		{at(2027, time.January, 6, 20), true},
+		{at(2027, time.January, 7, 8), true},
+		{at(2027, time.January, 7, 10), false},
+		{at(2027, time.July, 4, 20), false},
+	}
+
+	for _, test := range tests {
+		if got := s.contains(test.when, testGrace); got != test.want {
+			t.Fatalf("At %v expected in season %v", test.when, test.want)
+		}
+	}
+}
+
+func TestSeasonLeapYear(t *testing.T) {
+	seasons, err := parseSeasons("2/29,12/30-2/28")
+	if err != nil {
+		t.Fatalf("Parsing failed: %v", err)
+	}
+
+	var tests = []struct {
+		when time.Time
+		want bool
+	}{
+		{at(2028, time.February, 29, 20), true},
+		{at(2028, time.March, 1, 10), false},
+		{at(2027, time.February, 28, 20), true},
+		{at(2027, time.March, 1, 10), false},
+		{at(2028, time.January, 15, 20), true},
+		{at(2028, time.December, 29, 20), false},
+	}
+
+	for _, test := range tests {
+		got := false
+		for _, s := range seasons {
+			got = got || s.contains(test.when, 0)
+		}
+		if got != test.want {
+			t.Fatalf("At %v expected in season %v", test.when, test.want)
+		}
+	}
+}
+
+func TestRegionInSeason(t *testing.T) {
+	calendarMap["holidays"] = []seasonType{{start: dateRule{month: time.July, day: 4}, end: dateRule{month: time.July, day: 4}}}
+	defer delete(calendarMap, "holidays")
+
+	region := map[string]string{}
+	if !regionInSeason(at(2026, time.July, 1, 20), region) {
+		t.Fatal("Region with no seasons should be in season")
+	}
+
+	region["season/start"] = "11/1"
+	region["season/end"] = "1/6"
+	region["calendar"] = "holidays"
+	if !regionInSeason(at(2026, time.July, 4, 20), region) {
+		t.Fatal("Region should be in season on a calendar day")
+	}
+	if !regionInSeason(at(2026, time.November, 2, 20), region) {
+		t.Fatal("Region should be in season during season/start to season/end")
+	}
+	if regionInSeason(at(2026, time.July, 5, 20), region) {
+		t.Fatal("Region should be out of season")
+	}
+
+	region["calendar"] = "no-such-calendar"
+	if regionInSeason(at(2026, time.July, 4, 20), region) {
+		t.Fatal("Region should not use a calendar it does not name")
+	}
+}
+
+const testCalendar = `BEGIN:VCALENDAR
+VERSION:2.0
+BEGIN:VEVENT
+SUMMARY:Thanksgiving through Epiphany
+DTSTART;VALUE=DATE:20261126
+DTEND;VALUE=DATE:20270107
+RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=4TH
+END:VEVENT
+BEGIN:VEVENT
+SUMMARY:One time party
+DTSTART:20280228T180000
+DTEND:20280301T020000
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestCalendarFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lighting")
+	if err != nil {
+		t.Fatalf("Cannot make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "test.ics")
+	if err := ioutil.WriteFile(fileName, []byte(testCalendar), 0644); err != nil {
+		t.Fatalf("Cannot write calendar: %v", err)
+	}
+
+	seasons, err := loadCalendarFile(fileName)
+	if err != nil {
+		t.Fatalf("Loading calendar failed: %v", err)
+	}
+	if len(seasons) != 2 {
+		t.Fatalf("Expected 2 seasons, got %d", len(seasons))
+	}
+
+	var tests = []struct {
+		when time.Time
+		want bool
+	}{
+		{at(2027, time.November, 24, 20), false},
+		{at(2027, time.November, 25, 20), true},
+		// recurring events keep their length, so this one ends a day early
+		{at(2028, time.January, 5, 20), true},
+		{at(2028, time.January, 6, 10), false},
+		{at(2028, time.February, 29, 20), true},
+		{at(2028, time.March, 1, 20), true},
+		{at(2028, time.March, 2, 20), false},
+		{at(2029, time.February, 28, 20), false},
+	}
+
+	for _, test := range tests {
+		got := false
+		for _, s := range seasons {
+			got = got || s.contains(test.when, 0)
+		}
+		if got != test.want {
+			t.Fatalf("At %v expected in season %v", test.when, test.want)
+		}
+	}
+}
@@ -11,6 +11,8 @@ lighting/tree/window-end 23:00
 lighting/tree/devices plug-0003
 EOF
 #lighting/enable true
+#lighting/calendar/holidays 11/4thu-1/6
+#lighting/tree/calendar holidays
 #lighting/carolinaroom/window-end 22:00
 #lighting/carolinaroom/devices tp-plug-03,tp-plug-02,tp-plug-04
 #lighting/carolinaroom/window-start light
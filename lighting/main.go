@@ -21,10 +21,8 @@ const defaultLogDirectory = "/var/log"
 const defaultLogFileName = "HomeLighting.log"
 const defaultMqttBroker = "tcp://localhost:1883"
 const defaultStateMachineTicker = 10 // number of seconds between pokes of the state machine.
-const defaultSeasonStartMonth = 11
-const defaultSeasonStartDay = 1
-const defaultSeasonEndMonth = 1
-const defaultSeasonEndDay = 6
+const defaultWindowStartHour = 15
+const defaultWindowEndHour = 23
 
 type updateType struct {
 	update string
@@ -53,8 +51,13 @@ type publishType struct {
  control	auto/manual-i/manual-o
  state		on/off
  command	on/off
- season/start	mm:dd or "light" or nothing
- season/end	mm:dd
+ season/start	mm/dd
+ season/end	mm/dd
+ season/grace	hh:mm
+ seasons	list of seasons, see calendar.go
+ calendar	list of calendar names
+ enabled	true/false
+ mode/<mode>	auto/off/on/dark/vacation, see mode.go
  window-start
  window-end
 
@@ -69,8 +72,6 @@ var (
 	updateChan        chan updateType
 	deviceBackChan    chan string
 	publishChan       chan publishType
-	seasonStart       time.Duration
-	seasonEnd         time.Duration
 	globalEnable      bool
 	verboseLog        bool
 	regionMap         map[string]map[string]string // map region name to a region.  A region is a set of string-key/string-value pairs.
@@ -103,10 +104,6 @@ func init() {
 	_, verboseLog = os.LookupEnv("VERBOSE_LOG")
 
 	flag.BoolVar(&debug, "D", false, "debugging")
-	flag.Parse()
-	if debug {
-		verboseLog = true
-	}
 
 	loc, _ = time.LoadLocation("Local")
 	lastPublish = time.Now()
@@ -121,37 +118,6 @@ func init() {
 	stateMachineDefer = time.Duration(2) * time.Second
 }
 
-// parse "mm/dd" spec
-// returns duration after start of year
-func parsemmdd(mmdd string, defaultMonth, defaultDay int) (time.Duration, bool) {
-	now := time.Now()
-	yearBase := time.Date(now.Year(), time.Month(1), 1, 0, 0, 0, 0, loc)
-	defaultReturnValue := time.Date(now.Year(), time.Month(defaultMonth), defaultDay, 0, 0, 0, 0, loc).Sub(yearBase)
-	if debug {
-		fmt.Println("\t\t\tParsing: " + mmdd)
-	}
-	mc := strings.Split(mmdd, "/")
-	if len(mc) != 2 {
-		return defaultReturnValue, false
-	}
-
-	month, err := strconv.ParseInt(mc[0], 10, 32)
-	if err != nil {
-		return defaultReturnValue, false
-	}
-
-	day, err := strconv.ParseInt(mc[1], 10, 32)
-	if err != nil {
-		return defaultReturnValue, false
-	}
-
-	if month < 1 || month > 12 || day < 1 || day > 31 {
-		return defaultReturnValue, false
-	}
-
-	return time.Date(now.Year(), time.Month(month), int(day), 0, 0, 0, 0, loc).Sub(yearBase), true
-}
-
 // All mqtt messages about lighting are handled here
 var lightingHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	payload := string(msg.Payload())
@@ -180,11 +146,29 @@ var lightingHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Mess
 			globalEnable = false
 			logMessage("Lighting control disabled")
 		}
+	case "mode", "vacation", "mode-follows-alarm":
+		// the updater reads these, so it is the one to set them
+		var update updateType
+		update.update = topicComponents[1]
+		update.value1 = payload
+		updateChan <- update
+	case "calendar":
+		if len(topicComponents) != 3 {
+			return
+		}
+		var update updateType
+		update.update = "calendar"
+		update.value1 = topicComponents[2]
+		update.value2 = payload
+		updateChan <- update
 	default:
+		if len(topicComponents) < 3 {
+			return
+		}
 		var update updateType
 		update.update = "region"
 		update.region = topicComponents[1]
-		update.value1 = topicComponents[2]
+		update.value1 = strings.Join(topicComponents[2:], "/") // e.g. "season/start"
 		update.value2 = payload
 		updateChan <- update
 	}
@@ -314,6 +298,15 @@ func dropRegion(regionName string) {
 		}
 	}
 
+	// and any problems we reported
+	if regionErrorText(regionName) != "" {
+		var p publishType
+		p.topic = "lighting/" + regionName + "/error"
+		p.payload = ""
+		publishChan <- p
+	}
+	delete(regionErrors, regionName)
+
 	delete(regionMap, regionName)
 	logMessage("Region " + regionName + " dropped")
 }
@@ -325,6 +318,50 @@ func publishControl(name string, control string) {
 	publishChan <- p
 }
 
+/*
+ * A region setting arrived.  Runs in the updater go routine.
+ */
+func updateRegion(regionName, key, value string) {
+	// Our own error reports, heard back, are not settings.
+	// One for a region we do not know is left over from
+	// one dropped, so it is erased.
+	if key == "error" {
+		if _, ok := regionMap[regionName]; ok {
+			checkRegionSetting(regionName, key, value)
+		} else {
+			var p publishType
+			p.topic = "lighting/" + regionName + "/error"
+			p.payload = ""
+			publishChan <- p
+		}
+		return
+	}
+
+	// First, put this data into the region map
+	region, ok := regionMap[regionName]
+	if !ok {
+		region = make(map[string]string)
+		region["control"] = "auto"
+		if key != "control" {
+			publishControl(regionName, "auto")
+		}
+	}
+	region[key] = value
+	regionMap[regionName] = region
+
+	// Some region messages require more processing
+	switch key {
+	case "devices":
+		updateDevices(regionName, value)
+	case "drop":
+		dropRegion(regionName)
+	}
+
+	if key != "drop" {
+		checkRegionSetting(regionName, key, value)
+	}
+}
+
 /*
  * All action requests come here and are serialized that way
  */
@@ -345,25 +382,22 @@ func updater() {
 			}
 			switch update.update {
 			case "region":
-				// First, put this data into the region map
-				region, ok := regionMap[update.region]
-				if !ok {
-					region = make(map[string]string)
-					region["control"] = "auto"
-					if update.value1 != "control" {
-						publishControl(update.region, "auto")
-					}
-				}
-				region[update.value1] = update.value2
-				regionMap[update.region] = region
-
-				// Some region messages require more processing
-				switch update.value1 {
-				case "devices":
-					updateDevices(update.region, update.value2)
-				case "drop":
-					dropRegion(update.region)
-				}
+				updateRegion(update.region, update.value1, update.value2)
+
+			case "calendar":
+				updateCalendar(update.value1, update.value2)
+
+			case "mode":
+				setMode(update.value1)
+
+			case "vacation":
+				setVacation(update.value1)
+
+			case "mode-follows-alarm":
+				setModeFollowsAlarm(update.value1)
+
+			case "alarm":
+				alarmChanged(update.value1)
 
 			case "light":
 				// This is done here, rather than in the message handler
@@ -427,30 +461,39 @@ func updater() {
 // parse "hh:mm" spec
 // returns duration after midnight.
 func parsehhmm(hhmm string, defaultHour int) time.Duration {
-	defaultReturnValue := time.Duration(defaultHour) * time.Hour
 	if debug {
 		fmt.Println("\t\t\tParsing: " + hhmm)
 	}
+	when, err := checkhhmm(hhmm)
+	if err != nil {
+		return time.Duration(defaultHour) * time.Hour
+	}
+	return when
+}
+
+// check a "hh:mm" spec
+// returns duration after midnight, or why the spec is bad.
+func checkhhmm(hhmm string) (time.Duration, error) {
 	hc := strings.Split(hhmm, ":")
 	if len(hc) != 2 {
-		return defaultReturnValue
+		return 0, fmt.Errorf("\"%s\" is not of the form hh:mm", hhmm)
 	}
 
 	hour, err := strconv.ParseInt(hc[0], 10, 32)
 	if err != nil {
-		return defaultReturnValue
+		return 0, fmt.Errorf("\"%s\" has a bad hour", hhmm)
 	}
 
 	min, err := strconv.ParseInt(hc[1], 10, 32)
 	if err != nil {
-		return defaultReturnValue
+		return 0, fmt.Errorf("\"%s\" has a bad minute", hhmm)
 	}
 
 	if hour < 0 || hour > 23 || min < 0 || min > 59 {
-		return defaultReturnValue
+		return 0, fmt.Errorf("\"%s\" is not a time of day", hhmm)
 	}
 
-	return time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute
+	return time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute, nil
 }
 
 // takes a specification in the form of "hh:mm" and decides when that is
@@ -517,13 +560,13 @@ func allOff() {
 }
 
 /*
-   This routine gets called from time to time when the state of
-   the world may have changed.  Its job is to evaluate the world,
-   turning lights on and off when required.  It also acknowledges
-   the button pushes on the devices.
+This routine gets called from time to time when the state of
+the world may have changed.  Its job is to evaluate the world,
+turning lights on and off when required.  It also acknowledges
+the button pushes on the devices.
 
-   This routine is called from the updater go routine.  It is
-   safe for it to access the deviceMap and the regionMap.
+This routine is called from the updater go routine.  It is
+safe for it to access the deviceMap and the regionMap.
 */
 func stateMachine(client mqtt.Client) {
 	now := time.Now()
@@ -575,30 +618,34 @@ func stateMachine(client mqtt.Client) {
 	// For each region
 	for regionName, region := range regionMap {
 
-		// Are we in the season?
-		inSeason := true
-		seasonStartString, ok1 := region["season/start"]
-		seasonEndString, ok2 := region["season/end"]
-		if ok1 && ok2 {
-			inSeason = false
-
-			seasonStart, ok1 := parsemmdd(seasonStartString, defaultSeasonStartMonth, defaultSeasonStartDay)
-			seasonEnd, ok2 := parsemmdd(seasonEndString, defaultSeasonEndMonth, defaultSeasonEndDay)
-			if ok1 && ok2 {
-				start := time.Date(now.Year(), time.Month(1), 1, 0, 0, 0, 0, loc).Add(seasonStart)
-				end := time.Date(now.Year(), time.Month(1), 1, 0, 0, 0, 0, loc).Add(seasonEnd).Add(time.Duration(24+9) * time.Hour)
-				if start.Before(end) {
-					if now.After(start) && now.Before(end) {
-						inSeason = true
-					}
-				} else if now.After(start) || now.Before(end) {
-					inSeason = true
-				}
-
-				if debug {
-					fmt.Println("\tIn season: ", inSeason)
+		// Is this region enabled?  If not, ignore buttons and commands and turn it off.
+		if region["enabled"] == "false" {
+			for deviceName, device := range deviceMap {
+				if device.region == regionName && device.button == "true" {
+					device.button = "false"
+					deviceMap[deviceName] = device
 				}
 			}
+			if _, ok := region["command"]; ok {
+				delete(region, "command")
+				var p publishType
+				p.topic = fmt.Sprintf("lighting/%s/command", regionName)
+				p.payload = ""
+				publishChan <- p
+			}
+			setRegionState(regionName, false)
+			continue
+		}
+
+		behavior := regionBehavior(region)
+		if debug {
+			fmt.Printf("\tBehavior in mode %s: %s\n", lightingMode, behavior)
+		}
+
+		// Are we in the season?
+		inSeason := regionInSeason(now, region)
+		if debug {
+			fmt.Println("\tIn season: ", inSeason)
 		}
 
 		// Are we in the window when the lights should be on?
@@ -611,8 +658,11 @@ func stateMachine(client mqtt.Client) {
 			startString = "light"
 		}
 
-		start := hhmmWindow(now, startString, 15)
-		end := hhmmWindow(now, region["window-end"], 23)
+		start := hhmmWindow(now, startString, defaultWindowStartHour)
+		end := hhmmWindow(now, region["window-end"], defaultWindowEndHour)
+		if behavior == "vacation" {
+			start, end = vacationWindow(regionName, now, start, end)
+		}
 
 		inWindow := false
 		if start.Before(end) {
@@ -628,6 +678,11 @@ func stateMachine(client mqtt.Client) {
 			inWindow = false
 		}
 
+		// out of season is treated as outside the window
+		if !inSeason {
+			inWindow = false
+		}
+
 		if debug {
 			fmt.Printf("\t\tIn window at light level %d: %v\n", lightLevel, inWindow)
 		}
@@ -726,6 +781,20 @@ func stateMachine(client mqtt.Client) {
 			shouldBeOn = !shouldBeOn
 		}
 
+		// The mode may override all of the above
+		switch behavior {
+		case "off":
+			shouldBeOn = false
+		case "on":
+			shouldBeOn = true
+		case "dark":
+			shouldBeOn = lightLevel < 4
+		case "vacation":
+			if !vacationEnable {
+				shouldBeOn = false
+			}
+		}
+
 		if debug {
 			fmt.Println("\t\tlights should be on:", shouldBeOn)
 		}
@@ -736,6 +805,11 @@ func stateMachine(client mqtt.Client) {
 
 func main() {
 
+	flag.Parse()
+	if debug {
+		verboseLog = true
+	}
+
 	go updater()
 
 	//mqtt.DEBUG = log.New(os.Stdout, "", 0)
@@ -761,6 +835,11 @@ func main() {
 		os.Exit(1)
 	}
 
+	if token := client.Subscribe("environment/alarm-state", 0, alarmHandler); token.Wait() && token.Error() != nil {
+		fmt.Println(token.Error())
+		os.Exit(1)
+	}
+
 	// sleep forever, processing requests for mqtt work
 	for {
 		select {
@@ -0,0 +1,175 @@
+/*
+ * Lighting modes.
+ *
+ * The house is in one of three modes, home, away or night, set by
+ * lighting/mode.  Each region says how it behaves in each mode with
+ * lighting/<region>/mode/<mode>, one of
+ *	auto		the usual window, light level and manual control rules
+ *	off		lights are off
+ *	on		lights are on
+ *	dark		lights are on whenever it is dark outside
+ *	vacation	if lighting/vacation is true, the auto rules with the
+ *			window moved by a random amount each day.  Otherwise off.
+ * A region that does not say is auto in every mode.
+ *
+ * If lighting/mode-follows-alarm is true the mode is also set from
+ * environment/alarm-state, as published by the automation daemon.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultMode = "home"
+const defaultBehavior = "auto"
+const vacationJitter = 30 // most minutes a vacation window moves
+
+var modes = map[string]bool{
+	"home":  true,
+	"away":  true,
+	"night": true,
+}
+
+var behaviors = map[string]bool{
+	"auto":     true,
+	"off":      true,
+	"on":       true,
+	"dark":     true,
+	"vacation": true,
+}
+
+// the mode each alarm state puts us in.  Other alarm states leave the mode alone.
+var alarmModes = map[string]string{
+	"disarmed":   "home",
+	"armed-stay": "night",
+	"armed-away": "away",
+}
+
+type jitterType struct {
+	day   int
+	start time.Duration
+	end   time.Duration
+}
+
+var (
+	lightingMode     string
+	vacationEnable   bool
+	modeFollowsAlarm bool
+	regionJitter     map[string]jitterType // map region name to today's vacation window offsets
+)
+
+func init() {
+	lightingMode = defaultMode
+	vacationEnable = false
+	modeFollowsAlarm = false
+	regionJitter = make(map[string]jitterType)
+	rand.Seed(time.Now().UnixNano())
+}
+
+// All mqtt messages about the alarm state are handled here
+var alarmHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	payload := string(msg.Payload())
+
+	if debug {
+		fmt.Printf("alarm message: %s\n", payload)
+	}
+
+	// the updater decides, as it owns the lighting mode
+	var update updateType
+	update.update = "alarm"
+	update.value1 = payload
+	updateChan <- update
+}
+
+/*
+ * These set the mode and what goes with it.  Called only from the
+ * updater, which is the only reader of them.
+ */
+func setMode(mode string) {
+	if !modes[mode] {
+		logMessage(fmt.Sprintf("Invalid lighting mode \"%s\" rejected", mode))
+		return
+	}
+	if lightingMode != mode {
+		lightingMode = mode
+		logMessage("Lighting mode set to " + mode)
+	}
+}
+
+func setVacation(payload string) {
+	switch payload {
+	case "true":
+		vacationEnable = true
+		logMessage("Vacation randomization enabled")
+	case "false":
+		vacationEnable = false
+		logMessage("Vacation randomization disabled")
+	}
+}
+
+func setModeFollowsAlarm(payload string) {
+	switch payload {
+	case "true":
+		modeFollowsAlarm = true
+		logMessage("Lighting mode follows the alarm state")
+	case "false":
+		modeFollowsAlarm = false
+		logMessage("Lighting mode does not follow the alarm state")
+	}
+}
+
+// The alarm state changed.  Maybe the mode does too.
+func alarmChanged(alarmState string) {
+	if !modeFollowsAlarm {
+		return
+	}
+
+	mode, ok := alarmModes[alarmState]
+	if !ok || mode == lightingMode {
+		return
+	}
+
+	logMessage(fmt.Sprintf("Alarm state %s sets lighting mode to %s", alarmState, mode))
+
+	// we'll receive this and set the mode like any other mode change
+	var p publishType
+	p.topic = "lighting/mode"
+	p.payload = mode
+	publishChan <- p
+}
+
+// Returns how a region behaves in the current mode
+func regionBehavior(region map[string]string) string {
+	behavior, ok := region["mode/"+lightingMode]
+	if !ok || !behaviors[behavior] {
+		return defaultBehavior
+	}
+	return behavior
+}
+
+/*
+ * Move a window by a random amount, so an empty house does not
+ * turn its lights on and off at the same time every day.  The amount
+ * is chosen once a day for each region.
+ *
+ * Called from the updater go routine.
+ */
+func vacationWindow(regionName string, now, start, end time.Time) (time.Time, time.Time) {
+	j, ok := regionJitter[regionName]
+	if !ok || j.day != now.YearDay() {
+		j.day = now.YearDay()
+		j.start = time.Duration(rand.Intn(2*vacationJitter+1)-vacationJitter) * time.Minute
+		j.end = time.Duration(rand.Intn(2*vacationJitter+1)-vacationJitter) * time.Minute
+		regionJitter[regionName] = j
+		if verboseLog {
+			logMessage(fmt.Sprintf("region %s vacation window moved by %v and %v", regionName, j.start, j.end))
+		}
+	}
+	return start.Add(j.start), end.Add(j.end)
+}
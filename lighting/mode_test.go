@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegionBehavior(t *testing.T) {
+	defer func() { lightingMode = defaultMode }()
+
+	region := map[string]string{
+		"mode/away":  "vacation",
+		"mode/night": "bogus",
+	}
+
+	var tests = []struct {
+		mode string
+		want string
+	}{
+		{"home", "auto"},
+		{"away", "vacation"},
+		{"night", "auto"},
+	}
+
+	for _, test := range tests {
+		lightingMode = test.mode
+		if got := regionBehavior(region); got != test.want {
+			t.Fatalf("In mode %s expected %s got %s", test.mode, test.want, got)
+		}
+	}
+}
+
+func TestVacationWindow(t *testing.T) {
+	defer delete(regionJitter, "test-region")
+
+	start := at(2026, time.December, 1, 17)
+	end := at(2026, time.December, 1, 23)
+	limit := time.Duration(vacationJitter) * time.Minute
+
+	s1, e1 := vacationWindow("test-region", start, start, end)
+	if s1.Sub(start) > limit || start.Sub(s1) > limit || e1.Sub(end) > limit || end.Sub(e1) > limit {
+		t.Fatalf("Window moved too far: %v to %v", s1, e1)
+	}
+
+	// same day, same window
+	s2, e2 := vacationWindow("test-region", start.Add(time.Hour), start, end)
+	if !s1.Equal(s2) || !e1.Equal(e2) {
+		t.Fatalf("Window changed during the day: %v to %v then %v to %v", s1, e1, s2, e2)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Checking of region settings.
+ *
+ * Every region setting is checked when it arrives.  What is wrong, and
+ * what is being done instead, is published retained to
+ * lighting/<region>/error.  The topic is erased once all the settings
+ * of the region are good.  Bad calendars are reported the same way on
+ * lighting/calendar/<name>/error.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var regionErrors = make(map[string]map[string]string) // map region name to setting to problem
+
+// settings that are internal state, or are checked elsewhere
+var uncheckedSettings = map[string]bool{
+	"control": true,
+	"state":   true,
+	"command": true,
+	"drop":    true,
+	"error":   true,
+}
+
+/*
+ * Check one region setting.  Returns "" if the setting is good,
+ * otherwise what is wrong and what is done instead.
+ *
+ * Runs in the updater gothread, so is OK to look at calendarMap.
+ */
+func checkSetting(key, value string) string {
+	switch key {
+	case "window-start":
+		if value == "light" {
+			return ""
+		}
+		if _, err := checkhhmm(value); err != nil {
+			return fmt.Sprintf("window-start %v and is not \"light\", using %02d:00", err, defaultWindowStartHour)
+		}
+
+	case "window-end":
+		if _, err := checkhhmm(value); err != nil {
+			return fmt.Sprintf("window-end %v, using %02d:00", err, defaultWindowEndHour)
+		}
+
+	case "season/grace":
+		if _, err := checkhhmm(value); err != nil {
+			return fmt.Sprintf("season/grace %v, using %02d:00", err, defaultSeasonGrace)
+		}
+
+	case "season/start", "season/end":
+		if _, err := parseDateRule(value); err != nil {
+			return fmt.Sprintf("%s: %v, so season/start to season/end is never in season", key, err)
+		}
+
+	case "seasons":
+		if _, err := parseSeasons(value); err != nil {
+			return fmt.Sprintf("seasons: %v, so seasons is never in season", err)
+		}
+
+	case "calendar":
+		var missing []string
+		for _, name := range strings.Split(value, ",") {
+			if _, ok := calendarMap[strings.TrimSpace(name)]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Sprintf("calendar %s not defined, so has no seasons", strings.Join(missing, ","))
+		}
+
+	case "devices":
+		var invalid []string
+		for _, deviceName := range strings.Split(value, ",") {
+			if !validDevice(deviceName) {
+				invalid = append(invalid, "\""+deviceName+"\"")
+			}
+		}
+		if len(invalid) > 0 {
+			return fmt.Sprintf("invalid device names %s rejected", strings.Join(invalid, ","))
+		}
+
+	case "enabled":
+		if value != "true" && value != "false" {
+			return fmt.Sprintf("enabled \"%s\" is not true or false, using true", value)
+		}
+
+	default:
+		if uncheckedSettings[key] {
+			return ""
+		}
+
+		mode := strings.TrimPrefix(key, "mode/")
+		if mode == key {
+			return fmt.Sprintf("unknown setting %s ignored", key)
+		}
+		if !modes[mode] {
+			return fmt.Sprintf("unknown mode %s ignored", mode)
+		}
+		if !behaviors[value] {
+			return fmt.Sprintf("%s \"%s\" is not auto, off, on, dark or vacation, using %s",
+				key, value, defaultBehavior)
+		}
+	}
+
+	return ""
+}
+
+// All the problems with a region, in a stable order
+func regionErrorText(regionName string) string {
+	var keys, problems []string
+
+	for key := range regionErrors[regionName] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		problems = append(problems, regionErrors[regionName][key])
+	}
+	return strings.Join(problems, "; ")
+}
+
+func publishRegionErrors(regionName string) {
+	var p publishType
+	p.topic = fmt.Sprintf("lighting/%s/error", regionName)
+	p.payload = regionErrorText(regionName)
+	publishChan <- p
+}
+
+/*
+ * Check a region setting that just arrived and publish the region's
+ * problems if they changed.
+ *
+ * Runs in the updater gothread
+ */
+func checkRegionSetting(regionName, key, value string) {
+	// we hear our own error reports.  Make sure what is retained is current.
+	if key == "error" {
+		if value != regionErrorText(regionName) {
+			publishRegionErrors(regionName)
+		}
+		return
+	}
+
+	problem := checkSetting(key, value)
+	errors, ok := regionErrors[regionName]
+	if !ok {
+		errors = make(map[string]string)
+		regionErrors[regionName] = errors
+	}
+
+	if errors[key] == problem {
+		return
+	}
+
+	if problem == "" {
+		delete(errors, key)
+		logMessage(fmt.Sprintf("region %s setting %s fixed", regionName, key))
+	} else {
+		errors[key] = problem
+		logMessage(fmt.Sprintf("region %s: %s", regionName, problem))
+	}
+	publishRegionErrors(regionName)
+}
+
+// When calendars change, regions that name them may be fixed or broken
+func recheckCalendars() {
+	for regionName, region := range regionMap {
+		if value, ok := region["calendar"]; ok {
+			checkRegionSetting(regionName, "calendar", value)
+		}
+	}
+}
+
+// Report, or clear, a problem with a calendar definition
+func publishCalendarError(name, problem string) {
+	var p publishType
+	p.topic = fmt.Sprintf("lighting/calendar/%s/error", name)
+	p.payload = problem
+	publishChan <- p
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckSetting(t *testing.T) {
+	var tests = []struct {
+		key   string
+		value string
+		good  bool
+	}{
+		{"window-start", "light", true},
+		{"window-start", "17:30", true},
+		{"window-start", "dusk", false},
+		{"window-end", "23:00", true},
+		{"window-end", "24:00", false},
+		{"window-end", "light", false},
+		{"season/start", "11/4thu", true},
+		{"season/end", "1/32", false},
+		{"season/grace", "9", false},
+		{"seasons", "11/1-1/6,7/4", true},
+		{"seasons", "11/1-", false},
+		{"calendar", "no-such-calendar", false},
+		{"devices", "plug-0001,tp-plug-03", true},
+		{"devices", "plug-0001,plug 2", false},
+		{"enabled", "false", true},
+		{"enabled", "no", false},
+		{"mode/away", "vacation", true},
+		{"mode/away", "random", false},
+		{"mode/party", "on", false},
+		{"window-stat", "17:30", false},
+		{"control", "auto", true},
+	}
+
+	for _, test := range tests {
+		problem := checkSetting(test.key, test.value)
+		if (problem == "") != test.good {
+			t.Fatalf("Setting %s to \"%s\": expected good %v, got problem \"%s\"", test.key, test.value, test.good, problem)
+		}
+	}
+}
+
+// Errors are published when a setting goes bad and cleared when it is fixed
+func TestCheckRegionSetting(t *testing.T) {
+	debug = true
+	defer func() {
+		debug = false
+		delete(regionErrors, "test-region")
+	}()
+
+	checkRegionSetting("test-region", "window-end", "25:00")
+	p := <-publishChan
+	if p.topic != "lighting/test-region/error" || p.payload == "" {
+		t.Fatalf("Expected an error report, got %s: %s", p.topic, p.payload)
+	}
+
+	// a different bad value updates the report.  Hearing it back publishes nothing.
+	checkRegionSetting("test-region", "window-end", "26:00")
+	p = <-publishChan
+	if p.payload == "" {
+		t.Fatalf("Expected an updated error report")
+	}
+	checkRegionSetting("test-region", "error", p.payload)
+	if len(publishChan) != 0 {
+		t.Fatalf("Published when nothing changed")
+	}
+
+	checkRegionSetting("test-region", "window-end", "23:00")
+	p = <-publishChan
+	if p.topic != "lighting/test-region/error" || p.payload != "" {
+		t.Fatalf("Expected the error to be cleared, got %s: %s", p.topic, p.payload)
+	}
+
+	// a stale report is corrected
+	checkRegionSetting("test-region", "error", "left over from before")
+	p = <-publishChan
+	if p.payload != "" {
+		t.Fatalf("Expected the stale error to be cleared, got %s", p.payload)
+	}
+}
+
+// Our own error reports, heard back, are never stored as settings
+func TestRegionError(t *testing.T) {
+	regionMap["test-region"] = map[string]string{"control": "auto"}
+	defer func() {
+		delete(regionMap, "test-region")
+		delete(regionErrors, "test-region")
+	}()
+
+	updateRegion("test-region", "error", "left over from before")
+	p := <-publishChan
+	if p.topic != "lighting/test-region/error" || p.payload != "" {
+		t.Fatalf("Expected the stale error to be cleared, got %s: %s", p.topic, p.payload)
+	}
+	if _, ok := regionMap["test-region"]["error"]; ok {
+		t.Fatalf("Error stored as a setting")
+	}
+
+	// one for a dropped region is erased, and the region stays gone
+	updateRegion("dropped-region", "error", "left over from before")
+	p = <-publishChan
+	if p.topic != "lighting/dropped-region/error" || p.payload != "" {
+		t.Fatalf("Expected the error to be erased, got %s: %s", p.topic, p.payload)
+	}
+	if len(publishChan) != 0 {
+		t.Fatalf("Published more than the erase")
+	}
+	if _, ok := regionMap["dropped-region"]; ok {
+		t.Fatalf("Dropped region was created again")
+	}
+}
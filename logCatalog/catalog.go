@@ -0,0 +1,129 @@
+/*
+ * The catalog of log message numbers.
+ *
+ * Each service that logs registers its message numbers here, with a name,
+ * a severity, the format of the human readable version and whether it is
+ * a heartbeat, sent just to say all is well.  Those that log build their
+ * messages from it; the logger renders, filters and alerts by it.
+ *
+ * A message number, once given out, means that message for good.  One
+ * that is no longer sent is retired, not reused.  The test holds the
+ * catalog to the list in testdata/assigned.txt.
+ *
+ * Negative numbers are common to all services.
+ */
+
+package logCatalog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Debug Severity = iota
+	Info
+	Warning
+	Error
+)
+
+func (s Severity) String() string {
+	return [...]string{"debug", "info", "warning", "error"}[s]
+}
+
+// The Severity named s, as "warning"
+func ParseSeverity(s string) (Severity, error) {
+	for sev := Debug; sev <= Error; sev++ {
+		if strings.EqualFold(s, sev.String()) {
+			return sev, nil
+		}
+	}
+	return Debug, fmt.Errorf("Unknown severity %s", s)
+}
+
+type Entry struct {
+	Service   string // "" for those common to all
+	Num       int
+	Name      string
+	Severity  Severity
+	Format    string // the human readable version, for fmt.Sprintf
+	Heartbeat bool
+	Retired   bool // no longer sent, and its number not to be used again
+}
+
+var catalog = make(map[string]map[int]Entry)
+
+/*
+ * Adds the messages of service to the catalog.  A number may be
+ * registered only once.
+ */
+func Register(service string, entries ...Entry) error {
+	m, ok := catalog[service]
+	if !ok {
+		m = make(map[int]Entry)
+		catalog[service] = m
+	}
+	for _, e := range entries {
+		if (service == "") != (e.Num < 0) {
+			return fmt.Errorf("Message %s of %q: only common messages are negative", e.Name, service)
+		}
+		if old, ok := m[e.Num]; ok {
+			return fmt.Errorf("Message number %d of %q is both %s and %s", e.Num, service, old.Name, e.Name)
+		}
+		e.Service = service
+		m[e.Num] = e
+	}
+	return nil
+}
+
+func mustRegister(service string, entries ...Entry) {
+	if err := Register(service, entries...); err != nil {
+		panic(err)
+	}
+}
+
+// The entry for message num of service, or the common one
+func Lookup(service string, num int) (Entry, bool) {
+	if num < 0 {
+		service = ""
+	}
+	e, ok := catalog[service][num]
+	return e, ok
+}
+
+// Whether message num of service only says all is well
+func IsHeartbeat(service string, num int) bool {
+	e, ok := Lookup(service, num)
+	return ok && e.Heartbeat
+}
+
+// All the entries, by service and number
+func Entries() []Entry {
+	var entries []Entry
+	for _, m := range catalog {
+		for _, e := range m {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Service != entries[j].Service {
+			return entries[i].Service < entries[j].Service
+		}
+		return entries[i].Num < entries[j].Num
+	})
+	return entries
+}
+
+/*
+ * The human readable version of the message.  Formats without verbs
+ * ignore args.
+ */
+func (e Entry) Human(args ...interface{}) string {
+	if !strings.Contains(e.Format, "%") {
+		return e.Format
+	}
+	return fmt.Sprintf(e.Format, args...)
+}
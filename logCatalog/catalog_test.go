@@ -0,0 +1,100 @@
+package logCatalog
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+ * Holds the catalog to testdata/assigned.txt: every number assigned
+ * there is still in the catalog under the same name, and every number in
+ * the catalog has been assigned there.
+ */
+func TestAssigned(t *testing.T) {
+	f, err := os.Open("testdata/assigned.txt")
+	if err != nil {
+		t.Fatalf("Cannot open assigned list: %v", err)
+	}
+	defer f.Close()
+
+	assigned := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			t.Fatalf("assigned.txt line %d is malformed: %q", line, text)
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			t.Fatalf("assigned.txt line %d has a bad number: %q", line, text)
+		}
+		key := fields[0] + " " + fields[1]
+		if _, ok := assigned[key]; ok {
+			t.Fatalf("assigned.txt line %d assigns %s again", line, key)
+		}
+		assigned[key] = fields[2]
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range Entries() {
+		service := e.Service
+		if service == "" {
+			service = "-"
+		}
+		key := fmt.Sprintf("%s %d", service, e.Num)
+		name, ok := assigned[key]
+		if !ok {
+			t.Fatalf("%s %s is not in assigned.txt", key, e.Name)
+		}
+		if name != e.Name {
+			t.Fatalf("%s was %s and is now %s; retire it and assign a new number", key, name, e.Name)
+		}
+		seen[key] = true
+	}
+	for key, name := range assigned {
+		if !seen[key] {
+			t.Fatalf("%s %s was removed from the catalog; retire it instead", key, name)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register("ISPMonitor", Entry{Num: ISPNoRouter, Name: "Again"}); err == nil {
+		t.Fatal("Register reused a number")
+	}
+	if err := Register("Test", Entry{Num: -5, Name: "Negative"}); err == nil {
+		t.Fatal("Register took a negative number for a service")
+	}
+	if err := Register("", Entry{Num: 5, Name: "Positive"}); err == nil {
+		t.Fatal("Register took a positive common number")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	e, ok := Lookup("IPUpdate", IPUpdateNewAddress)
+	if !ok || e.Name != "NewAddress" || e.Service != "IPUpdate" {
+		t.Fatalf("Lookup got %+v, %v", e, ok)
+	}
+	if got := e.Human("10.0.0.1"); got != "New IP address: 10.0.0.1" {
+		t.Fatalf("Human got %q", got)
+	}
+	if e, ok = Lookup("ISPMonitor", Repeated); !ok || e.Name != "Repeated" {
+		t.Fatalf("common Lookup got %+v, %v", e, ok)
+	}
+	if _, ok = Lookup("Nobody", 0); ok {
+		t.Fatal("Lookup found an unknown service")
+	}
+	if !IsHeartbeat("IPUpdate", IPUpdateNoChange) || IsHeartbeat("IPUpdate", IPUpdateStartup) {
+		t.Fatal("IsHeartbeat is wrong")
+	}
+	if sev, err := ParseSeverity("WARNING"); err != nil || sev != Warning {
+		t.Fatalf("ParseSeverity got %v, %v", sev, err)
+	}
+}
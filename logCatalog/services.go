@@ -0,0 +1,64 @@
+/*
+ * The messages of each service.  Add to the end; never renumber.
+ */
+
+package logCatalog
+
+// Common to all services
+const (
+	Repeated = -1 // a run of the same message, summarized by logSimple
+)
+
+// ISPMonitor
+const (
+	ISPLifeIsGood = iota
+	ISPHelloWorld
+	ISPInternetDown
+	ISPWiFiDown
+	ISPWiFiReset
+	ISPModemReset
+	ISPStateInternetUp
+	ISPStateInternetDown
+	ISPStateWiFiDown
+	ISPContactFailed
+	ISPNoRouter
+	ISPMessagesDropped
+)
+
+// IPUpdate
+const (
+	IPUpdateNoChange = iota
+	IPUpdateStartup
+	IPUpdateGetFailed
+	IPUpdateNewAddress
+	IPUpdateUpdateFailed
+)
+
+func init() {
+	mustRegister("",
+		Entry{Num: Repeated, Name: "Repeated", Severity: Info, Format: "%q repeated %d times over %v"},
+	)
+
+	mustRegister("ISPMonitor",
+		Entry{Num: ISPLifeIsGood, Name: "LifeIsGood", Severity: Info, Format: "Internet Up for %d seconds", Heartbeat: true},
+		Entry{Num: ISPHelloWorld, Name: "HelloWorld", Severity: Info, Format: "Hello World! Version=%d"},
+		Entry{Num: ISPInternetDown, Name: "InternetDown", Severity: Warning, Format: "Internet Down for %d seconds"},
+		Entry{Num: ISPWiFiDown, Name: "WiFiDown", Severity: Warning, Format: "WiFi Down for %d seconds"},
+		Entry{Num: ISPWiFiReset, Name: "WiFiReset", Severity: Warning, Format: "Router Reset try %d"},
+		Entry{Num: ISPModemReset, Name: "ModemReset", Severity: Warning, Format: "Modem Reset try %d"},
+		Entry{Num: ISPStateInternetUp, Name: "StateInternetUp", Severity: Info, Format: "Internet Up"},
+		Entry{Num: ISPStateInternetDown, Name: "StateInternetDown", Severity: Error, Format: "Internet Down"},
+		Entry{Num: ISPStateWiFiDown, Name: "StateWiFiDown", Severity: Error, Format: "WiFi Down"},
+		Entry{Num: ISPContactFailed, Name: "ContactFailed", Severity: Warning, Format: "Contact Failed"},
+		Entry{Num: ISPNoRouter, Name: "NoRouter", Severity: Error, Format: "Contact with Router Failed"},
+		Entry{Num: ISPMessagesDropped, Name: "MessagesDropped", Severity: Warning, Format: "%d log messages dropped while the Internet was down"},
+	)
+
+	mustRegister("IPUpdate",
+		Entry{Num: IPUpdateNoChange, Name: "NoChange", Severity: Info, Format: "No IP Address Change", Heartbeat: true},
+		Entry{Num: IPUpdateStartup, Name: "Startup", Severity: Info, Format: "Startup. IP Address: %s"},
+		Entry{Num: IPUpdateGetFailed, Name: "GetFailed", Severity: Warning, Format: "Failed to get IP address"},
+		Entry{Num: IPUpdateNewAddress, Name: "NewAddress", Severity: Warning, Format: "New IP address: %s"},
+		Entry{Num: IPUpdateUpdateFailed, Name: "UpdateFailed", Severity: Error, Format: "Failed to update IP address"},
+	)
+}
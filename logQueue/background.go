@@ -2,94 +2,265 @@ package logQueue
 
 import (
 	"context"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strings"
+	"errors"
+	"fmt"
+	"math/rand"
 	"time"
 )
 
-const timeToSend = 10  // timeout in seconds
-const timeToWait = 600 // time between directory scans, in seconds
+var errSendFailed = errors.New("logQueue sender failed")
 
 /*
  * This function is the background thread.
  *
- * It wakes up every minute
- * When it wakes up it scans the directory.
- * For each file in the directory, it reads the file into a string,
- * and calls the sender function with the file name and file contents.
- *  (Note: the file name is presumed to be a timestamp)
- * If the sender returns false, it goes back to sleep.
- * If the sender returns true, it removes the corresponding file
- * and goes on to the next file.
+ * It drops messages over the age cap, sends everything queued, then
+ * sleeps, and goes around again.  After a failure it sleeps for the
+ * retry interval, doubled after each failure in a row up to the
+ * maximum, with jitter so many queues do not all try at once.  When
+ * everything has been sent it sleeps for the maximum, or until Log or
+ * Kick wakes it.
  *
- * The context passed to the sender has a timeout.  If that context
- * is cancelled or times out, sender is to return false.
- *
- * The thread exits when the context is cancelled
+ * The thread exits when the queue is closed
  */
 
-func backgroundLogThread(c context.Context, sender LogSender) {
+func (q *Queue) backgroundLogThread() {
+	defer close(q.done)
+
+	var backoff time.Duration
+	for {
+		if err := q.expire(time.Now()); err != nil {
+			return
+		}
+		err := q.sendAll(q.ctx)
+		if err != nil && err != errSendFailed && q.ctx.Err() == nil {
+			// Something is wrong with the log.  Give up.
+			return
+		}
+
+		wait := q.maxRetry
+		if err != nil {
+			backoff = q.nextBackoff(backoff)
+			wait = jitter(backoff)
+		} else {
+			backoff = 0
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-q.wake:
+			// something new to send, or the caller says the way is open
+			t.Stop()
+			backoff = 0
+		case <-q.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// The wait after another failure
+func (q *Queue) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return q.retryInterval
+	}
+	backoff *= 2
+	if backoff > q.maxRetry {
+		backoff = q.maxRetry
+	}
+	return backoff
+}
+
+// Somewhere between half of d and d
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+/*
+ * Sends what is queued, in sendOrder, a batch at a time.  Records
+ * sent are taken off the queue, and the cursor moves past them, as are
+ * those that can never be sent, which become dead letters.  If any in a
+ * batch is to be tried again, it stops.  A record that cannot be read
+ * is quarantined and skipped.
+ *
+ * The context passed to the sender has a timeout.
+ */
+func (q *Queue) sendAll(c context.Context) (err error) {
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
 	defer func() {
-		running = false
+		q.mu.Lock()
+		q.healthy = err == nil
+		q.mu.Unlock()
 	}()
 
+	// until nothing is left, as more may be logged while sending
 	for {
-		files, err := ioutil.ReadDir(workingDir)
+		batch, refs, summarized, err := q.nextBatch()
 		if err != nil {
-			return
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
 		}
-		for _, f := range files {
-			shortName := f.Name()
-			file := filepath.Join(workingDir, shortName)
-			// ignore files whose name begins with "_"
-			if strings.HasPrefix(shortName, "_") {
-				continue
-			}
 
-			content, err := ioutil.ReadFile(file)
-			if err != nil {
-				// for some reason could not read the file.
-				// try to remove it and then move on
-				err := os.Remove(file)
-				if err != nil {
-					// if there is an error, abort. Prevent infinite loop this way
-					return
-				}
-				continue
+		results := q.send(c, batch)
+		if err := q.sent(batch, refs, summarized, results); err != nil {
+			return err
+		}
+		for _, err := range results {
+			if err != nil && !IsPermanent(err) {
+				return errSendFailed
 			}
-			text := string(content)
-			ctx, cf := context.WithTimeout(c, timeToSend*time.Second)
-
-			// send the log message off into the world
-			r := sender(ctx, shortName, text)
-			cf()
-			if !r {
-				// sender failed
-				break
+		}
+	}
+}
+
+/*
+ * What is queued, in the order it is to be sent: the high priority
+ * records, then the normal ones, each oldest first.  The summary record,
+ * if there is one, is a normal one, in line where the oldest message it
+ * counts was.  At most max of them, if max is not zero.  Call with q.mu
+ * held.
+ */
+func (q *Queue) sendOrder(max int) []recordRef {
+	var order []recordRef
+	full := func() bool { return max > 0 && len(order) >= max }
+
+	for _, r := range q.index {
+		if full() {
+			return order
+		}
+		if !r.done && r.prio == High {
+			order = append(order, r)
+		}
+	}
+
+	summary := q.summaryCount > 0
+	for _, r := range q.index {
+		if full() {
+			return order
+		}
+		if r.done || r.prio != Normal {
+			continue
+		}
+		if summary && (r.when > q.summaryWhen || (r.when == q.summaryWhen && r.seqn > q.summarySeqn)) {
+			order = append(order, recordRef{summary: true})
+			summary = false
+			if full() {
+				return order
 			}
-			// worked.  delete the message and loop
-			err = os.Remove(file)
-			if err != nil {
-				// if there is an error, abort. Prevent infinite loop this way
-				return
+		}
+		order = append(order, r)
+	}
+	if summary && !full() {
+		order = append(order, recordRef{summary: true})
+	}
+	return order
+}
+
+/*
+ * The next batch to send, and where each record of it is.  If the
+ * summary record is in the batch, summarized is the count it was sent
+ * with.
+ */
+func (q *Queue) nextBatch() (batch []Record, refs []recordRef, summarized int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := q.batchSize
+	if q.batchSender == nil {
+		size = 1
+	}
+
+	for _, r := range q.sendOrder(size) {
+		if r.summary {
+			summarized = q.summaryCount
+			batch = append(batch, q.summaryRecord(summarized))
+			refs = append(refs, r)
+			continue
+		}
+		record, raw, err := q.read(r)
+		if err != nil {
+			// set it aside, and move on
+			if err := q.quarantine(r.segment, r.offset, raw); err != nil {
+				// abort.  Prevent infinite loop this way
+				return nil, nil, 0, fmt.Errorf("Cannot quarantine unreadable record in %s: %v", q.segmentPath(r.segment), err)
 			}
+			q.markDone(q.find(r))
+			continue
 		}
+		batch = append(batch, record)
+		refs = append(refs, r)
+	}
+	return batch, refs, summarized, q.saveCursor()
+}
 
-		// Either we processed all the files or the sender failed
-		// Wait until 5 minutes or until the incoming context is cancelled.
-		t := timeToWait
-		if debugMode {
-			t = 5
+// Where a record is in the index, or -1.  Call with q.mu held.
+func (q *Queue) find(r recordRef) int {
+	for i := range q.index {
+		if q.index[i].segment == r.segment && q.index[i].offset == r.offset {
+			return i
 		}
-		ctx, cf := context.WithTimeout(c, time.Duration(t)*time.Second)
-		<-ctx.Done()
-		if c.Err() != nil {
-			// If the incoming context has been cancelled, we are instructed to stop.
-			cf()
-			return
+	}
+	return -1
+}
+
+/*
+ * Sends a batch, with the BatchSender, or with the LogSender one at a
+ * time until one fails.  Returns the result for each, as a BatchSender.
+ */
+func (q *Queue) send(c context.Context, batch []Record) []error {
+	results := make([]error, len(batch))
+	for i := range results {
+		results[i] = errNotSent
+	}
+
+	ctx, cf := context.WithTimeout(c, q.sendTimeout)
+	defer cf()
+
+	if q.batchSender != nil {
+		copy(results, q.batchSender(ctx, batch))
+		return results
+	}
+	for i, r := range batch {
+		if !q.sender(ctx, r.Name, r.Body) {
+			break
+		}
+		results[i] = nil
+	}
+	return results
+}
+
+/*
+ * Takes what was sent, or never can be, off the queue, unless it was
+ * dropped meanwhile.  If the summary was sent, what more was dropped
+ * while it was being sent stays as a summary.
+ */
+func (q *Queue) sent(batch []Record, refs []recordRef, summarized int, results []error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for n, r := range refs {
+		if results[n] != nil {
+			if !IsPermanent(results[n]) {
+				continue
+			}
+			if err := q.bury(batch[n], results[n]); err != nil {
+				return err
+			}
+		}
+		if r.summary {
+			q.setSummary(q.summaryCount - summarized)
+			continue
+		}
+		if i := q.find(r); i >= 0 {
+			q.markDone(i)
 		}
-		cf()
 	}
+	return q.saveCursor()
 }
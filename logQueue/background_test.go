@@ -2,32 +2,207 @@ package logQueue
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-var linkchan chan string
+// A sender that passes everything down a channel
+func channelSender(linkchan chan string) LogSender {
+	return func(c context.Context, t, s string) bool {
+		select {
+		case linkchan <- t + " " + s:
+			return true
+		case <-c.Done():
+			return false
+		}
+	}
+}
 
 // first test. The background thread should never call the sender
 func TestBackgroundLogThread1(t *testing.T) {
+	linkchan := make(chan string)
 
-	linkchan = make(chan string)
-	defer close(linkchan)
-
-	c, cxf := context.WithTimeout(context.Background(), 7*time.Second)
-	defer cxf()
+	q, err := New(Options{Dir: t.TempDir(), Sender: channelSender(linkchan), RetryInterval: time.Second})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
 
-	go backgroundLogThread(c, mySender1)
 	select {
 	case m := <-linkchan:
 		t.Fatalf("Got unexpected message in test1: %s", m)
-	case <-c.Done():
+	case <-time.After(3 * time.Second):
+	}
+}
+
+// a message logged while the sender works goes out without waiting
+func TestBackgroundWake(t *testing.T) {
+	linkchan := make(chan string, 1)
+	q, err := New(Options{Dir: t.TempDir(), Sender: channelSender(linkchan), RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+
+	q.Log("now")
+	select {
+	case <-linkchan:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Message not sent when logged")
+	}
+}
+
+// a failing sender is left alone until kicked
+func TestBackgroundKick(t *testing.T) {
+	g := new(gate)
+	q, err := New(Options{Dir: t.TempDir(), Sender: g.send, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+
+	q.Log("m0")
+	q.Log("m1")
+	time.Sleep(100 * time.Millisecond)
+	g.mu.Lock()
+	g.open = true
+	g.mu.Unlock()
+	if stats := q.Stats(); stats.Messages != 2 {
+		t.Fatalf("%d messages queued", stats.Messages)
+	}
+
+	q.Kick()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Stats().Messages > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Not sent after Kick")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{retryInterval: time.Second, maxRetry: 5 * time.Second}
+	var backoff time.Duration
+	for _, expected := range []time.Duration{1, 2, 4, 5, 5} {
+		backoff = q.nextBackoff(backoff)
+		if backoff != expected*time.Second {
+			t.Fatalf("Backoff %v, expected %v", backoff, expected*time.Second)
+		}
+		for i := 0; i < 10; i++ {
+			if j := jitter(backoff); j < backoff/2 || j > backoff {
+				t.Fatalf("Jitter %v of %v", j, backoff)
+			}
+		}
+	}
+}
+
+// A batch sender that fails the records it is told to, once each
+type batcher struct {
+	mu      sync.Mutex
+	fail    map[string]bool
+	batches [][]string
+	sent    []string
+}
+
+func (b *batcher) send(c context.Context, records []Record) []error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var batch []string
+	results := make([]error, len(records))
+	for i, r := range records {
+		batch = append(batch, r.Body)
+		if b.fail[r.Body] {
+			delete(b.fail, r.Body)
+			results[i] = errors.New("try again")
+			continue
+		}
+		b.sent = append(b.sent, r.Body)
+	}
+	b.batches = append(b.batches, batch)
+	return results
+}
+
+// only what was not sent in a batch is sent again, even after a restart
+func TestBatchPartial(t *testing.T) {
+	dir := t.TempDir()
+	b := &batcher{fail: map[string]bool{"m1": true}}
+	never := func(c context.Context, t, s string) bool { return false }
+
+	q, err := New(Options{Dir: dir, Sender: never, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logN(t, q, 7)
+	q.Close()
+
+	q, err = New(Options{Dir: dir, BatchSender: b.send, BatchSize: 3, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	// the background thread tries first
+	time.Sleep(100 * time.Millisecond)
+	q.Close()
+	if got := fmt.Sprint(b.batches); got != "[[m0 m1 m2]]" {
+		t.Fatalf("Batches %s", got)
+	}
+
+	q, err = New(Options{Dir: dir, BatchSender: b.send, BatchSize: 3, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+	if stats := q.Stats(); stats.Messages != 5 {
+		t.Fatalf("%d messages queued after restart", stats.Messages)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := strings.Join(b.sent, ","); got != "m0,m2,m1,m3,m4,m5,m6" {
+		t.Fatalf("Sent %s", got)
+	}
+	if stats := q.Stats(); stats.Messages != 0 {
+		t.Fatalf("%d messages queued after flush", stats.Messages)
 	}
 }
 
-func mySender1(c context.Context, t, s string) bool {
-	log.Printf("Sender called on %s %s", t, s)
-	linkchan <- t + " " + s
-	return true
+// a sender that answers for fewer than it was given sent only those
+func TestBatchShort(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		tries int
+	)
+	short := func(c context.Context, records []Record) []error {
+		mu.Lock()
+		defer mu.Unlock()
+		tries++
+		return []error{nil}
+	}
+	dir := t.TempDir()
+	never := func(c context.Context, t, s string) bool { return false }
+	q, err := New(Options{Dir: dir, Sender: never, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	logN(t, q, 3)
+	q.Close()
+
+	q, err = New(Options{Dir: dir, BatchSender: short, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+	// each try sends one more
+	for i := 0; i < 3; i++ {
+		q.Flush(context.Background())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stats := q.Stats(); stats.Messages != 0 || tries != 3 {
+		t.Fatalf("%d messages queued after %d tries", stats.Messages, tries)
+	}
 }
@@ -0,0 +1,112 @@
+package logQueue
+
+/*
+ * Dead letters.
+ *
+ * A record its sender says can never be sent is not tried again.  It is
+ * moved to dead/ in the queue directory, one JSON file each, with the
+ * reason, so someone can look at it and perhaps put it back.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const deadDirName = "dead"
+
+// A sender's error for a record that can never be sent
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Marks a sender's error as one trying again will not fix
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// errNotSent is a try again, when a sender has nothing better to say
+var errNotSent = errors.New("not sent")
+
+// A record that could not be sent, and why
+type DeadLetter struct {
+	Record
+	Reason string
+	Failed time.Time
+}
+
+func (q *Queue) deadDir() string {
+	return filepath.Join(q.dir, deadDirName)
+}
+
+// Moves a record to the dead letters.  Call with q.mu held.
+func (q *Queue) bury(r Record, reason error) error {
+	if err := os.MkdirAll(q.deadDir(), 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(DeadLetter{Record: r, Reason: reason.Error(), Failed: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(q.deadDir(), r.Name+".json")
+	tempFileName := filepath.Join(q.deadDir(), "_"+r.Name)
+	if err := ioutil.WriteFile(tempFileName, content, 0600); err != nil {
+		return fmt.Errorf("Cannot write dead letter %s: %v", tempFileName, err)
+	}
+	if err := os.Rename(tempFileName, name); err != nil {
+		os.Remove(tempFileName)
+		return fmt.Errorf("Cannot rename dead letter %s to %s: %v", tempFileName, name, err)
+	}
+	q.stats.DeadLetters++
+	return nil
+}
+
+// The dead letters, oldest first
+func (q *Queue) DeadLetters() ([]DeadLetter, error) {
+	var dead []DeadLetter
+
+	files, err := ioutil.ReadDir(q.deadDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(q.deadDir(), f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var d DeadLetter
+		if err := json.Unmarshal(content, &d); err != nil {
+			return nil, fmt.Errorf("Cannot parse dead letter %s: %v", f.Name(), err)
+		}
+		dead = append(dead, d)
+	}
+	sort.Slice(dead, func(i, j int) bool {
+		return dead[i].When < dead[j].When || (dead[i].When == dead[j].When && dead[i].Seqn < dead[j].Seqn)
+	})
+	return dead, nil
+}
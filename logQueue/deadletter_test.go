@@ -0,0 +1,150 @@
+package logQueue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// attributes go in with a record, and come out with it after a restart
+func TestRecordAttributes(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		open bool
+		got  []Record
+	)
+	sender := func(c context.Context, records []Record) []error {
+		mu.Lock()
+		defer mu.Unlock()
+		results := make([]error, len(records))
+		for i, r := range records {
+			if !open {
+				results[i] = errors.New("closed")
+				continue
+			}
+			got = append(got, r)
+		}
+		return results
+	}
+	opts := Options{Dir: t.TempDir(), BatchSender: sender, RetryInterval: time.Hour}
+	q, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	q.LogRecord(map[string]string{"MsgNum": "7", "Human": "seven"}, "body")
+	q.Log("plain")
+	q.Close()
+	if stats := q.Stats(); stats.Bytes != int64(len("MsgNum7Humansevenbodyplain")) {
+		t.Fatalf("Stats %+v", stats)
+	}
+
+	mu.Lock()
+	open = true
+	mu.Unlock()
+	q, err = New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("Got %d records", len(got))
+	}
+	if a := got[0].Attributes; len(a) != 2 || a["MsgNum"] != "7" || a["Human"] != "seven" || got[0].Body != "body" {
+		t.Fatalf("Got %+v", got[0])
+	}
+	if got[1].Attributes != nil || got[1].Body != "plain" || got[1].Name != recordName(got[1].When, got[1].Seqn) {
+		t.Fatalf("Got %+v", got[1])
+	}
+}
+
+// a record from before there were attributes still reads
+func TestRecordPlain(t *testing.T) {
+	payload := make([]byte, fixedSize, fixedSize+3)
+	binary.BigEndian.PutUint64(payload[0:8], 5)
+	binary.BigEndian.PutUint32(payload[8:12], 3)
+	payload = append(payload, "old"...)
+	plain := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(plain[0:2], plainMagic)
+	binary.BigEndian.PutUint32(plain[2:6], uint32(len(payload)))
+	binary.BigEndian.PutUint32(plain[6:10], crc32.Checksum(payload, crcTable))
+	plain = append(plain, payload...)
+
+	size, r, err := decodeRecord(plain)
+	if err != nil || size != int64(len(plain)) {
+		t.Fatalf("Decode failed, size %d err %v", size, err)
+	}
+	if r.When != 5 || r.Seqn != 3 || r.Attributes != nil || r.Body != "old" || r.Name != "5_03" {
+		t.Fatalf("Got %+v", r)
+	}
+}
+
+// a record that can never be sent becomes a dead letter, and the rest go on
+func TestDeadLetter(t *testing.T) {
+	var sent []string
+	sender := func(c context.Context, records []Record) []error {
+		results := make([]error, len(records))
+		for i, r := range records {
+			if r.Body == "bad" {
+				results[i] = Permanent(errors.New("malformed"))
+				continue
+			}
+			sent = append(sent, r.Body)
+		}
+		return results
+	}
+	dir := t.TempDir()
+	never := func(c context.Context, t, s string) bool { return false }
+	q, err := New(Options{Dir: dir, Sender: never, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	q.Log("m0")
+	q.LogRecord(map[string]string{"k": "v"}, "bad")
+	q.Log("m2")
+	q.Close()
+
+	q, err = New(Options{Dir: dir, BatchSender: sender, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := strings.Join(sent, ","); got != "m0,m2" {
+		t.Fatalf("Sent %s", got)
+	}
+	if stats := q.Stats(); stats.Messages != 0 || stats.DeadLetters != 1 {
+		t.Fatalf("Stats %+v", stats)
+	}
+
+	dead, err := q.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters failed: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Body != "bad" || dead[0].Attributes["k"] != "v" ||
+		dead[0].Reason != "malformed" || dead[0].Failed.IsZero() {
+		t.Fatalf("Dead letters %+v", dead)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	base := errors.New("base")
+	if IsPermanent(base) || !IsPermanent(Permanent(base)) || Permanent(nil) != nil {
+		t.Fatalf("Permanent is wrong")
+	}
+	if !errors.Is(Permanent(base), base) {
+		t.Fatalf("Permanent does not unwrap")
+	}
+}
@@ -1,6 +1,11 @@
 /*
  * System for enqueing log messages and then later, when possible
  * shipping them off somewhere
+ *
+ * Each queue is a directory, holding a write-ahead log of the messages
+ * as in wal.go.  Each message is named for the time it was logged and
+ * a sequence number within that second.  A process may run any number
+ * of queues, each in its own directory.
  */
 
 package logQueue
@@ -9,119 +14,375 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var (
-	workingDir = filepath.Join(os.TempDir(), "logQueue")
-	oldNow     int64
+const (
+	// Where a queue is kept if neither Options.Dir nor $LOGQUEUEDIR say.
+	// Not under /tmp, which may be cleaned out at boot.
+	DefaultDir = "/var/spool/logQueue"
+
+	defaultRetryInterval    = 10 * time.Second // first wait after a failure
+	defaultMaxRetryInterval = 600 * time.Second
+	defaultSendTimeout      = 10 * time.Second
+	defaultBatchSize        = 100
+
+	lockFileName = "lock"
 )
 
+/*
+ * Sends one message.  t is its name, <seconds>_<seqn>, which is the time
+ * the message was logged, and s is the message.  Returns true if it was sent.  If
+ * the context is cancelled or times out, the sender is to return false.
+ * A LogSender does not see attributes.
+ */
 type LogSender func(c context.Context, t, s string) bool
 
-var (
-	running   bool
-	seqn      int64
-	epoch     time.Time
-	debugMode bool
+/*
+ * High priority messages are sent before normal ones, whenever they
+ * were logged, and are the last to be dropped to make room.
+ */
+type Priority int
+
+const (
+	Normal Priority = iota
+	High
 )
 
+// A queued message
+type Record struct {
+	Name       string // <seconds>_<seqn>, as a LogSender's t
+	When       int64  // seconds since the epoch the message was logged
+	Seqn       int    // within that second
+	Priority   Priority
+	Attributes map[string]string
+	Body       string
+}
+
 /*
- * Initializes the system.  Spawns a thread
- * that does the work
+ * Sends a batch of messages, oldest first.  Returns, for each, nil if it
+ * was sent, an error made by Permanent if it never can be, or any other
+ * error to try it again later.  Those sent, or never to be, are not
+ * tried again, whatever their place in the batch.  A missing result is
+ * a try again.  The context's timeout is for the whole batch.
  */
-func Start(myContext context.Context, sender LogSender) error {
-	// Already running?
-	if running {
-		return errors.New("logQueue already started")
-	}
+type BatchSender func(c context.Context, records []Record) []error
 
-	// does the working directory exist?
-	_, err := ioutil.ReadDir(workingDir)
-	if err != nil {
-		// No.  Try making it
-		err = os.Mkdir(workingDir, 0755)
-		if err != nil {
-			// Nope.  We are done.
-			return fmt.Errorf("Trying to mkdir %s got error %v",
-				workingDir,
-				err)
-		}
+type Options struct {
+	Dir              string        // the queue directory.  Default $LOGQUEUEDIR, then DefaultDir
+	Sender           LogSender     // this, or BatchSender, is required
+	BatchSender      BatchSender   // if set, used instead of Sender
+	BatchSize        int           // most records to a BatchSender call.  Default 100.
+	RetryInterval    time.Duration // first wait after a failure, doubling from there.  Default 10 seconds.
+	MaxRetryInterval time.Duration // longest wait.  Default 10 minutes, or RetryInterval if longer.
+	SendTimeout      time.Duration // for each call to Sender or BatchSender.  Default 10 seconds.
+	SegmentBytes     int64         // size at which a new segment is started.  Default 1MB.
+
+	// Retention, as in retention.go.  Zero is no cap.
+	MaxMessages int
+	MaxBytes    int64
+	MaxAge      time.Duration
+	Policy      Policy
+	Summary     func(dropped int) (attributes map[string]string, body string) // a summary record
+}
+
+type Queue struct {
+	dir           string
+	sender        LogSender
+	batchSender   BatchSender
+	batchSize     int
+	retryInterval time.Duration
+	maxRetry      time.Duration
+	sendTimeout   time.Duration
+	maxMessages   int
+	maxBytes      int64
+	maxAge        time.Duration
+	policy        Policy
+	summary       func(dropped int) (map[string]string, string)
+	segmentBytes  int64
+
+	mu           sync.Mutex // guards what follows, and the files in the directory
+	seqn         int64
+	oldNow       int64
+	closed       bool
+	healthy      bool // the last try to send worked
+	stats        Stats
+	summaryCount int   // the messages the summary record counts, if any
+	summaryWhen  int64 // and its name
+	summarySeqn  int
+	index        []recordRef // what is queued, from the cursor on
+	cursor       cursorType  // as last saved
+	cursorText   string
+	writeSegment int64
+	writeFile    *os.File
+	writeOffset  int64
+	lockFile     *os.File
+
+	sendMu sync.Mutex    // held while sending, by the background or by Flush
+	wake   chan struct{} // wakes the background thread
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var epoch time.Time
+
+var ErrClosed = errors.New("logQueue closed")
+
+func init() {
+	epoch, _ = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
+}
+
+/*
+ * Makes a queue, and spawns a thread that does the work.  Messages
+ * left in the log by an earlier run are sent too.
+ */
+func New(opts Options) (*Queue, error) {
+	if opts.Sender == nil && opts.BatchSender == nil {
+		return nil, errors.New("logQueue needs a sender")
 	}
-	clean(false)
 
-	epoch, err = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
+	q, err := newQueue(opts)
 	if err != nil {
-		return fmt.Errorf("failed to get epoch")
+		return nil, err
 	}
 
 	// spawn the thread that will pump the enqueued messages
-	go backgroundLogThread(myContext, sender)
-	running = true
-	return nil
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.done = make(chan struct{})
+	q.wake = make(chan struct{}, 1)
+	q.healthy = true
+	go q.backgroundLogThread()
+	return q, nil
 }
 
-func Log(s string) error {
-	if !running {
-		return errors.New("logQueue not running")
+/*
+ * Opens a queue to look at or work on, as in inspect.go, with no sender
+ * and no background thread.
+ */
+func Inspect(dir string) (*Queue, error) {
+	if dir == "" {
+		return nil, errors.New("logQueue needs a directory to inspect")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
 	}
 
-	// write the log message to a temporary file
-	tempFileName := filepath.Join(workingDir, "_"+strconv.FormatInt(seqn, 10))
-	tempFile, err := os.OpenFile(tempFileName, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0600)
+	q, err := newQueue(Options{Dir: dir})
 	if err != nil {
-		return fmt.Errorf("Cannot creat temp file %s: %v", tempFileName, err)
+		return nil, err
 	}
-	_, err = tempFile.WriteString(s)
-	if err != nil {
-		return fmt.Errorf("Cannot write temp file %s: %v", tempFileName, err)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.done = make(chan struct{})
+	q.wake = make(chan struct{}, 1)
+	close(q.done)
+	return q, nil
+}
+
+// A queue, its log read, with no background thread
+func newQueue(opts Options) (*Queue, error) {
+	q := new(Queue)
+	q.sender = opts.Sender
+	q.batchSender = opts.BatchSender
+	q.batchSize = opts.BatchSize
+	if q.batchSize <= 0 {
+		q.batchSize = defaultBatchSize
+	}
+	q.dir = opts.Dir
+	if q.dir == "" {
+		q.dir = os.Getenv("LOGQUEUEDIR")
+	}
+	if q.dir == "" {
+		q.dir = DefaultDir
+	}
+	q.retryInterval = opts.RetryInterval
+	if q.retryInterval <= 0 {
+		q.retryInterval = defaultRetryInterval
+	}
+	q.maxRetry = opts.MaxRetryInterval
+	if q.maxRetry <= 0 {
+		q.maxRetry = defaultMaxRetryInterval
+	}
+	if q.maxRetry < q.retryInterval {
+		q.maxRetry = q.retryInterval
+	}
+	q.sendTimeout = opts.SendTimeout
+	if q.sendTimeout <= 0 {
+		q.sendTimeout = defaultSendTimeout
 	}
-	tempFile.Close()
 
-	// rename the temp file to its final name
-	now := int64(time.Since(epoch) / time.Second)
-	if now != oldNow {
-		seqn = 0
-		oldNow = now
+	if opts.MaxMessages < 0 || opts.MaxBytes < 0 || opts.MaxAge < 0 {
+		return nil, errors.New("logQueue caps may not be negative")
 	}
-	logFileName := filepath.Join(workingDir, fmt.Sprintf("%d_%02d", now, seqn))
-	seqn += 1
-	err = os.Rename(tempFileName, logFileName)
+	q.maxMessages = opts.MaxMessages
+	q.maxBytes = opts.MaxBytes
+	q.maxAge = opts.MaxAge
+	if opts.Policy < DropOldest || opts.Policy > Summarize {
+		return nil, fmt.Errorf("logQueue policy %d unknown", opts.Policy)
+	}
+	q.policy = opts.Policy
+	q.summary = opts.Summary
+	if q.summary == nil {
+		q.summary = defaultSummary
+	}
+	q.segmentBytes = opts.SegmentBytes
+	if q.segmentBytes <= 0 {
+		q.segmentBytes = defaultSegmentBytes
+	}
+
+	err := os.MkdirAll(q.dir, 0755)
 	if err != nil {
-		return fmt.Errorf("Cannot rename temp file %s to %s: %v", tempFileName, logFileName, err)
+		return nil, fmt.Errorf("Trying to mkdir %s got error %v", q.dir, err)
+	}
+	if err := q.lock(); err != nil {
+		return nil, err
 	}
+	if err := q.open(); err != nil {
+		if q.writeFile != nil {
+			q.writeFile.Close()
+		}
+		q.lockFile.Close()
+		return nil, fmt.Errorf("Cannot read log queue %s: %v", q.dir, err)
+	}
+	return q, nil
+}
 
+/*
+ * Only one queue, in one process, may use a directory at a time.  The
+ * lock goes when the lock file is closed, or the process exits.
+ */
+func (q *Queue) lock() error {
+	name := filepath.Join(q.dir, lockFileName)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open lock file %s: %v", name, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return fmt.Errorf("logQueue %s is in use: %v", q.dir, err)
+	}
+	q.lockFile = f
 	return nil
 }
 
 /*
- * Clean junk out of the log directory.
- * If the arg is true, cleans everything out.
- * Returns true if anything was cleaned out
+ * Queues a message.  A message dropped under the retention policy is
+ * not an error.  If the sender is working, the message is sent right
+ * away; if not, it waits for the next try.
  */
+func (q *Queue) Log(s string) error {
+	return q.LogRecord(nil, s)
+}
 
-func clean(very bool) (retval bool) {
+// Queues a message with attributes, as Log
+func (q *Queue) LogRecord(attributes map[string]string, body string) error {
+	return q.LogPriority(Normal, attributes, body)
+}
 
-	retval = false
-	files, err := ioutil.ReadDir(workingDir)
-	if err != nil {
-		return
+// Queues a message with attributes and a priority, as Log
+func (q *Queue) LogPriority(prio Priority, attributes map[string]string, body string) error {
+	if prio < Normal || prio > High {
+		return fmt.Errorf("logQueue priority %d unknown", prio)
 	}
 
-	for _, f := range files {
-		shortName := f.Name()
-		file := filepath.Join(workingDir, shortName)
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-		// ignore files whose name begins with "_"
-		if very || strings.HasPrefix(shortName, "_") {
-			os.Remove(file)
-			retval = true
+	if q.closed {
+		return ErrClosed
+	}
+
+	size := messageSize(attributes, body)
+	room, err := q.makeRoom(size, prio)
+	if err != nil {
+		return err
+	}
+	if !room {
+		q.stats.Dropped++
+		q.stats.DroppedBytes += size
+		if q.policy == Summarize && q.summaryCount > 0 {
+			q.stats.Summarized++
+			q.setSummary(q.summaryCount + 1)
+			return q.saveCursor()
 		}
+		return nil
 	}
-	return
+
+	now := int64(time.Since(epoch) / time.Second)
+	if now != q.oldNow {
+		q.seqn = 0
+		q.oldNow = now
+	}
+
+	seqn := int(q.seqn)
+	q.seqn++
+	if err := q.append(now, seqn, prio, attributes, body); err != nil {
+		return err
+	}
+	if q.healthy {
+		q.kick()
+	}
+	return nil
+}
+
+/*
+ * Tries to send now, and starts the backoff over.  For a caller that
+ * knows the way is open again.
+ */
+func (q *Queue) Kick() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.kick()
+	}
+}
+
+func (q *Queue) kick() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// already awake
+	}
+}
+
+/*
+ * Sends everything queued, now, in this thread.  Returns an error if
+ * anything is left unsent.
+ */
+func (q *Queue) Flush(c context.Context) error {
+	q.mu.Lock()
+	closed := q.closed
+	q.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	return q.sendAll(c)
+}
+
+/*
+ * Stops the background thread and waits for it.  Messages not yet sent
+ * stay in the log for next time.
+ */
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mu.Unlock()
+
+	q.cancel()
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.writeFile.Close()
+	q.lockFile.Close()
+	return err
 }
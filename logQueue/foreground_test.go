@@ -3,56 +3,65 @@ package logQueue
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-var (
-	blocked  bool
-	nblocked int
-)
+func testQueue(t *testing.T, dir string, sender LogSender) *Queue {
+	q, err := New(Options{Dir: dir, Sender: sender, RetryInterval: time.Second, SendTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// nothing queued, and the segments sent are compacted away
+func empty(t *testing.T, q *Queue) {
+	t.Helper()
+	if stats := q.Stats(); stats.Messages != 0 || stats.Bytes != 0 {
+		t.Fatalf("Found %d messages queued at end of test", stats.Messages)
+	}
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatalf("Cannot read %s: %v", q.dir, err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("Found %d segments in log directory at end of test", len(segments))
+	}
+}
 
 // write a log record and see that it comes back out
 func TestLogWrite1(t *testing.T) {
+	linkchan := make(chan string)
+	q := testQueue(t, t.TempDir(), channelSender(linkchan))
 
-	debugMode = true
-
-	linkchan = make(chan string)
-	defer close(linkchan)
-
-	c, cxf := context.WithTimeout(context.Background(), 12*time.Second)
-	defer cxf()
-	Start(c, mySender1)
 	myMessage := "Test Message 1"
-	err := Log(myMessage)
+	err := q.Log(myMessage)
 	if err != nil {
 		t.Fatalf("Logging failed err = %v", err)
 	}
-	messages := 1
 
-	for {
-		select {
-		case m := <-linkchan:
-			if messages != 1 {
-				t.Fatalf("Got unexpected or duplicate message in test log write 1: %s", m)
-			}
-			// did we get what we sent?
-			mFields := strings.SplitN(m, " ", 2)
-			if len(mFields) != 2 {
-				t.Fatalf("Recieved message badly formatted: %s", m)
-			}
-			if mFields[1] != myMessage {
-				t.Fatalf("Sent .%s. got .%s.", myMessage, mFields[1])
-			}
-			messages -= 1
-		case <-c.Done():
-			if messages != 0 {
-				t.Fatalf("Message never received in test log write 1")
-			}
-			return
+	select {
+	case m := <-linkchan:
+		// did we get what we sent?
+		mFields := strings.SplitN(m, " ", 2)
+		if len(mFields) != 2 {
+			t.Fatalf("Recieved message badly formatted: %s", m)
+		}
+		if mFields[1] != myMessage {
+			t.Fatalf("Sent .%s. got .%s.", myMessage, mFields[1])
 		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message never received in test log write 1")
+	}
+
+	select {
+	case m := <-linkchan:
+		t.Fatalf("Got unexpected or duplicate message in test log write 1: %s", m)
+	case <-time.After(2 * time.Second):
 	}
 }
 
@@ -61,106 +70,130 @@ const nMess2 = 10
 
 // write a bunch of log records
 func TestLogWrite2(t *testing.T) {
+	linkchan := make(chan string, nMess1)
+	dir := t.TempDir()
+	q := testQueue(t, dir, channelSender(linkchan))
 
-	debugMode = true
-
-	linkchan = make(chan string)
-	defer close(linkchan)
-
-	c, cxf := context.WithTimeout(context.Background(), 12*time.Second)
-	defer cxf()
-	Start(c, mySender1)
 	for i := 0; i < nMess1; i++ {
-		err := Log(fmt.Sprintf("Test Message %d", i))
+		err := q.Log(fmt.Sprintf("Test Message %d", i))
 		if err != nil {
 			t.Fatalf("Logging failed on message %d, err = %v", i, err)
 		}
 	}
-	messages := nMess1
-
-	for {
-		select {
-		case <-linkchan:
-			if messages == 0 {
-				t.Fatalf("Got too many messages")
-			}
-			messages -= 1
-		case <-c.Done():
-			if messages != 0 {
-				t.Fatalf("Timed out waiting for %d more messages", messages)
-			}
-			return
-		}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
 	}
 
-	if clean(true) {
-		t.Fatalf("Found files in log directory at end of test")
+	if len(linkchan) != nMess1 {
+		t.Fatalf("Got %d messages, expected %d", len(linkchan), nMess1)
 	}
+	empty(t, q)
 }
 
 // test failure retry
 func TestLogWrite3(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		blocked  = true
+		nblocked int
+	)
+
+	linkchan := make(chan string, nMess2)
+	dir := t.TempDir()
+	send := channelSender(linkchan)
+	q := testQueue(t, dir, func(c context.Context, t, s string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if blocked {
+			nblocked++
+			return false
+		}
+		return send(c, t, s)
+	})
 
-	debugMode = true
-	blocked = true
-	nblocked = 0
-
-	linkchan = make(chan string)
-	defer close(linkchan)
-
-	c, cxf := context.WithTimeout(context.Background(), 40*time.Second)
-	cT, _ := context.WithTimeout(c, 15*time.Second)
-	defer cxf()
-	Start(c, mySender2)
 	for i := 0; i < nMess2; i++ {
-		err := Log(fmt.Sprintf("Test Message %d", i))
+		err := q.Log(fmt.Sprintf("Test Message %d", i))
 		if err != nil {
 			t.Fatalf("Logging failed on message %d, err = %v", i, err)
 		}
 	}
-	messages := nMess2
+	if q.Flush(context.Background()) == nil {
+		t.Fatalf("Flush worked while blocked")
+	}
+
+	time.Sleep(3500 * time.Millisecond)
+	mu.Lock()
+	blocked = false
+	n := nblocked
+	mu.Unlock()
+	q.Kick()
 
-testLoop:
-	for {
+	if n < 2 {
+		t.Fatalf("Only %d tries during blocked period", n)
+	}
+	if n > 6 {
+		t.Fatalf("Too many (%d) tries during blocked period", n)
+	}
+
+	deadline := time.After(time.Second)
+	for messages := 0; messages < nMess2; messages++ {
 		select {
 		case <-linkchan:
-			if messages == 0 {
-				t.Fatalf("Got too many messages")
-			}
-			if blocked {
-				t.Fatalf("Got message while blocked")
-			}
-			messages -= 1
-		case <-cT.Done():
-			blocked = false
-		case <-c.Done():
-			if messages != 0 {
-				t.Fatalf("Timed out waiting for %d more messages", messages)
-			}
-			break testLoop
+		case <-deadline:
+			t.Fatalf("Timed out waiting for %d more messages", nMess2-messages)
 		}
 	}
-	if nblocked <= 0 {
-		t.Fatalf("No messages sent during blocked period")
-	}
+	q.Close()
+	empty(t, q)
+}
+
+// messages left by one queue are sent by the next in the same directory
+func TestLogRestart(t *testing.T) {
+	dir := t.TempDir()
+	never := func(c context.Context, t, s string) bool { return false }
 
-	if nblocked > 4 {
-		t.Fatalf("Too many (%d) messages received during blocked period", nblocked)
+	q, err := New(Options{Dir: dir, Sender: never, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	for i := 0; i < nMess2; i++ {
+		if err := q.Log(fmt.Sprintf("Test Message %d", i)); err != nil {
+			t.Fatalf("Logging failed on message %d, err = %v", i, err)
+		}
+	}
+	q.Close()
+	if q.Log("late") != ErrClosed {
+		t.Fatalf("Log worked after Close")
 	}
 
-	if clean(true) {
-		t.Fatalf("Found files in log directory at end of test")
+	linkchan := make(chan string, nMess2)
+	q = testQueue(t, dir, channelSender(linkchan))
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for i := 0; i < nMess2; i++ {
+		m := <-linkchan
+		if !strings.HasSuffix(m, fmt.Sprintf(" Test Message %d", i)) {
+			t.Fatalf("Message %d out of order: %s", i, m)
+		}
 	}
 }
 
-func mySender2(c context.Context, t, s string) bool {
-	if blocked {
-		log.Printf("Sender called on %s %s.  Blocked", t, s)
-		nblocked++
-		return false
+// one process, several queues
+func TestLogQueues(t *testing.T) {
+	chan1 := make(chan string, 1)
+	chan2 := make(chan string, 1)
+	q1 := testQueue(t, t.TempDir(), channelSender(chan1))
+	q2 := testQueue(t, t.TempDir(), channelSender(chan2))
+
+	q1.Log("one")
+	q2.Log("two")
+	q1.Flush(context.Background())
+	q2.Flush(context.Background())
+	if m := <-chan1; !strings.HasSuffix(m, " one") {
+		t.Fatalf("Queue 1 sent %s", m)
+	}
+	if m := <-chan2; !strings.HasSuffix(m, " two") {
+		t.Fatalf("Queue 2 sent %s", m)
 	}
-
-	log.Printf("Sender called on %s %s", t, s)
-	linkchan <- t + " " + s
-	return true
 }
@@ -0,0 +1,108 @@
+package logQueue
+
+/*
+ * Looking at a queue, and working on it by hand.  Used by the logqueue
+ * command, on a queue opened by Inspect.
+ */
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The time a record was logged
+func (r Record) Time() time.Time {
+	return epoch.Add(time.Duration(r.When) * time.Second)
+}
+
+// What is queued, in the order it will be sent
+func (q *Queue) Pending() ([]Record, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pending []Record
+	for _, r := range q.sendOrder(0) {
+		if r.summary {
+			pending = append(pending, q.summaryRecord(q.summaryCount))
+			continue
+		}
+		record, _, err := q.read(r)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, record)
+	}
+	return pending, nil
+}
+
+/*
+ * Deletes queued records logged more than age ago, not counting them
+ * in a summary.  Returns how many were deleted.
+ */
+func (q *Queue) DeleteOlder(age time.Duration) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for len(q.index) > 0 {
+		when := epoch.Add(time.Duration(q.index[0].when) * time.Second)
+		if now.Sub(when) <= age {
+			break
+		}
+		r := q.pop()
+		q.stats.Dropped++
+		q.stats.DroppedBytes += r.length
+		n++
+	}
+	return n, q.saveCursor()
+}
+
+/*
+ * Puts the dead letters back on the queue, with the times they were
+ * first logged, and removes them from the dead letters.  Returns how
+ * many were put back.
+ */
+func (q *Queue) Requeue() (int, error) {
+	dead, err := q.DeadLetters()
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+	for n, d := range dead {
+		if err := q.append(d.When, d.Seqn, d.Priority, d.Attributes, d.Body); err != nil {
+			return n, err
+		}
+		if err := os.Remove(filepath.Join(q.deadDir(), d.Name+".json")); err != nil {
+			return n + 1, err
+		}
+	}
+	if len(dead) > 0 && q.healthy {
+		q.kick()
+	}
+	return len(dead), q.saveCursor()
+}
+
+/*
+ * Sends everything queued with this sender, as Flush does with the
+ * queue's own.  For a queue opened by Inspect.
+ */
+func (q *Queue) Drain(c context.Context, sender BatchSender) error {
+	if sender == nil {
+		return errors.New("logQueue needs a sender to drain to")
+	}
+
+	q.sendMu.Lock()
+	q.batchSender = sender
+	q.sendMu.Unlock()
+	return q.Flush(c)
+}
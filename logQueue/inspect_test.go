@@ -0,0 +1,100 @@
+package logQueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bodies(records []Record) string {
+	var b []string
+	for _, r := range records {
+		b = append(b, r.Body)
+	}
+	return strings.Join(b, ",")
+}
+
+// a queue in use by one cannot be opened by another
+func TestInspectLock(t *testing.T) {
+	q, _ := retentionQueue(t, t.TempDir(), Options{})
+	if _, err := Inspect(q.dir); err == nil {
+		t.Fatalf("Inspect of a queue in use worked")
+	}
+	q.Close()
+	i, err := Inspect(q.dir)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	i.Close()
+	if _, err := Inspect(filepath.Join(q.dir, "none")); err == nil {
+		t.Fatalf("Inspect of no queue worked")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+
+	// left over from an earlier run
+	now := int64(time.Since(epoch) / time.Second)
+	for i, age := range []int64{3 * 3600, 60} {
+		name := filepath.Join(dir, fmt.Sprintf("%d_%02d", now-age, i))
+		if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("old%d", i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q, err := Inspect(dir)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	defer q.Close()
+	q.LogRecord(map[string]string{"k": "v"}, "new")
+
+	pending, err := q.Pending()
+	if err != nil || bodies(pending) != "old0,old1,new" {
+		t.Fatalf("Pending %s, err %v", bodies(pending), err)
+	}
+	if age := time.Since(pending[0].Time()); age < 3*time.Hour || age > 3*time.Hour+time.Minute {
+		t.Fatalf("Oldest is %v old", age)
+	}
+
+	n, err := q.DeleteOlder(time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("Deleted %d, err %v", n, err)
+	}
+	if stats := q.Stats(); stats.Messages != 2 || stats.Summarized != 0 {
+		t.Fatalf("Stats %+v", stats)
+	}
+
+	var sent []Record
+	err = q.Drain(context.Background(), func(c context.Context, records []Record) []error {
+		results := make([]error, len(records))
+		for i, r := range records {
+			if r.Body == "new" {
+				results[i] = Permanent(errors.New("no"))
+				continue
+			}
+			sent = append(sent, r)
+		}
+		return results
+	})
+	if err != nil || bodies(sent) != "old1" {
+		t.Fatalf("Drained %s, err %v", bodies(sent), err)
+	}
+
+	n, err = q.Requeue()
+	if err != nil || n != 1 {
+		t.Fatalf("Requeued %d, err %v", n, err)
+	}
+	pending, err = q.Pending()
+	if err != nil || bodies(pending) != "new" || pending[0].Attributes["k"] != "v" {
+		t.Fatalf("Pending %+v, err %v", pending, err)
+	}
+	if dead, _ := q.DeadLetters(); len(dead) != 0 {
+		t.Fatalf("%d dead letters left", len(dead))
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * This program looks at and works on a logQueue directory, such as the
+ * one ispmonitor keeps its messages in while the Internet is down.
+ *
+ *	logqueue [-d dir] list			pending records, in the order they will be sent, high priority marked !
+ *	logqueue [-d dir] stats			depth, oldest age, bytes
+ *	logqueue [-d dir] export [-dead]	pending records, or dead letters, as JSON lines
+ *	logqueue [-d dir] delete <age>		delete pending records older than age, e.g. 72h
+ *	logqueue [-d dir] requeue		put the dead letters back on the queue
+ *	logqueue [-d dir] drain [-url url]	send everything to stdout as JSON lines, or POST it to url
+ *
+ * The queue must not be in use by another process.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/duke1swd/iotgo/logQueue"
+)
+
+var (
+	flagd    string
+	flagDead bool
+	flagURL  string
+)
+
+func init() {
+	flag.StringVar(&flagd, "d", "", "queue directory, default $LOGQUEUEDIR, then "+logQueue.DefaultDir)
+	flag.BoolVar(&flagDead, "dead", false, "with export, export the dead letters")
+	flag.StringVar(&flagURL, "url", "", "with drain, POST each batch to this url as a JSON array")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: logqueue [-d dir] list | stats | export [-dead] | delete <age> | requeue | drain [-url url]\n")
+		flag.PrintDefaults()
+	}
+}
+
+// A record as exported
+type exported struct {
+	Name       string            `json:"name"`
+	Time       time.Time         `json:"time"`
+	Seqn       int               `json:"seqn"`
+	High       bool              `json:"high,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Body       string            `json:"body"`
+	Reason     string            `json:"reason,omitempty"`
+	Failed     *time.Time        `json:"failed,omitempty"`
+}
+
+func export(r logQueue.Record) exported {
+	return exported{Name: r.Name, Time: r.Time(), Seqn: r.Seqn, High: r.Priority == logQueue.High,
+		Attributes: r.Attributes, Body: r.Body}
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// flags may follow the command
+	command := args[0]
+	flag.CommandLine.Parse(args[1:])
+	args = flag.Args()
+
+	dir := flagd
+	if dir == "" {
+		dir = os.Getenv("LOGQUEUEDIR")
+	}
+	if dir == "" {
+		dir = logQueue.DefaultDir
+	}
+
+	q, err := logQueue.Inspect(dir)
+	if err != nil {
+		log.Fatalf("Cannot open log queue: %v", err)
+	}
+	defer q.Close()
+
+	switch command {
+	case "list":
+		err = list(q, os.Stdout)
+	case "stats":
+		err = stats(q, os.Stdout)
+	case "export":
+		err = exportAll(q, os.Stdout, flagDead)
+	case "delete":
+		if len(args) != 1 {
+			log.Fatalf("delete needs an age, such as 72h")
+		}
+		var age time.Duration
+		age, err = time.ParseDuration(args[0])
+		if err != nil {
+			log.Fatalf("Bad age %s: %v", args[0], err)
+		}
+		var n int
+		n, err = q.DeleteOlder(age)
+		fmt.Printf("%d deleted\n", n)
+	case "requeue":
+		var n int
+		n, err = q.Requeue()
+		fmt.Printf("%d requeued\n", n)
+	case "drain":
+		sender := jsonSender(os.Stdout)
+		if flagURL != "" {
+			sender = httpSender(flagURL)
+		}
+		err = q.Drain(context.Background(), sender)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		q.Close()
+		log.Fatalf("%s failed: %v", command, err)
+	}
+}
+
+func list(q *logQueue.Queue, w io.Writer) error {
+	pending, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	for _, r := range pending {
+		var attributes []string
+		for k, v := range r.Attributes {
+			attributes = append(attributes, k+"="+v)
+		}
+		sort.Strings(attributes)
+		prio := " "
+		if r.Priority == logQueue.High {
+			prio = "!"
+		}
+		fmt.Fprintf(w, "%s %s %s  %s  %s\n", prio, r.Name, r.Time().Local().Format("2006-01-02 15:04:05"),
+			strings.Join(attributes, " "), r.Body)
+	}
+	return nil
+}
+
+func stats(q *logQueue.Queue, w io.Writer) error {
+	pending, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	dead, err := q.DeadLetters()
+	if err != nil {
+		return err
+	}
+	s := q.Stats()
+
+	fmt.Fprintf(w, "pending:      %d\n", s.Messages)
+	fmt.Fprintf(w, "bytes:        %d\n", s.Bytes)
+	if len(pending) > 0 {
+		oldest := pending[0].Time()
+		for _, r := range pending {
+			if r.Time().Before(oldest) {
+				oldest = r.Time()
+			}
+		}
+		fmt.Fprintf(w, "oldest:       %s (%s ago)\n", oldest.Local().Format("2006-01-02 15:04:05"),
+			time.Since(oldest).Round(time.Second))
+	}
+	fmt.Fprintf(w, "dead letters: %d\n", len(dead))
+	fmt.Fprintf(w, "quarantined:  %d (%d bytes)\n", s.Quarantined, s.QuarantinedBytes)
+	return nil
+}
+
+func exportAll(q *logQueue.Queue, w io.Writer, dead bool) error {
+	enc := json.NewEncoder(w)
+	if !dead {
+		pending, err := q.Pending()
+		if err != nil {
+			return err
+		}
+		for _, r := range pending {
+			if err := enc.Encode(export(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	letters, err := q.DeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, d := range letters {
+		e := export(d.Record)
+		e.Reason = d.Reason
+		e.Failed = &d.Failed
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes each record as a JSON line
+func jsonSender(w io.Writer) logQueue.BatchSender {
+	enc := json.NewEncoder(w)
+	return func(c context.Context, records []logQueue.Record) []error {
+		results := make([]error, len(records))
+		for i, r := range records {
+			results[i] = enc.Encode(export(r))
+		}
+		return results
+	}
+}
+
+/*
+ * POSTs each batch as a JSON array.  A 4xx answer means the batch will
+ * never be taken, so it goes to the dead letters.
+ */
+func httpSender(url string) logQueue.BatchSender {
+	return func(c context.Context, records []logQueue.Record) []error {
+		results := make([]error, len(records))
+		fail := func(err error) []error {
+			for i := range results {
+				results[i] = err
+			}
+			return results
+		}
+
+		batch := make([]exported, len(records))
+		for i, r := range records {
+			batch[i] = export(r)
+		}
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return fail(logQueue.Permanent(err))
+		}
+		req, err := http.NewRequestWithContext(c, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fail(logQueue.Permanent(err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fail(err)
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return results
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return fail(logQueue.Permanent(fmt.Errorf("%s answered %s", url, resp.Status)))
+		default:
+			return fail(fmt.Errorf("%s answered %s", url, resp.Status))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package logQueue
+
+/*
+ * Bounded retention.
+ *
+ * A queue may be capped on the number of messages, their total size,
+ * and their age.  When a new message would go over a cap, the policy
+ * says what gives:
+ *	DropOldest:	the oldest messages are dropped to make room
+ *	DropNewest:	the new message is dropped
+ *	Summarize:	as DropOldest, but the dropped messages are counted
+ *			in a summary record that takes the place of the
+ *			oldest of them, so the far end hears about them
+ * Normal priority messages are dropped before high priority ones, and
+ * a high priority message is never dropped to make room for a normal
+ * one.  Under DropNewest, a new high priority message may still drop
+ * the oldest normal one.
+ * Messages over the age cap are dropped, or under Summarize counted in
+ * the summary, by the background thread.
+ *
+ * Everything dropped is counted in the queue's Stats.
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+type Policy int
+
+const (
+	DropOldest Policy = iota
+	DropNewest
+	Summarize
+)
+
+// What is queued now, and what has been dropped since the queue was made
+type Stats struct {
+	Messages     int   // queued now, including any summary
+	Bytes        int64 // size of those
+	Dropped      int64 // messages dropped, for any reason
+	DroppedBytes int64 // size of those
+	Expired      int64 // of those dropped, how many for age
+	Summarized   int64 // of those dropped, how many were counted in a summary
+
+	Quarantined      int64 // corrupt records set aside, as in wal.go
+	QuarantinedBytes int64 // size of those
+	DeadLetters      int64 // records never to be sent, as in deadletter.go
+}
+
+func defaultSummary(dropped int) (map[string]string, string) {
+	return nil, fmt.Sprintf("%d messages dropped", dropped)
+}
+
+// The summary record, counting this many.  Call with q.mu held.
+func (q *Queue) summaryRecord(count int) Record {
+	attributes, body := q.summary(count)
+	return Record{Name: recordName(q.summaryWhen, q.summarySeqn), When: q.summaryWhen,
+		Seqn: q.summarySeqn, Attributes: attributes, Body: body}
+}
+
+func (r Record) size() int64 {
+	return messageSize(r.Attributes, r.Body)
+}
+
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+func (q *Queue) over(size int64) bool {
+	return (q.maxMessages > 0 && q.stats.Messages+1 > q.maxMessages) ||
+		(q.maxBytes > 0 && q.stats.Bytes+size > q.maxBytes)
+}
+
+/*
+ * Sets the number of messages the summary record counts, keeping the
+ * books.  Call with q.mu held.
+ */
+func (q *Queue) setSummary(count int) {
+	if q.summaryCount > 0 {
+		q.stats.Messages--
+		q.stats.Bytes -= q.summaryRecord(q.summaryCount).size()
+	}
+	q.summaryCount = count
+	if q.summaryCount > 0 {
+		q.stats.Messages++
+		q.stats.Bytes += q.summaryRecord(q.summaryCount).size()
+	}
+}
+
+// Takes the oldest record off the queue.  Call with q.mu held.
+func (q *Queue) pop() recordRef {
+	r := q.index[0]
+	q.index = q.index[1:]
+	q.stats.Messages--
+	q.stats.Bytes -= r.length
+	q.trim()
+	return r
+}
+
+/*
+ * Takes a record off the queue, wherever it is in line.  Call with q.mu
+ * held.
+ */
+func (q *Queue) markDone(i int) {
+	if q.index[i].done {
+		return
+	}
+	q.index[i].done = true
+	q.stats.Messages--
+	q.stats.Bytes -= q.index[i].length
+	q.trim()
+}
+
+// Moves the cursor past records already done.  Call with q.mu held.
+func (q *Queue) trim() {
+	for len(q.index) > 0 && q.index[0].done {
+		q.index = q.index[1:]
+	}
+}
+
+/*
+ * Drops a record under the policy.  The caller saves the cursor.  Call
+ * with q.mu held.
+ */
+func (q *Queue) drop(i int, expired bool) {
+	r := q.index[i]
+	q.markDone(i)
+	q.stats.Dropped++
+	q.stats.DroppedBytes += r.length
+	if expired {
+		q.stats.Expired++
+	}
+	if q.policy == Summarize {
+		q.stats.Summarized++
+		if q.summaryCount == 0 || r.when < q.summaryWhen {
+			// the summary takes the oldest dropped message's place in line
+			q.summaryWhen = r.when
+			q.summarySeqn = r.seqn
+		}
+		q.setSummary(q.summaryCount + 1)
+	}
+}
+
+/*
+ * The next record to drop to make room for one of this priority, or -1.
+ * Call with q.mu held.
+ */
+func (q *Queue) victim(prio Priority) int {
+	for p := Normal; p <= prio; p++ {
+		if q.policy == DropNewest && p == prio {
+			break
+		}
+		for i, r := range q.index {
+			if !r.done && r.prio == p {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+/*
+ * Makes room for a new message of this size and priority.  Returns
+ * false if the new message is to be dropped instead.  Call with q.mu
+ * held.
+ */
+func (q *Queue) makeRoom(size int64, prio Priority) (bool, error) {
+	if !q.over(size) {
+		return true, nil
+	}
+
+	// the summary may take the room just made
+	for q.over(size) {
+		i := q.victim(prio)
+		if i < 0 {
+			break
+		}
+		q.drop(i, false)
+	}
+	return !q.over(size), q.saveCursor()
+}
+
+// Drops messages over the age cap
+func (q *Queue) expire(now time.Time) error {
+	if q.maxAge <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.index) > 0 {
+		when := epoch.Add(time.Duration(q.index[0].when) * time.Second)
+		if now.Sub(when) <= q.maxAge {
+			// oldest first, so the rest are younger
+			break
+		}
+		q.drop(0, true)
+	}
+	return q.saveCursor()
+}
@@ -0,0 +1,287 @@
+package logQueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A sender that fails until opened, then records what it sends
+type gate struct {
+	mu   sync.Mutex
+	open bool
+	sent []string
+}
+
+func (g *gate) send(c context.Context, t, s string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.open {
+		return false
+	}
+	g.sent = append(g.sent, s)
+	return true
+}
+
+func (g *gate) flush(t *testing.T, q *Queue) string {
+	t.Helper()
+	g.mu.Lock()
+	g.open = true
+	g.mu.Unlock()
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return strings.Join(g.sent, ",")
+}
+
+func retentionQueue(t *testing.T, dir string, opts Options) (*Queue, *gate) {
+	g := new(gate)
+	opts.Dir = dir
+	opts.Sender = g.send
+	opts.RetryInterval = time.Hour
+	q, err := New(opts)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q, g
+}
+
+func logN(t *testing.T, q *Queue, n int) {
+	for i := 0; i < n; i++ {
+		if err := q.Log(fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatalf("Logging failed on message %d, err = %v", i, err)
+		}
+	}
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	var tests = []struct {
+		policy Policy
+		sent   string
+	}{
+		{DropOldest, "m3,m4,m5,m6,m7"},
+		{DropNewest, "m0,m1,m2,m3,m4"},
+		{Summarize, "4 messages dropped,m4,m5,m6,m7"},
+	}
+
+	for _, test := range tests {
+		q, g := retentionQueue(t, t.TempDir(), Options{MaxMessages: 5, Policy: test.policy})
+		logN(t, q, 8)
+
+		stats := q.Stats()
+		if stats.Messages != 5 {
+			t.Fatalf("Policy %d: %d messages queued", test.policy, stats.Messages)
+		}
+		dropped := int64(3)
+		if test.policy == Summarize {
+			dropped = 4
+			if stats.Summarized != 4 {
+				t.Fatalf("Policy %d: %d summarized", test.policy, stats.Summarized)
+			}
+		}
+		if stats.Dropped != dropped || stats.DroppedBytes != 2*dropped {
+			t.Fatalf("Policy %d: stats %+v", test.policy, stats)
+		}
+
+		if sent := g.flush(t, q); sent != test.sent {
+			t.Fatalf("Policy %d: sent %s, expected %s", test.policy, sent, test.sent)
+		}
+		if stats := q.Stats(); stats.Messages != 0 || stats.Bytes != 0 {
+			t.Fatalf("Policy %d: after flush, stats %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestRetentionBytes(t *testing.T) {
+	q, g := retentionQueue(t, t.TempDir(), Options{MaxBytes: 7})
+	logN(t, q, 5)
+	if err := q.Log("too big to fit"); err != nil {
+		t.Fatalf("Logging failed: %v", err)
+	}
+
+	if stats := q.Stats(); stats.Bytes != 0 || stats.Dropped != 6 {
+		t.Fatalf("Stats %+v", stats)
+	}
+	q.Log("m5")
+	if sent := g.flush(t, q); sent != "m5" {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+func TestRetentionAge(t *testing.T) {
+	dir := t.TempDir()
+
+	// left over from an earlier run
+	now := int64(time.Since(epoch) / time.Second)
+	for i, age := range []int64{3 * 3600, 2 * 3600, 60} {
+		name := filepath.Join(dir, fmt.Sprintf("%d_%02d", now-age, i))
+		if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("old%d", i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, g := retentionQueue(t, dir, Options{MaxAge: time.Hour, Policy: Summarize,
+		Summary: func(dropped int) (map[string]string, string) { return nil, fmt.Sprintf("lost %d", dropped) }})
+	if stats := q.Stats(); stats.Messages != 3 {
+		t.Fatalf("Found %d messages", stats.Messages)
+	}
+	if err := q.expire(time.Now()); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if stats := q.Stats(); stats.Expired != 2 || stats.Summarized != 2 || stats.Messages != 2 {
+		t.Fatalf("Stats %+v", stats)
+	}
+
+	if sent := g.flush(t, q); sent != "lost 2,old2" {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+// More are dropped while the summary is being sent
+func TestRetentionSummaryRace(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		open bool
+		once sync.Once
+		sent []string
+	)
+	sending := make(chan bool)
+	sender := func(c context.Context, t, s string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if !open {
+			return false
+		}
+		once.Do(func() {
+			sending <- true
+			<-sending
+		})
+		sent = append(sent, s)
+		return true
+	}
+
+	q, err := New(Options{Dir: t.TempDir(), Sender: sender, RetryInterval: time.Hour,
+		MaxMessages: 2, Policy: Summarize})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer q.Close()
+
+	logN(t, q, 3) // summary of 2, and m2
+	mu.Lock()
+	open = true
+	mu.Unlock()
+	done := make(chan error)
+	go func() { done <- q.Flush(context.Background()) }()
+
+	// the background thread or Flush is sending the summary
+	<-sending
+	q.Log("m3")
+	q.Log("m4")
+	sending <- true
+	if err := <-done; err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if got := strings.Join(sent, ","); !strings.HasPrefix(got, "2 messages dropped,") ||
+		!strings.Contains(got, "messages dropped,m4") {
+		t.Fatalf("Sent %s", got)
+	}
+	if stats := q.Stats(); stats.Messages != 0 || stats.Summarized != stats.Dropped {
+		t.Fatalf("Stats %+v", stats)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	var tests = []struct {
+		policy Policy
+		log    string // n for normal, h for high
+		sent   string
+	}{
+		// high first, each in the order logged
+		{DropOldest, "nhn", "h1,n0,n2"},
+		// normal dropped first
+		{DropOldest, "hnnhn", "h0,h3,n4"},
+		// high not dropped for normal
+		{DropOldest, "hhhn", "h0,h1,h2"},
+		// high dropped for high
+		{DropOldest, "hhhh", "h1,h2,h3"},
+		// new normal dropped, but high drops the oldest normal
+		{DropNewest, "nnnnh", "h4,n1,n2"},
+		// the summary takes room too, and goes where the normal ones it
+		// counts were
+		{Summarize, "nhnnh", "h1,h4,3 messages dropped"},
+		{Summarize, "nnnhn", "h3,3 messages dropped,n4"},
+	}
+
+	for _, test := range tests {
+		q, g := retentionQueue(t, t.TempDir(), Options{MaxMessages: 3, Policy: test.policy})
+		for i, c := range test.log {
+			prio := Normal
+			if c == 'h' {
+				prio = High
+			}
+			if err := q.LogPriority(prio, nil, fmt.Sprintf("%c%d", c, i)); err != nil {
+				t.Fatalf("Logging failed on message %d, err = %v", i, err)
+			}
+		}
+		if sent := g.flush(t, q); sent != test.sent {
+			t.Fatalf("Policy %d, logged %s: sent %s, expected %s", test.policy, test.log, sent, test.sent)
+		}
+	}
+}
+
+// the summary is in the normal lane, behind high priority records
+func TestSummaryOrder(t *testing.T) {
+	q, g := retentionQueue(t, t.TempDir(), Options{MaxMessages: 4, Policy: Summarize})
+	q.Log("n0")
+	q.Log("n1")
+	q.Log("n2")
+	q.LogPriority(High, nil, "h3")
+	q.Log("n4") // drops n0, n1
+
+	pending, err := q.Pending()
+	if err != nil {
+		t.Fatalf("Pending failed: %v", err)
+	}
+	var bodies []string
+	for _, r := range pending {
+		bodies = append(bodies, r.Body)
+	}
+	want := "h3,2 messages dropped,n2,n4"
+	if got := strings.Join(bodies, ","); got != want {
+		t.Fatalf("Pending %s, expected %s", got, want)
+	}
+	if sent := g.flush(t, q); sent != want {
+		t.Fatalf("Sent %s, expected %s", sent, want)
+	}
+}
+
+// priorities, and what was dropped, are kept across a restart
+func TestPriorityRestart(t *testing.T) {
+	q, _ := retentionQueue(t, t.TempDir(), Options{MaxMessages: 3})
+	q.Log("n0")
+	q.LogPriority(High, nil, "h1")
+	q.Log("n2")
+	q.Log("n3")
+	q.Log("n4") // drops n0, n2
+
+	q, g := reopen(t, q, Options{MaxMessages: 3})
+	if stats := q.Stats(); stats.Messages != 3 {
+		t.Fatalf("Stats %+v", stats)
+	}
+	if sent := g.flush(t, q); sent != "h1,n3,n4" {
+		t.Fatalf("Sent %s", sent)
+	}
+	if q.LogPriority(Priority(7), nil, "x") == nil {
+		t.Fatalf("Unknown priority accepted")
+	}
+}
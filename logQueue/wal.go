@@ -0,0 +1,571 @@
+package logQueue
+
+/*
+ * The queue's storage, a write-ahead log.
+ *
+ * Messages are appended to segment files, seg-<number>.log, each record
+ *	magic	2 bytes, "LP"
+ *	length	4 bytes, of what follows the header
+ *	crc	4 bytes, CRC-32C of what follows the header
+ *	when	8 bytes, seconds since the epoch the message was logged
+ *	seqn	4 bytes, sequence number within that second
+ *	prio	1 byte, the priority
+ *	nattr	2 bytes, the number of attributes
+ *	then for each attribute, in order of key
+ *	  klen	2 bytes
+ *	  key
+ *	  vlen	4 bytes
+ *	  value
+ *	body	the message
+ * all big-endian.  Each append is fsynced.  Records written before there
+ * were priorities have magic "LR", and no prio.  Those written before
+ * there were attributes have magic "LQ", and no prio, nattr or
+ * attributes.
+ *
+ * The file "cursor" says where the next message to send starts, and
+ * how many dropped messages the summary record owes.  It then lists any
+ * records after that already sent, as a batch may be sent in part.  It
+ * is replaced, never rewritten, so a crash leaves the old one or the
+ * new one.
+ *
+ * Segments wholly behind the cursor are deleted.  Bytes that do not
+ * make a good record are copied to quarantine/ and skipped, never just
+ * deleted.  The magic lets a scan find the next good record after them.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	plainMagic        = 0x4C51 // "LQ"
+	attributeMagic    = 0x4C52 // "LR"
+	recordMagic       = 0x4C50 // "LP"
+	headerSize        = 10
+	fixedSize         = 12 // when and seqn
+	maxRecordSize     = 16 << 20
+	segmentPrefix     = "seg-"
+	segmentSuffix     = ".log"
+	cursorFileName    = "cursor"
+	quarantineDirName = "quarantine"
+
+	defaultSegmentBytes = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupt = errors.New("corrupt record")
+
+// Where a record is, and what it is
+type recordRef struct {
+	segment int64
+	offset  int64
+	size    int64 // header and all
+	when    int64
+	seqn    int
+	length  int64 // of the message, as Stats counts it
+	prio    Priority
+	done    bool // sent, or set aside, ahead of the cursor
+	summary bool // stands for the summary record, which is not in the log
+}
+
+// Where a record starts
+type recordPos struct {
+	segment int64
+	offset  int64
+}
+
+// The name the sender sees, as when each message was a file
+func recordName(when int64, seqn int) string {
+	return fmt.Sprintf("%d_%02d", when, seqn)
+}
+
+// The size of a message, body and attributes, as Stats counts it
+func messageSize(attributes map[string]string, body string) int64 {
+	size := int64(len(body))
+	for k, v := range attributes {
+		size += int64(len(k) + len(v))
+	}
+	return size
+}
+
+func encodeRecord(when int64, seqn int, prio Priority, attributes map[string]string, body string) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	payload := make([]byte, fixedSize+3, fixedSize+3+int(messageSize(attributes, body))+6*len(keys))
+	binary.BigEndian.PutUint64(payload[0:8], uint64(when))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(seqn))
+	payload[12] = byte(prio)
+	binary.BigEndian.PutUint16(payload[13:15], uint16(len(keys)))
+	for _, k := range keys {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(k)))
+		payload = append(payload, k...)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(attributes[k])))
+		payload = append(payload, attributes[k]...)
+	}
+	payload = append(payload, body...)
+
+	record := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint16(record[0:2], recordMagic)
+	binary.BigEndian.PutUint32(record[2:6], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[6:10], crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+/*
+ * Decodes the record at the start of b.  Returns the record's size, or
+ * errCorrupt, or io.ErrUnexpectedEOF if b ends before the record does.
+ */
+func decodeRecord(b []byte) (size int64, r Record, err error) {
+	if len(b) < headerSize {
+		return 0, r, io.ErrUnexpectedEOF
+	}
+	magic := binary.BigEndian.Uint16(b[0:2])
+	if magic != recordMagic && magic != attributeMagic && magic != plainMagic {
+		return 0, r, errCorrupt
+	}
+	length := int64(binary.BigEndian.Uint32(b[2:6]))
+	if length < fixedSize || length > maxRecordSize {
+		return 0, r, errCorrupt
+	}
+	if int64(len(b)) < headerSize+length {
+		return 0, r, io.ErrUnexpectedEOF
+	}
+	payload := b[headerSize : headerSize+length]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(b[6:10]) {
+		return 0, r, errCorrupt
+	}
+	r.When = int64(binary.BigEndian.Uint64(payload[0:8]))
+	r.Seqn = int(binary.BigEndian.Uint32(payload[8:12]))
+	r.Name = recordName(r.When, r.Seqn)
+	rest := payload[fixedSize:]
+
+	if magic == recordMagic {
+		if len(rest) < 1 {
+			return 0, r, errCorrupt
+		}
+		r.Priority = Priority(rest[0])
+		rest = rest[1:]
+	}
+	if magic == recordMagic || magic == attributeMagic {
+		if len(rest) < 2 {
+			return 0, r, errCorrupt
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if n > 0 {
+			r.Attributes = make(map[string]string, n)
+		}
+		for i := 0; i < n; i++ {
+			if len(rest) < 2 {
+				return 0, r, errCorrupt
+			}
+			klen := int(binary.BigEndian.Uint16(rest))
+			if len(rest) < 2+klen+4 {
+				return 0, r, errCorrupt
+			}
+			key := string(rest[2 : 2+klen])
+			rest = rest[2+klen:]
+			vlen := int64(binary.BigEndian.Uint32(rest))
+			if int64(len(rest)) < 4+vlen {
+				return 0, r, errCorrupt
+			}
+			r.Attributes[key] = string(rest[4 : 4+vlen])
+			rest = rest[4+vlen:]
+		}
+	}
+	r.Body = string(rest)
+	return headerSize + length, r, nil
+}
+
+func (q *Queue) segmentPath(segment int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s%016d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+// The segments in the directory, in order
+func (q *Queue) segments() ([]int64, error) {
+	var segments []int64
+
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// fsync a directory, so files made or renamed in it stay made
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The durable read cursor
+type cursorType struct {
+	segment      int64
+	offset       int64
+	summaryCount int
+	summaryWhen  int64
+	summarySeqn  int
+}
+
+// Returns the cursor, and the records after it already sent
+func (q *Queue) readCursor() (cursorType, map[recordPos]bool, bool, error) {
+	var c cursorType
+	done := make(map[recordPos]bool)
+
+	content, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFileName))
+	if os.IsNotExist(err) {
+		return c, done, false, nil
+	}
+	if err != nil {
+		return c, done, false, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	_, err = fmt.Sscanf(lines[0], "%d %d %d %d %d",
+		&c.segment, &c.offset, &c.summaryCount, &c.summaryWhen, &c.summarySeqn)
+	if err != nil {
+		return c, done, false, fmt.Errorf("Cannot parse cursor %q: %v", lines[0], err)
+	}
+	for _, line := range lines[1:] {
+		var p recordPos
+		if _, err := fmt.Sscanf(line, "%d %d", &p.segment, &p.offset); err != nil {
+			return c, done, false, fmt.Errorf("Cannot parse cursor %q: %v", line, err)
+		}
+		done[p] = true
+	}
+	return c, done, true, nil
+}
+
+/*
+ * Saves where the next message starts, and deletes segments behind it.
+ * Call with q.mu held.
+ */
+func (q *Queue) saveCursor() error {
+	c := cursorType{segment: q.writeSegment, offset: q.writeOffset}
+	if len(q.index) > 0 {
+		c.segment = q.index[0].segment
+		c.offset = q.index[0].offset
+	}
+	c.summaryCount = q.summaryCount
+	c.summaryWhen = q.summaryWhen
+	c.summarySeqn = q.summarySeqn
+
+	text := fmt.Sprintf("%d %d %d %d %d\n", c.segment, c.offset, c.summaryCount, c.summaryWhen, c.summarySeqn)
+	for _, r := range q.index {
+		if r.done {
+			text += fmt.Sprintf("%d %d\n", r.segment, r.offset)
+		}
+	}
+	if text == q.cursorText {
+		return nil
+	}
+
+	tempFileName := filepath.Join(q.dir, "_"+cursorFileName)
+	f, err := os.OpenFile(tempFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot create cursor %s: %v", tempFileName, err)
+	}
+	_, err = f.WriteString(text)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Cannot write cursor %s: %v", tempFileName, err)
+	}
+	if err := os.Rename(tempFileName, filepath.Join(q.dir, cursorFileName)); err != nil {
+		return fmt.Errorf("Cannot rename cursor %s: %v", tempFileName, err)
+	}
+	if err := syncDir(q.dir); err != nil {
+		return err
+	}
+
+	q.cursor = c
+	q.cursorText = text
+	return q.compact()
+}
+
+// Deletes segments wholly behind the cursor.  Call with q.mu held.
+func (q *Queue) compact() error {
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= q.cursor.segment || s == q.writeSegment {
+			break
+		}
+		if err := os.Remove(q.segmentPath(s)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps bytes that are not a good record.  Call with q.mu held.
+func (q *Queue) quarantine(segment, offset int64, b []byte) error {
+	dir := filepath.Join(q.dir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%016d-%d", segment, offset))
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		return fmt.Errorf("Cannot quarantine to %s: %v", name, err)
+	}
+	q.stats.Quarantined++
+	q.stats.QuarantinedBytes += int64(len(b))
+	return nil
+}
+
+/*
+ * Reads the good records of a segment from offset on into the index.
+ * Bad bytes are quarantined.  If the segment ends in a partial record,
+ * as after a crash while appending, that is quarantined and cut off.
+ */
+func (q *Queue) scan(segment, offset int64, done map[recordPos]bool) error {
+	path := q.segmentPath(segment)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+
+	for offset < int64(len(content)) {
+		size, record, err := decodeRecord(content[offset:])
+		if err == nil {
+			r := recordRef{segment: segment, offset: offset, size: size, when: record.When,
+				seqn: record.Seqn, length: messageSize(record.Attributes, record.Body), prio: record.Priority}
+			r.done = done[recordPos{segment, offset}]
+			q.index = append(q.index, r)
+			if !r.done {
+				q.stats.Messages++
+				q.stats.Bytes += r.length
+			}
+			offset += size
+			continue
+		}
+
+		// find the next good record
+		next := offset + 1
+		for ; next < int64(len(content)); next++ {
+			if _, _, err := decodeRecord(content[next:]); err == nil {
+				break
+			}
+		}
+		if err := q.quarantine(segment, offset, content[offset:next]); err != nil {
+			return err
+		}
+		if next == int64(len(content)) {
+			// nothing good after it, so cut it off
+			if err := os.Truncate(path, offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset = next
+	}
+	return nil
+}
+
+/*
+ * Reads the log at startup: the cursor, then every record after it.
+ * Opens the last segment for appending.
+ */
+func (q *Queue) open() error {
+	cursor, done, ok, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+	segments, err := q.segments()
+	if err != nil {
+		return err
+	}
+	if !ok && len(segments) > 0 {
+		cursor.segment = segments[0]
+	}
+	q.cursor = cursor
+	q.summaryCount = cursor.summaryCount
+	q.summaryWhen = cursor.summaryWhen
+	q.summarySeqn = cursor.summarySeqn
+	if q.summaryCount > 0 {
+		q.stats.Messages++
+		q.stats.Bytes += q.summaryRecord(q.summaryCount).size()
+	}
+
+	q.writeSegment = 1
+	for _, s := range segments {
+		if s < cursor.segment {
+			continue
+		}
+		offset := int64(0)
+		if s == cursor.segment {
+			offset = cursor.offset
+		}
+		if err := q.scan(s, offset, done); err != nil {
+			return err
+		}
+		q.writeSegment = s
+	}
+	q.trim()
+	if q.writeSegment < cursor.segment {
+		q.writeSegment = cursor.segment
+	}
+
+	if err := q.openSegment(); err != nil {
+		return err
+	}
+	if err := q.compact(); err != nil {
+		return err
+	}
+	return q.importFiles()
+}
+
+// Opens q.writeSegment for appending
+func (q *Queue) openSegment() error {
+	path := q.segmentPath(q.writeSegment)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Cannot open segment %s: %v", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		f.Close()
+		return err
+	}
+	q.writeFile = f
+	q.writeOffset = info.Size()
+	return nil
+}
+
+// Appends a record, and fsyncs it.  Call with q.mu held.
+func (q *Queue) append(when int64, seqn int, prio Priority, attributes map[string]string, body string) error {
+	if q.writeOffset >= q.segmentBytes {
+		q.writeFile.Close()
+		q.writeSegment++
+		if err := q.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	record := encodeRecord(when, seqn, prio, attributes, body)
+	n, err := q.writeFile.Write(record)
+	if err == nil {
+		err = q.writeFile.Sync()
+	}
+	if err != nil {
+		// leave no partial record for the next append to follow
+		q.writeFile.Truncate(q.writeOffset)
+		return fmt.Errorf("Cannot append to segment %s: %v", q.segmentPath(q.writeSegment), err)
+	}
+
+	length := messageSize(attributes, body)
+	q.index = append(q.index, recordRef{segment: q.writeSegment, offset: q.writeOffset,
+		size: int64(n), when: when, seqn: seqn, length: length, prio: prio})
+	q.writeOffset += int64(n)
+	q.stats.Messages++
+	q.stats.Bytes += length
+	return nil
+}
+
+// Reads a record, and its raw bytes.  Call with q.mu held.
+func (q *Queue) read(r recordRef) (Record, []byte, error) {
+	f, err := os.Open(q.segmentPath(r.segment))
+	if err != nil {
+		return Record{}, nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, r.size)
+	if _, err := f.ReadAt(b, r.offset); err != nil {
+		return Record{}, b, err
+	}
+	_, record, err := decodeRecord(b)
+	return record, b, err
+}
+
+/*
+ * Messages left as one file each, <seconds>_<seqn>, by the old queue
+ * format are moved into the log, in order.
+ */
+func (q *Queue) importFiles() error {
+	type oldFile struct {
+		name string
+		when int64
+		seqn int
+	}
+	var old []oldFile
+
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		parts := strings.SplitN(f.Name(), "_", 2)
+		if len(parts) != 2 || f.IsDir() {
+			continue
+		}
+		when, err1 := strconv.ParseInt(parts[0], 10, 64)
+		seqn, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		old = append(old, oldFile{name: f.Name(), when: when, seqn: seqn})
+	}
+	sort.Slice(old, func(i, j int) bool {
+		return old[i].when < old[j].when || (old[i].when == old[j].when && old[i].seqn < old[j].seqn)
+	})
+
+	for _, f := range old {
+		path := filepath.Join(q.dir, f.name)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := q.append(f.when, f.seqn, Normal, nil, string(content)); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if len(old) > 0 {
+		return q.saveCursor()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package logQueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reopen(t *testing.T, q *Queue, opts Options) (*Queue, *gate) {
+	t.Helper()
+	q.Close()
+	return retentionQueue(t, q.dir, opts)
+}
+
+// more than 100 in one second still go out in order
+func TestWALOrder(t *testing.T) {
+	q, g := retentionQueue(t, t.TempDir(), Options{})
+	var expected []string
+	for i := 0; i < 150; i++ {
+		m := fmt.Sprintf("m%d", i)
+		expected = append(expected, m)
+		if err := q.Log(m); err != nil {
+			t.Fatalf("Logging failed on message %d, err = %v", i, err)
+		}
+	}
+	if sent := g.flush(t, q); sent != strings.Join(expected, ",") {
+		t.Fatalf("Sent out of order: %s", sent)
+	}
+}
+
+// what was sent before a restart is not sent again
+func TestWALCursor(t *testing.T) {
+	q, g := retentionQueue(t, t.TempDir(), Options{})
+	logN(t, q, 3)
+	g.flush(t, q)
+	g.mu.Lock()
+	g.open = false
+	g.mu.Unlock()
+	q.Log("m3")
+	q.Log("m4")
+
+	q, g = reopen(t, q, Options{})
+	if stats := q.Stats(); stats.Messages != 2 {
+		t.Fatalf("Found %d messages after restart", stats.Messages)
+	}
+	if sent := g.flush(t, q); sent != "m3,m4" {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+// a summary owed is still owed after a restart
+func TestWALSummaryRestart(t *testing.T) {
+	opts := Options{MaxMessages: 2, Policy: Summarize}
+	q, _ := retentionQueue(t, t.TempDir(), opts)
+	logN(t, q, 4)
+
+	q, g := reopen(t, q, opts)
+	if sent := g.flush(t, q); sent != "3 messages dropped,m3" {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+func corrupt(t *testing.T, q *Queue, f func(b []byte) []byte) {
+	t.Helper()
+	path := q.segmentPath(q.writeSegment)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, f(b), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func quarantined(t *testing.T, q *Queue) int {
+	t.Helper()
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, quarantineDirName))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// a bad record in the middle is set aside, and those after it are sent
+func TestWALCorrupt(t *testing.T) {
+	q, _ := retentionQueue(t, t.TempDir(), Options{})
+	logN(t, q, 3)
+	second := q.index[1]
+	q.Close()
+	corrupt(t, q, func(b []byte) []byte {
+		b[second.offset+second.size-1] ^= 0xff
+		return b
+	})
+
+	q, g := reopen(t, q, Options{})
+	if stats := q.Stats(); stats.Messages != 2 || stats.Quarantined != 1 || stats.QuarantinedBytes != second.size {
+		t.Fatalf("Stats %+v", stats)
+	}
+	if n := quarantined(t, q); n != 1 {
+		t.Fatalf("%d files quarantined", n)
+	}
+	if sent := g.flush(t, q); sent != "m0,m2" {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+// a record cut short by a crash is set aside, and appending goes on
+func TestWALTorn(t *testing.T) {
+	q, _ := retentionQueue(t, t.TempDir(), Options{})
+	logN(t, q, 2)
+	q.Close()
+	corrupt(t, q, func(b []byte) []byte {
+		return append(b, encodeRecord(1, 0, Normal, nil, "torn")[:headerSize+3]...)
+	})
+
+	q, g := reopen(t, q, Options{})
+	if stats := q.Stats(); stats.Messages != 2 || stats.Quarantined != 1 {
+		t.Fatalf("Stats %+v", stats)
+	}
+	q.Log("m2")
+	if sent := g.flush(t, q); sent != "m0,m1,m2" {
+		t.Fatalf("Sent %s", sent)
+	}
+
+	q, g = reopen(t, q, Options{})
+	if stats := q.Stats(); stats.Messages != 0 || stats.Quarantined != 0 {
+		t.Fatalf("Stats after restart %+v", stats)
+	}
+}
+
+// segments are started as they fill, and deleted once sent
+func TestWALCompaction(t *testing.T) {
+	q, g := retentionQueue(t, t.TempDir(), Options{SegmentBytes: 100})
+	logN(t, q, 20)
+	segments, err := q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 5 {
+		t.Fatalf("Only %d segments", len(segments))
+	}
+
+	g.flush(t, q)
+	segments, err = q.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("%d segments left after sending", len(segments))
+	}
+	q.Log("m20")
+	if sent := g.flush(t, q); !strings.HasSuffix(sent, ",m19,m20") {
+		t.Fatalf("Sent %s", sent)
+	}
+}
+
+// messages in the old one file each format are taken in
+func TestWALImport(t *testing.T) {
+	dir := t.TempDir()
+	now := int64(time.Since(epoch) / time.Second)
+	for _, seqn := range []int{100, 11, 2} {
+		name := filepath.Join(dir, fmt.Sprintf("%d_%02d", now, seqn))
+		if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("old%d", seqn)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, g := retentionQueue(t, dir, Options{})
+	if sent := g.flush(t, q); sent != "old2,old11,old100" {
+		t.Fatalf("Sent %s", sent)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*_*"))
+	if err != nil || len(files) != 0 {
+		t.Fatalf("Old files left: %v", files)
+	}
+}
@@ -0,0 +1,237 @@
+package logSimple
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/iotgo/logQueue"
+)
+
+func TestAttributes(t *testing.T) {
+	m := Message{When: 1234, Seqn: 2, MsgNum: 3, MsgVal: -4, Human: "Test"}
+	a := m.attributes(testLocation, testService)
+	if a["Location"] != testLocation || a["Service"] != testService {
+		t.Fatalf("attributes %v", a)
+	}
+	got, err := parseAttributes(a)
+	if err != nil {
+		t.Fatalf("parseAttributes: %v", err)
+	}
+	if got != m {
+		t.Fatalf("parseAttributes got %+v, want %+v", got, m)
+	}
+
+	delete(a, "MsgNum")
+	if _, err := parseAttributes(a); !errors.Is(err, errMalformed) {
+		t.Fatalf("parseAttributes without MsgNum got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	l, err := NewFile(path, testLocation, testService)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := l.Log(context.Background(), Message{When: 10, Seqn: i, MsgNum: 1, Human: "Test"}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); n++ {
+		var a map[string]string
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+		m, err := parseAttributes(a)
+		if err != nil || m.Seqn != n || m.When != 10 {
+			t.Fatalf("line %d is %+v, %v", n, m, err)
+		}
+	}
+	if n != 2 {
+		t.Fatalf("got %d lines, want 2", n)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var got map[string]string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	if _, err := NewHTTP("ftp://example.com/", testLocation, testService); err == nil {
+		t.Fatal("NewHTTP took an ftp URL")
+	}
+	l, err := NewHTTP(server.URL, testLocation, testService)
+	if err != nil {
+		t.Fatalf("NewHTTP: %v", err)
+	}
+	defer l.Close()
+
+	if err := l.Log(context.Background(), Message{MsgNum: 5, Human: "Test"}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if got["MsgNum"] != "5" || got["Service"] != testService || got["IOTTime"] == "0" {
+		t.Fatalf("server got %v", got)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := l.Log(context.Background(), Message{MsgNum: 6}); err == nil || logQueue.IsPermanent(err) {
+		t.Fatalf("Log on a 503 got %v", err)
+	}
+
+	// refused, so not to be tried again
+	status = http.StatusBadRequest
+	if err := l.Log(context.Background(), Message{MsgNum: 7}); !logQueue.IsPermanent(err) {
+		t.Fatalf("Log on a 400 got %v", err)
+	}
+}
+
+// A broker that is down at the start is no reason not to log
+func TestMQTTDown(t *testing.T) {
+	start := time.Now()
+	l, err := NewMQTT("tcp://127.0.0.1:1", "logs/test", testLocation, testService)
+	if err != nil {
+		t.Fatalf("NewMQTT: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("NewMQTT waited %v for the broker", time.Since(start))
+	}
+
+	s, err := NewSpooled(l, t.TempDir(), logQueue.Options{RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewSpooled: %v", err)
+	}
+	defer s.Close()
+	if err := s.Log(context.Background(), Message{MsgNum: 1, Human: "Outage"}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if stats := s.Stats(); stats.Messages != 1 {
+		t.Fatalf("queued %d messages, want 1", stats.Messages)
+	}
+}
+
+// A Logger that fails while down, and remembers what it sent
+type fakeLogger struct {
+	mu   sync.Mutex
+	down bool
+	sent []Message
+}
+
+func (f *fakeLogger) Log(ctx context.Context, m Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("down")
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func (f *fakeLogger) Close() error { return nil }
+
+func (f *fakeLogger) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *fakeLogger) messages() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.sent...)
+}
+
+func TestSpooledRefused(t *testing.T) {
+	l := &SpooledLogger{logger: &refusingLogger{refuse: 1}}
+	records := make([]logQueue.Record, 3)
+	for i := range records {
+		records[i].Attributes = (&Message{When: 1, MsgNum: i}).attributes("", "")
+	}
+	results := l.sendQueued(context.Background(), records)
+	if results[0] != nil || !logQueue.IsPermanent(results[1]) || results[2] != nil {
+		t.Fatalf("sendQueued got %v", results)
+	}
+}
+
+// A Logger that refuses one message number for good
+type refusingLogger struct {
+	refuse int
+}
+
+func (r *refusingLogger) Log(ctx context.Context, m Message) error {
+	if m.MsgNum == r.refuse {
+		return logQueue.Permanent(errors.New("refused"))
+	}
+	return nil
+}
+
+func (r *refusingLogger) Close() error { return nil }
+
+func TestSpooled(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeLogger{down: true}
+	l, err := NewSpooled(fake, t.TempDir(), logQueue.Options{RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewSpooled: %v", err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := l.Log(ctx, Message{When: int64(100 + i), MsgNum: i, Human: "Outage"}); err != nil {
+			t.Fatalf("Log %d: %v", i, err)
+		}
+	}
+	if s := l.Stats(); s.Messages != 3 {
+		t.Fatalf("queued %d messages, want 3", s.Messages)
+	}
+	if len(fake.messages()) != 0 {
+		t.Fatal("sent while down")
+	}
+
+	fake.setDown(false)
+	if err := l.Log(ctx, Message{When: 200, MsgNum: 9, Human: "Back"}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if err := l.queue.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	sent := fake.messages()
+	if len(sent) != 4 {
+		t.Fatalf("sent %d messages, want 4", len(sent))
+	}
+	if sent[0].MsgNum != 9 {
+		t.Fatalf("first sent %+v, want the live message", sent[0])
+	}
+	for i, m := range sent[1:] {
+		if m.MsgNum != i || m.When != int64(100+i) || m.Human != "Outage" {
+			t.Fatalf("queued message %d came out as %+v", i, m)
+		}
+	}
+	if s := l.Stats(); s.Messages != 0 {
+		t.Fatalf("%d messages still queued", s.Messages)
+	}
+}
@@ -0,0 +1,43 @@
+package logSimple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type FileLogger struct {
+	mu       sync.Mutex
+	f        *os.File
+	location string
+	service  string
+}
+
+// Logs to a local file, appending each message as a line of JSON
+func NewFile(path, location, service string) (*FileLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open log file %s: %v", path, err)
+	}
+	return &FileLogger{f: f, location: location, service: service}, nil
+}
+
+func (l *FileLogger) Log(ctx context.Context, m Message) error {
+	line, err := json.Marshal(m.attributes(l.location, l.service))
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+func (l *FileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
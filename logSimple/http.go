@@ -0,0 +1,64 @@
+package logSimple
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/duke1swd/iotgo/logQueue"
+)
+
+type HTTPLogger struct {
+	url      string
+	client   *http.Client
+	location string
+	service  string
+}
+
+// Logs by POSTing each message to a URL, as a JSON object of its attributes
+func NewHTTP(u, location, service string) (*HTTPLogger, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("Bad log URL %s: %v", u, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Log URL %s is not http or https", u)
+	}
+	return &HTTPLogger{url: u, client: &http.Client{}, location: location, service: service}, nil
+}
+
+func (l *HTTPLogger) Log(ctx context.Context, m Message) error {
+	body, err := json.Marshal(m.attributes(l.location, l.service))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// the message was refused, and would be again
+		return logQueue.Permanent(fmt.Errorf("%s answered %s", l.url, resp.Status))
+	default:
+		return fmt.Errorf("%s answered %s", l.url, resp.Status)
+	}
+}
+
+func (l *HTTPLogger) Close() error {
+	l.client.CloseIdleConnections()
+	return nil
+}
@@ -1,89 +1,122 @@
 package logSimple
 
+/*
+ * Log messages go to a Logger.  There is one for each way of shipping
+ * them off:
+ *	NewPubSub	Google Pub/Sub, where the logger program picks them up
+ *	NewMQTT		an MQTT broker
+ *	NewFile		a local file, one JSON object a line
+ *	NewHTTP		a POST of a JSON object to a URL
+ * and two that go in front of another:
+ *	NewSpooled	puts it in front of a logQueue, so that messages it
+ *			cannot send now are sent later, not lost
+ *	NewSuppressing	collapses runs of the same message into a summary
+ *
+ * LogInit and Log are the old interface, a Pub/Sub Logger kept in the
+ * package.
+ */
+
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"strconv"
 	"time"
-
-	"cloud.google.com/go/pubsub"
 )
 
 const defaultProjectID = "iot-services-274518" // This is the IOT Services project
 const topicID = "Logs"                         // Log messages go to topic Logs.
 
 /*
-  Log messages have these attributes.
-   - A time the message was recorded, which may be signicantly before it was published.
-   - A sequence number.  Messages published at the same time may have different sequence numbers.
-   - A message number.  Basically, what event is being logged
-   - An integer value that may contain relevant information about the logged event.
-   - A string that is the human readable version of the message.
+Log messages have these attributes.
+  - A time the message was recorded, which may be signicantly before it was published.
+  - A sequence number.  Messages published at the same time may have different sequence numbers.
+  - A message number.  Basically, what event is being logged
+  - An integer value that may contain relevant information about the logged event.
+  - A string that is the human readable version of the message.
 */
+type Message struct {
+	When   int64 // seconds since the epoch.  Zero is now.
+	Seqn   int
+	MsgNum int
+	MsgVal int
+	Human  string
+}
+
+type Logger interface {
+	// Sends a message.  An error means it was not sent.
+	Log(ctx context.Context, m Message) error
+	Close() error
+}
 
 var (
-	topic     *pubsub.Topic
-	location  string
-	service   string
-	projectID string
-	epoch     time.Time
+	epoch        time.Time
+	defaultLog   Logger
+	errMalformed = errors.New("logSimple: malformed message")
 )
 
-// we need a context, a location, and a service
-func LogInit(ctx context.Context, l, s string) {
-	var err error
+func init() {
+	epoch, _ = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
+}
 
-	location = l
-	service = s
+// Seconds since the epoch
+func Now() int64 {
+	return int64(time.Since(epoch) / time.Second)
+}
 
-	projectID := os.Getenv("PROJECTID")
-	if len(projectID) < 1 {
-		projectID = defaultProjectID
+/*
+ * The message as attributes, as the logger program wants them.  Fills
+ * in When if it is zero.
+ */
+func (m *Message) attributes(location, service string) map[string]string {
+	if m.When == 0 {
+		m.When = Now()
 	}
-
-	epoch, err = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
-	if err != nil {
-		log.Fatalf("logSimple: Failed to get epoch. Err = %v", err)
+	return map[string]string{
+		"Service":  service,
+		"Location": location,
+		"IOTTime":  strconv.FormatInt(m.When, 10),
+		"Seqn":     strconv.Itoa(m.Seqn),
+		"MsgNum":   strconv.Itoa(m.MsgNum),
+		"MsgVal":   strconv.Itoa(m.MsgVal),
+		"Human":    m.Human,
 	}
+}
 
-	// Creates a client.
-	log.Printf("ProjectID = %s\n", projectID)
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatalf("logSimple: Failed to create client: %v", err)
+// The message back from its attributes
+func parseAttributes(a map[string]string) (m Message, err error) {
+	if m.When, err = strconv.ParseInt(a["IOTTime"], 10, 64); err != nil {
+		return m, fmt.Errorf("%w: IOTTime %q", errMalformed, a["IOTTime"])
 	}
-
-	// Get a pointer to the topic object
-	topic = client.Topic(topicID)
-	if topic == nil {
-		log.Fatalf("logSimple: Failed to get topic: %s", topicID)
+	if m.Seqn, err = strconv.Atoi(a["Seqn"]); err != nil {
+		return m, fmt.Errorf("%w: Seqn %q", errMalformed, a["Seqn"])
 	}
-
-	// request to send messages immediately
-	topic.PublishSettings.CountThreshold = 1
+	if m.MsgNum, err = strconv.Atoi(a["MsgNum"]); err != nil {
+		return m, fmt.Errorf("%w: MsgNum %q", errMalformed, a["MsgNum"])
+	}
+	if m.MsgVal, err = strconv.Atoi(a["MsgVal"]); err != nil {
+		return m, fmt.Errorf("%w: MsgVal %q", errMalformed, a["MsgVal"])
+	}
+	m.Human = a["Human"]
+	return m, nil
 }
 
-func Log(ctx context.Context, seqn, msgNum, msgVal int, human string) bool {
-	var myMsg pubsub.Message
-
-	when := int64(time.Since(epoch) / time.Second)
+// we need a context, a location, and a service
+func LogInit(ctx context.Context, l, s string) {
+	var err error
 
-	myMsg.Attributes = make(map[string]string)
-	myMsg.Attributes["Service"] = service
-	myMsg.Attributes["Location"] = location
-	myMsg.Attributes["IOTTime"] = strconv.FormatInt(when, 10)
-	myMsg.Attributes["Seqn"] = strconv.Itoa(seqn)
-	myMsg.Attributes["MsgNum"] = strconv.Itoa(msgNum)
-	myMsg.Attributes["MsgVal"] = strconv.Itoa(msgVal)
-	myMsg.Attributes["Human"] = human
+	defaultLog, err = NewPubSub(ctx, "", l, s)
+	if err != nil {
+		log.Fatalf("logSimple: %v", err)
+	}
+}
 
-	result := topic.Publish(ctx, &myMsg)
-	_, err := result.Get(ctx)
+func Log(ctx context.Context, seqn, msgNum, msgVal int, human string) bool {
+	err := defaultLog.Log(ctx, Message{Seqn: seqn, MsgNum: msgNum, MsgVal: msgVal, Human: human})
 	if err != nil {
-		log.Printf("logSimple: publish get result returns error: %v", err)
+		log.Printf("logSimple: %v", err)
 		return false
 	}
-
 	return true
 }
@@ -2,29 +2,104 @@ package logSimple
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/duke1swd/iotgo/pubsubTest"
 )
 
 const testLocation = "Home"
 const testService = "logSimpleTest"
+const testProjectID = "test-project"
 
 func TestLog(t *testing.T) {
 	ctx := context.Background()
 
-	LogInit(ctx, testLocation, testService)
+	srv := pubsubTest.New(t)
+	srv.Topic(testProjectID, topicID, "Test")
+	client, err := srv.Client(ctx, testProjectID)
+	if err != nil {
+		t.Fatalf("Cannot create client: %v", err)
+	}
+	defaultLog, err = NewPubSubClient(client, testLocation, testService)
+	if err != nil {
+		t.Fatalf("NewPubSubClient: %v", err)
+	}
+	defer defaultLog.Close()
 
 	seqn := 0
 	msgNum := 1
 	msgVal := 1
 	human := "Test Message The First"
-	if ! Log(ctx, seqn, msgNum, msgVal, human) {
+	if !Log(ctx, seqn, msgNum, msgVal, human) {
 		t.Fatal("Log 1 Failed")
 	}
 
 	seqn = 1
 	msgVal = 2
 	human = "Test Message The Second"
-	if ! Log(ctx, seqn, msgNum, msgVal, human) {
+	if !Log(ctx, seqn, msgNum, msgVal, human) {
 		t.Fatal("Log 2 Failed")
 	}
+
+	got := receive(t, srv, "Test", 2)
+	for i, m := range got {
+		if m.Location != testLocation || m.Service != testService || m.Seqn != i || m.MsgVal != i+1 {
+			t.Fatalf("message %d came as %+v", i, m)
+		}
+	}
+}
+
+type received struct {
+	Message
+	Location, Service string
+}
+
+// Receives n messages from subscription subID, in order of Seqn
+func receive(t *testing.T, srv *pubsubTest.Server, subID string, n int) []received {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := srv.Client(ctx, testProjectID)
+	if err != nil {
+		t.Fatalf("Cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	var (
+		mu  sync.Mutex
+		got = make([]received, n)
+		bad error
+	)
+	count := 0
+	err = client.Subscription(subID).Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		m, err := parseAttributes(msg.Attributes)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil && (m.Seqn < 0 || m.Seqn >= n) {
+			err = errMalformed
+		}
+		if err != nil {
+			bad = err
+		} else {
+			got[m.Seqn] = received{m, msg.Attributes["Location"], msg.Attributes["Service"]}
+		}
+		if count++; count == n || bad != nil {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if bad != nil {
+		t.Fatalf("Received a bad message: %v", bad)
+	}
+	if count != n {
+		t.Fatalf("Received %d messages, want %d", count, n)
+	}
+	return got
 }
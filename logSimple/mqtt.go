@@ -0,0 +1,68 @@
+package logSimple
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const mqttTimeout = 10 * time.Second
+
+type MQTTLogger struct {
+	client   mqtt.Client
+	topic    string
+	location string
+	service  string
+}
+
+/*
+ * Logs to an MQTT broker, such as tcp://192.168.1.13:1883.  Each
+ * message is published to topic as a JSON object of its attributes.
+ * The broker need not be up yet; the client keeps trying, and until it
+ * connects Log fails.
+ */
+func NewMQTT(broker, topic, location, service string) (*MQTTLogger, error) {
+	if _, err := url.Parse(broker); err != nil {
+		return nil, fmt.Errorf("Bad broker %s: %v", broker, err)
+	}
+	opts := mqtt.NewClientOptions().AddBroker(broker).
+		SetClientID(fmt.Sprintf("logSimple-%s-%s-%d", location, service, time.Now().UnixNano())).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	client := mqtt.NewClient(opts)
+
+	// with ConnectRetry, this is done only once connected
+	client.Connect()
+	return &MQTTLogger{client: client, topic: topic, location: location, service: service}, nil
+}
+
+func (l *MQTTLogger) Log(ctx context.Context, m Message) error {
+	payload, err := json.Marshal(m.attributes(l.location, l.service))
+	if err != nil {
+		return err
+	}
+	if !l.client.IsConnectionOpen() {
+		return fmt.Errorf("Not connected to broker")
+	}
+
+	token := l.client.Publish(l.topic, 1, false, payload)
+	timer := time.NewTimer(mqttTimeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-timer.C:
+		return fmt.Errorf("Timed out publishing to broker")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *MQTTLogger) Close() error {
+	l.client.Disconnect(250)
+	return nil
+}
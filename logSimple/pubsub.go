@@ -0,0 +1,72 @@
+package logSimple
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+)
+
+type PubSubLogger struct {
+	client   *pubsub.Client
+	topic    *pubsub.Topic
+	location string
+	service  string
+}
+
+/*
+ * Logs to the Logs topic in Google Pub/Sub.  An empty projectID is
+ * $PROJECTID, then the IOT Services project.
+ */
+func NewPubSub(ctx context.Context, projectID, location, service string) (*PubSubLogger, error) {
+	if projectID == "" {
+		projectID = os.Getenv("PROJECTID")
+	}
+	if projectID == "" {
+		projectID = defaultProjectID
+	}
+
+	// Creates a client.
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create client for project %s: %v", projectID, err)
+	}
+
+	l, err := NewPubSubClient(client, location, service)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+/*
+ * Logs to the Logs topic with a client of one's own making, such as one
+ * of a test server.  The logger closes the client when it is closed.
+ */
+func NewPubSubClient(client *pubsub.Client, location, service string) (*PubSubLogger, error) {
+	// Get a pointer to the topic object
+	topic := client.Topic(topicID)
+	if topic == nil {
+		return nil, fmt.Errorf("Failed to get topic: %s", topicID)
+	}
+
+	// request to send messages immediately
+	topic.PublishSettings.CountThreshold = 1
+
+	return &PubSubLogger{client: client, topic: topic, location: location, service: service}, nil
+}
+
+func (l *PubSubLogger) Log(ctx context.Context, m Message) error {
+	result := l.topic.Publish(ctx, &pubsub.Message{Attributes: m.attributes(l.location, l.service)})
+	if _, err := result.Get(ctx); err != nil {
+		return fmt.Errorf("publish get result returns error: %v", err)
+	}
+	return nil
+}
+
+func (l *PubSubLogger) Close() error {
+	l.topic.Stop()
+	return l.client.Close()
+}
@@ -0,0 +1,103 @@
+package logSimple
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/duke1swd/iotgo/logCatalog"
+)
+
+/*
+ * The MsgNum of the summary a SuppressingLogger sends in place of
+ * repeats.  Its MsgVal is how many were suppressed.
+ */
+const RepeatMsgNum = logCatalog.Repeated
+
+/*
+ * A Logger in front of another that collapses runs of messages with the
+ * same MsgNum.  The first of a run is sent, the rest are counted, and a
+ * summary, "repeated N times over T", is sent when the run ends, every
+ * heartbeat while it goes on, and at Close.
+ */
+type SuppressingLogger struct {
+	mu        sync.Mutex
+	logger    Logger
+	heartbeat int64 // seconds, zero for never
+
+	running bool
+	msgNum  int
+	since   int64   // when the run, or its last summary, was sent
+	count   int     // repeats since then
+	last    Message // the last of them
+}
+
+/*
+ * Suppresses repeats on their way to logger.  A heartbeat of zero sends
+ * the summary only when the run ends.
+ */
+func NewSuppressing(logger Logger, heartbeat time.Duration) *SuppressingLogger {
+	return &SuppressingLogger{logger: logger, heartbeat: int64(heartbeat / time.Second)}
+}
+
+func (l *SuppressingLogger) Log(ctx context.Context, m Message) error {
+	if m.When == 0 {
+		m.When = Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.running && m.MsgNum == l.msgNum {
+		l.count++
+		l.last = m
+		if l.heartbeat > 0 && m.When-l.since >= l.heartbeat {
+			return l.summarize(ctx)
+		}
+		return nil
+	}
+
+	// a new run
+	err := l.summarize(ctx)
+	l.running = true
+	l.msgNum = m.MsgNum
+	l.since = m.When
+	if err2 := l.logger.Log(ctx, m); err == nil {
+		err = err2
+	}
+	return err
+}
+
+/*
+ * Sends the summary of the repeats so far, if there are any.  The
+ * summary takes the time and sequence number of the last of them.
+ */
+func (l *SuppressingLogger) summarize(ctx context.Context) error {
+	if l.count == 0 {
+		return nil
+	}
+	over := time.Duration(l.last.When-l.since) * time.Second
+	e, _ := logCatalog.Lookup("", RepeatMsgNum)
+	s := Message{
+		When:   l.last.When,
+		Seqn:   l.last.Seqn,
+		MsgNum: RepeatMsgNum,
+		MsgVal: l.count,
+		Human:  e.Human(l.last.Human, l.count, over),
+	}
+	l.since = l.last.When
+	l.count = 0
+	return l.logger.Log(ctx, s)
+}
+
+// Sends the summary of any repeats, and closes the Logger behind
+func (l *SuppressingLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.summarize(context.Background())
+	if err2 := l.logger.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
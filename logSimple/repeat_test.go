@@ -0,0 +1,72 @@
+package logSimple
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSuppressing(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeLogger{}
+	l := NewSuppressing(fake, 0)
+
+	log := func(when int64, msgNum int) {
+		if err := l.Log(ctx, Message{When: when, MsgNum: msgNum, Human: "Test"}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	log(100, 0)
+	log(200, 0)
+	log(300, 0)
+	log(400, 3)
+	log(500, 3)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := []Message{
+		{When: 100, MsgNum: 0, Human: "Test"},
+		{When: 300, MsgNum: RepeatMsgNum, MsgVal: 2, Human: `"Test" repeated 2 times over 3m20s`},
+		{When: 400, MsgNum: 3, Human: "Test"},
+		{When: 500, MsgNum: RepeatMsgNum, MsgVal: 1, Human: `"Test" repeated 1 times over 1m40s`},
+	}
+	sent := fake.messages()
+	if len(sent) != len(want) {
+		t.Fatalf("sent %+v, want %+v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("message %d is %+v, want %+v", i, sent[i], want[i])
+		}
+	}
+}
+
+func TestSuppressingHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeLogger{}
+	l := NewSuppressing(fake, time.Hour)
+
+	// one every ten minutes, for four hours and a bit
+	for when := int64(0); when <= 4*3600+600; when += 600 {
+		if err := l.Log(ctx, Message{When: when + 1, MsgNum: 0}); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+
+	sent := fake.messages()
+	if len(sent) != 5 {
+		t.Fatalf("sent %d messages, want 5: %+v", len(sent), sent)
+	}
+	for i, m := range sent[1:] {
+		if m.MsgNum != RepeatMsgNum || m.MsgVal != 6 || m.When != int64(i+1)*3600+1 {
+			t.Fatalf("heartbeat %d is %+v", i, m)
+		}
+	}
+
+	// the last ten minutes come out at Close
+	l.Close()
+	if sent = fake.messages(); len(sent) != 6 || sent[5].MsgVal != 1 {
+		t.Fatalf("at Close sent %+v", sent[5:])
+	}
+}
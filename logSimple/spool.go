@@ -0,0 +1,92 @@
+package logSimple
+
+import (
+	"context"
+
+	"github.com/duke1swd/iotgo/logQueue"
+)
+
+/*
+ * A Logger in front of a logQueue.  A message the Logger cannot send is
+ * queued, with the time it was logged, and sent when the Logger works
+ * again.
+ */
+type SpooledLogger struct {
+	logger Logger
+	queue  *logQueue.Queue
+}
+
+/*
+ * Spools what logger cannot send in a logQueue in dir.  The queue's
+ * options, but for Dir and the sender, may be given in opts.
+ */
+func NewSpooled(logger Logger, dir string, opts logQueue.Options) (*SpooledLogger, error) {
+	l := &SpooledLogger{logger: logger}
+
+	opts.Dir = dir
+	opts.Sender = nil
+	opts.BatchSender = l.sendQueued
+	q, err := logQueue.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	l.queue = q
+	return l, nil
+}
+
+/*
+ * Sends a message, or failing that queues it.  An error means it was
+ * neither sent nor queued.
+ */
+func (l *SpooledLogger) Log(ctx context.Context, m Message) error {
+	if m.When == 0 {
+		m.When = Now()
+	}
+	if err := l.logger.Log(ctx, m); err != nil {
+		return l.queue.LogRecord(m.attributes("", ""), "")
+	}
+
+	// the way is open, so send what was queued
+	l.queue.Kick()
+	return nil
+}
+
+// What has been queued, and dropped
+func (l *SpooledLogger) Stats() logQueue.Stats {
+	return l.queue.Stats()
+}
+
+/*
+ * Sends queued messages with the Logger, until it fails.  One it refuses
+ * for good is a dead letter, and the rest are still sent.
+ */
+func (l *SpooledLogger) sendQueued(ctx context.Context, records []logQueue.Record) []error {
+	var failed error
+
+	results := make([]error, len(records))
+	for i, r := range records {
+		if failed != nil {
+			// the rest would fail too
+			results[i] = failed
+			continue
+		}
+		m, err := parseAttributes(r.Attributes)
+		if err != nil {
+			results[i] = logQueue.Permanent(err)
+			continue
+		}
+		results[i] = l.logger.Log(ctx, m)
+		if !logQueue.IsPermanent(results[i]) {
+			failed = results[i]
+		}
+	}
+	return results
+}
+
+func (l *SpooledLogger) Close() error {
+	err := l.queue.Close()
+	if err2 := l.logger.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
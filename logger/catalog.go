@@ -0,0 +1,93 @@
+/*
+ * What the message catalog says about a message: whether it is wanted,
+ * whether it is a heartbeat, how to say it, and whether to raise the
+ * alarm over it.
+ */
+
+package main
+
+import (
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/duke1swd/iotgo/logCatalog"
+)
+
+// The catalog entry for the message, if it has one
+func catalogEntry(attributes map[string]string) (logCatalog.Entry, bool) {
+	msgNum, err := strconv.Atoi(attributes["MsgNum"])
+	if err != nil {
+		return logCatalog.Entry{}, false
+	}
+	return logCatalog.Lookup(attributes["Service"], msgNum)
+}
+
+// Messages below minSeverity are not logged.  Those not in the catalog are.
+func wanted(attributes map[string]string) bool {
+	e, ok := catalogEntry(attributes)
+	return !ok || e.Severity >= minSeverity
+}
+
+/*
+ * Heartbeats say only that all is well, so repeats of them are
+ * overwritten.  A message not in the catalog is a heartbeat if it is
+ * number 0, as all were before there was a catalog.
+ */
+func heartbeat(attributes map[string]string) bool {
+	e, ok := catalogEntry(attributes)
+	if !ok {
+		return attributes["MsgNum"] == "0"
+	}
+	return e.Heartbeat
+}
+
+/*
+ * Fills in the human readable version of a message sent without one, if
+ * the catalog knows it.  Formats that need more than the message value
+ * come out as the message name.
+ */
+func render(attributes map[string]string) {
+	if attributes["Human"] != "" {
+		return
+	}
+	e, ok := catalogEntry(attributes)
+	if !ok {
+		return
+	}
+	switch strings.Count(e.Format, "%") {
+	case 0:
+		attributes["Human"] = e.Format
+	case 1:
+		if msgVal, err := strconv.Atoi(attributes["MsgVal"]); err == nil && strings.Contains(e.Format, "%d") {
+			attributes["Human"] = e.Human(msgVal)
+			return
+		}
+		fallthrough
+	default:
+		attributes["Human"] = e.Name
+	}
+}
+
+/*
+ * Messages at alertSeverity or above are handed to alertCommand, if
+ * there is one, on its standard input.
+ */
+func alert(attributes map[string]string, line string) {
+	if alertCommand == "" {
+		return
+	}
+	e, ok := catalogEntry(attributes)
+	if !ok || e.Severity < alertSeverity {
+		return
+	}
+
+	go func() {
+		cmd := exec.Command("/bin/sh", "-c", alertCommand)
+		cmd.Stdin = strings.NewReader(attributes["Location"] + "_" + attributes["Service"] + " " + e.Severity.String() + ": " + line)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Logger: Alert command failed. err = %v, output = %q", err, out)
+		}
+	}()
+}
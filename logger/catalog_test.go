@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/duke1swd/iotgo/logCatalog"
+)
+
+func TestCatalog(t *testing.T) {
+	noChange := map[string]string{"Service": "IPUpdate", "MsgNum": "0", "MsgVal": "300"}
+	if !heartbeat(noChange) {
+		t.Fatal("IPUpdate 0 is not a heartbeat")
+	}
+	render(noChange)
+	if noChange["Human"] != "No IP Address Change" {
+		t.Fatalf("rendered %q", noChange["Human"])
+	}
+
+	down := map[string]string{"Service": "ISPMonitor", "MsgNum": "2", "MsgVal": "60"}
+	if heartbeat(down) {
+		t.Fatal("ISPMonitor 2 is a heartbeat")
+	}
+	render(down)
+	if down["Human"] != "Internet Down for 60 seconds" {
+		t.Fatalf("rendered %q", down["Human"])
+	}
+
+	startup := map[string]string{"Service": "IPUpdate", "MsgNum": "1", "Human": "Startup. IP Address: 10.0.0.1"}
+	render(startup)
+	if startup["Human"] != "Startup. IP Address: 10.0.0.1" {
+		t.Fatalf("render changed %q", startup["Human"])
+	}
+	delete(startup, "Human")
+	render(startup)
+	if startup["Human"] != "Startup" {
+		t.Fatalf("rendered %q", startup["Human"])
+	}
+
+	unknown := map[string]string{"Service": "Other", "MsgNum": "0"}
+	if !heartbeat(unknown) {
+		t.Fatal("message 0 of an unknown service is not a heartbeat")
+	}
+
+	minSeverity = logCatalog.Warning
+	defer func() { minSeverity = logCatalog.Debug }()
+	if wanted(noChange) || !wanted(down) || !wanted(unknown) {
+		t.Fatal("wanted is wrong at warning")
+	}
+}
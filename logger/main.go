@@ -1,6 +1,6 @@
 /*
  * This program subscribes to log messages at google
- * and puts them into a flat file.
+ * and puts them into flat files, one a day unless ROTATE says otherwise.
  * The log messages are in a CSV format, begining with a timestamp and ending with the human readable version.
  */
 
@@ -8,32 +8,49 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/duke1swd/iotgo/logCatalog"
 )
 
 const defaultSubID = "Logger"
 const defaultProjectID = "iot-services-274518" // This is the IOT Services project
 const defaultLogDirectory = "/var/log"
 const defaultFiltering = true
+const defaultMinSeverity = "debug"
+const defaultAlertSeverity = "error"
+const defaultRotation = rotateDaily
+const defaultRotateSize = 10 << 20 // bytes
+const defaultRetainDays = 90
 
 var (
 	subID          string
 	projectID      string
 	logDirectory   string
 	filtering      bool
+	minSeverity    logCatalog.Severity
+	alertSeverity  logCatalog.Severity
+	alertCommand   string
+	rotation       string
+	rotateBytes    int64
+	retention      time.Duration
 	mu             sync.Mutex
 	epoch          time.Time
 	repeatFilter   map[string]bool  = make(map[string]bool)
 	lastMessagePos map[string]int64 = make(map[string]int64)
 	lastDay        map[string]int   = make(map[string]int)
+
+	// How the client is made.  Tests make one of a fake server.
+	newClient = func(ctx context.Context, projectID string) (*pubsub.Client, error) {
+		return pubsub.NewClient(ctx, projectID)
+	}
 )
 
 func init() {
@@ -67,6 +84,52 @@ func init() {
 		filtering = true
 	}
 
+	s := os.Getenv("MINSEVERITY")
+	if len(s) < 1 {
+		s = defaultMinSeverity
+	}
+	minSeverity, err = logCatalog.ParseSeverity(s)
+	if err != nil {
+		log.Fatalf("Logger: MINSEVERITY: %v", err)
+	}
+
+	s = os.Getenv("ALERTSEVERITY")
+	if len(s) < 1 {
+		s = defaultAlertSeverity
+	}
+	alertSeverity, err = logCatalog.ParseSeverity(s)
+	if err != nil {
+		log.Fatalf("Logger: ALERTSEVERITY: %v", err)
+	}
+
+	alertCommand = os.Getenv("ALERTCMD")
+
+	rotation = strings.ToLower(os.Getenv("ROTATE"))
+	switch rotation {
+	case "":
+		rotation = defaultRotation
+	case rotateNone, rotateDaily, rotateSize:
+	default:
+		log.Fatalf("Logger: ROTATE %s is not none, daily or size", rotation)
+	}
+
+	rotateBytes = defaultRotateSize
+	if s = os.Getenv("ROTATESIZE"); len(s) > 0 {
+		rotateBytes, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || rotateBytes < 1 {
+			log.Fatalf("Logger: ROTATESIZE %s is not a number of bytes", s)
+		}
+	}
+
+	retainDays := defaultRetainDays
+	if s = os.Getenv("RETAINDAYS"); len(s) > 0 {
+		retainDays, err = strconv.Atoi(s)
+		if err != nil || retainDays < 0 {
+			log.Fatalf("Logger: RETAINDAYS %s is not a number of days", s)
+		}
+	}
+	retention = time.Duration(retainDays) * 24 * time.Hour
+
 	epoch, err = time.Parse("2006-Jan-02 MST", "2018-Nov-01 EDT")
 	if err != nil {
 		log.Fatalf("Logger: Failed to get epoch. Err = %v", err)
@@ -78,15 +141,11 @@ func main() {
 	ctx, cfx := context.WithCancel(context.Background())
 	defer cfx()
 
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatalf("Logger: Failed to create client: %v", err)
-	}
+	go sweeper(ctx)
 
-	sub := client.Subscription(subID)
-	err = sub.Receive(ctx, processor)
+	err := receive(ctx)
 	if err != nil {
-		log.Fatalf("Logger: Receive returns error: %v", err)
+		log.Fatalf("Logger: %v", err)
 	}
 
 	// wait forever
@@ -96,9 +155,32 @@ func main() {
 	}
 }
 
+/*
+ * Receives log messages, and logs them, until ctx is done
+ */
+func receive(ctx context.Context) error {
+	client, err := newClient(ctx, projectID)
+	if err != nil {
+		return fmt.Errorf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	sub := client.Subscription(subID)
+	err = sub.Receive(ctx, processor)
+	if err != nil {
+		return fmt.Errorf("Receive returns error: %v", err)
+	}
+	return nil
+}
+
 func processor(ctx context.Context, msg *pubsub.Message) {
 	msg.Ack()
 
+	if !wanted(msg.Attributes) {
+		return
+	}
+	render(msg.Attributes)
+
 	// format the time stamp
 	iottime, err := strconv.Atoi(msg.Attributes["IOTTime"])
 	if err != nil {
@@ -109,8 +191,10 @@ func processor(ctx context.Context, msg *pubsub.Message) {
 
 	// format the attributes for the log file
 	formattedMsg += msgFormat(msg.Attributes) + "\n"
+	alert(msg.Attributes, formattedMsg)
 
-	// make the log file name.  Should be for the form "Location_Service"
+	// make the log file name.  Should be for the form "Location_Service",
+	// and a date when rotating
 	logFileName, ok := msg.Attributes["Location"]
 	if ok {
 		logFileName += "_"
@@ -122,37 +206,40 @@ func processor(ctx context.Context, msg *pubsub.Message) {
 	}
 	logFileName += s
 
-	fullFileName := filepath.Join(logDirectory, logFileName)
-
 	// now, append the line to the file
 	// but first, global lock to ensure we don't mess up the file
 	mu.Lock()
 	defer mu.Unlock()
 
-	// If this is message zero, and it is a repeat, discard it.
+	// what is remembered of the file is kept by its full name, so it
+	// starts over in a new one
+	fullFileName := logFilePath(logFileName, stampTime)
+	_, err = os.Stat(fullFileName)
+	newFile := os.IsNotExist(err)
+
+	// If this is a heartbeat, and it is a repeat, discard it.
 	append := true
 	if filtering {
-		msgNumS, ok := msg.Attributes["MsgNum"]
+		_, ok := msg.Attributes["MsgNum"]
 		if ok {
-			msgNum, err := strconv.Atoi(msgNumS)
-			if err == nil && msgNum == 0 {
-				// we overwrite repeated copies of log message #0, but keep at least 1 a day.
+			if heartbeat(msg.Attributes) {
+				// we overwrite repeated heartbeats, but keep at least 1 a day.
 				day := stampTime.Day()
-				priorDay, _ := lastDay[logFileName]
-				b, ok := repeatFilter[logFileName]
+				priorDay, _ := lastDay[fullFileName]
+				b, ok := repeatFilter[fullFileName]
 				if day == priorDay && ok && b {
 					append = false
 				}
-				repeatFilter[logFileName] = true
-				lastDay[logFileName] = day
+				repeatFilter[fullFileName] = true
+				lastDay[fullFileName] = day
 			} else {
-				repeatFilter[logFileName] = false
+				repeatFilter[fullFileName] = false
 			}
 		}
 	}
 
-	pos, ok := lastMessagePos[logFileName]
-	if !ok {
+	pos, ok := lastMessagePos[fullFileName]
+	if !ok || newFile {
 		append = true
 	}
 
@@ -179,10 +266,22 @@ func processor(ctx context.Context, msg *pubsub.Message) {
 		}
 	}
 
-	lastMessagePos[logFileName] = pos
+	lastMessagePos[fullFileName] = pos
 	_, err = f.WriteString(formattedMsg)
 	if err != nil {
 		log.Printf("Logger: Error writing to file %s.  err = %v\n", fullFileName, err)
 		return
 	}
+
+	// an overwritten line may have been longer
+	if !append {
+		err = f.Truncate(pos + int64(len(formattedMsg)))
+		if err != nil {
+			log.Printf("Logger: Cannot truncate log file %s. err = %v", fullFileName, err)
+		}
+	}
+
+	if newFile {
+		sweep(time.Now())
+	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duke1swd/iotgo/logCatalog"
+	"github.com/duke1swd/iotgo/logSimple"
+	"github.com/duke1swd/iotgo/pubsubTest"
+)
+
+const testProjectID = "test-project"
+
+/*
+ * Publishes through logSimple to a fake server, and checks what the
+ * logger makes of it in the log file.
+ */
+func TestReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := pubsubTest.New(t)
+	srv.Topic(testProjectID, "Logs", subID)
+
+	projectID = testProjectID
+	logDirectory = t.TempDir()
+	newClient = srv.Client
+	filtering = true
+	rotation = rotateDaily
+	retention = 0
+
+	done := make(chan error)
+	go func() { done <- receive(ctx) }()
+
+	client, err := srv.Client(ctx, testProjectID)
+	if err != nil {
+		t.Fatalf("Cannot create client: %v", err)
+	}
+	l, err := logSimple.NewPubSubClient(client, "Home", "IPUpdate")
+	if err != nil {
+		t.Fatalf("NewPubSubClient: %v", err)
+	}
+	defer l.Close()
+
+	logFile := filepath.Join(logDirectory, "Home_IPUpdate."+epoch.Format(dayStamp))
+	line := func(when int64, rest string) string {
+		return epoch.Add(time.Duration(when)*time.Second).Format("Mon Jan 2 15:04:05 2006") + ", " + rest
+	}
+
+	// Each message, and the lines of the log file once it is in
+	steps := []struct {
+		m    logSimple.Message
+		want []string
+	}{
+		{
+			logSimple.Message{When: 100, MsgNum: logCatalog.IPUpdateStartup, Human: "Startup. IP Address: 10.0.0.1"},
+			[]string{line(100, "100,0,1,0,Startup. IP Address: 10.0.0.1")},
+		},
+		{
+			logSimple.Message{When: 400, MsgNum: logCatalog.IPUpdateNoChange, MsgVal: 300, Human: "No IP Address Change"},
+			[]string{
+				line(100, "100,0,1,0,Startup. IP Address: 10.0.0.1"),
+				line(400, "400,0,0,300,No IP Address Change"),
+			},
+		},
+		{
+			// a repeated heartbeat overwrites the last
+			logSimple.Message{When: 700, MsgNum: logCatalog.IPUpdateNoChange, MsgVal: 600, Human: "No IP Address Change"},
+			[]string{
+				line(100, "100,0,1,0,Startup. IP Address: 10.0.0.1"),
+				line(700, "700,0,0,600,No IP Address Change"),
+			},
+		},
+		{
+			// one sent without the human readable version gets it from the catalog
+			logSimple.Message{When: 1000, Seqn: 1, MsgNum: logCatalog.IPUpdateGetFailed, MsgVal: 900},
+			[]string{
+				line(100, "100,0,1,0,Startup. IP Address: 10.0.0.1"),
+				line(700, "700,0,0,600,No IP Address Change"),
+				line(1000, "1000,1,2,900,Failed to get IP address"),
+			},
+		},
+	}
+
+	for i, step := range steps {
+		if err := l.Log(ctx, step.m); err != nil {
+			t.Fatalf("step %d: Log: %v", i, err)
+		}
+
+		var got []string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			b, _ := os.ReadFile(logFile)
+			got = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			if strings.Join(got, "\n") == strings.Join(step.want, "\n") {
+				break
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Fatalf("step %d: log file is\n%s\nwant\n%s", i, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+}
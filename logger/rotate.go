@@ -0,0 +1,239 @@
+/*
+ * Rotation and retention of the log files.
+ *
+ * With daily rotation, each message goes to the file of the day of its
+ * IOTTime, "Location_Service.2006-01-02", so messages sent late, as after
+ * an outage, land on the day they happened.  With rotation by size, a
+ * file is written until it is ROTATESIZE bytes, and is named for the
+ * IOTTime of its first message, "Location_Service.2006-01-02T15-04-05".
+ * With no rotation, there is just "Location_Service".
+ *
+ * The newest file of each is left as it is.  The others are gzipped
+ * once nothing has been written to them for a while, so a backlog of
+ * late messages is compressed all at once, not a message at a time.
+ * If RETAINDAYS is not zero, they are removed once they are that many
+ * days old by their names.
+ *
+ * Only the files of a Location_Service the logger has written to since
+ * it started are touched, not others that may be in the directory.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	rotateNone  = "none"
+	rotateDaily = "daily"
+	rotateSize  = "size"
+
+	dayStamp  = "2006-01-02"
+	sizeStamp = "2006-01-02T15-04-05"
+
+	quietTime     = 10 * time.Minute // unwritten this long, a file may be compressed
+	sweepInterval = time.Hour
+)
+
+var (
+	activeFile = make(map[string]string) // the newest file of each Location_Service, when rotating by size
+	written    = make(map[string]bool)   // each Location_Service written to
+)
+
+/*
+ * The file to write a message to, the one logged at stampTime to
+ * logFileName
+ */
+func logFilePath(logFileName string, stampTime time.Time) string {
+	written[logFileName] = true
+
+	base := filepath.Join(logDirectory, logFileName)
+	switch rotation {
+	case rotateDaily:
+		return base + "." + stampTime.Format(dayStamp)
+	case rotateSize:
+		path, ok := activeFile[logFileName]
+		if ok {
+			info, err := os.Stat(path)
+			if err != nil || info.Size() < rotateBytes {
+				return path
+			}
+		}
+		path = base + "." + stampTime.Format(sizeStamp)
+		activeFile[logFileName] = path
+		return path
+	}
+	return base
+}
+
+/*
+ * Splits the name of a rotated log file into the Location_Service it is
+ * for and the time in its name.
+ */
+func rotatedName(name string) (logFileName string, stamp time.Time, ok bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	dot := strings.LastIndex(name, ".")
+	if dot < 1 {
+		return "", stamp, false
+	}
+	s := name[dot+1:]
+	for _, layout := range []string{dayStamp, sizeStamp} {
+		if len(s) != len(layout) {
+			continue
+		}
+		if t, err := time.ParseInLocation(layout, s, epoch.Location()); err == nil {
+			return name[:dot], t, true
+		}
+	}
+	return "", stamp, false
+}
+
+/*
+ * Gzips all but the newest log file of each, if they are quiet, and
+ * removes those past retention.  Called when a log file is started, and
+ * every sweepInterval.  Call with mu held.
+ */
+func sweep(now time.Time) {
+	if rotation == rotateNone {
+		return
+	}
+
+	entries, err := os.ReadDir(logDirectory)
+	if err != nil {
+		log.Printf("Logger: Cannot read log directory %s. err = %v", logDirectory, err)
+		return
+	}
+
+	type rotated struct {
+		name    string
+		stamp   time.Time
+		modTime time.Time
+	}
+	files := make(map[string][]rotated)
+	newest := make(map[string]time.Time)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		logFileName, stamp, ok := rotatedName(e.Name())
+		if !ok || !written[logFileName] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files[logFileName] = append(files[logFileName], rotated{e.Name(), stamp, info.ModTime()})
+		if stamp.After(newest[logFileName]) {
+			newest[logFileName] = stamp
+		}
+	}
+
+	for logFileName, rs := range files {
+		for _, r := range rs {
+			path := filepath.Join(logDirectory, r.name)
+			switch {
+			case retention > 0 && now.Sub(r.stamp) > retention:
+				forget(strings.TrimSuffix(path, ".gz"))
+				if err := os.Remove(path); err != nil {
+					log.Printf("Logger: Cannot remove old log file %s. err = %v", path, err)
+				}
+			case strings.HasSuffix(r.name, ".gz"):
+			case r.stamp.Equal(newest[logFileName]) || path == activeFile[logFileName]:
+			case !r.modTime.Before(now.Add(-quietTime)):
+				// still being written, as by late messages
+			default:
+				forget(path)
+				if err := compress(path); err != nil {
+					log.Printf("Logger: Cannot compress log file %s. err = %v", path, err)
+				}
+			}
+		}
+	}
+}
+
+// Sweeps every sweepInterval, until ctx is done
+func sweeper(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			mu.Lock()
+			sweep(now)
+			mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Drops what is remembered of a log file that is no longer written
+func forget(path string) {
+	delete(lastMessagePos, path)
+	delete(repeatFilter, path)
+	delete(lastDay, path)
+}
+
+/*
+ * Gzips path into path.gz and removes it.  If path.gz is there already,
+ * as when messages came in late for a day already compressed, they are
+ * added to it.
+ */
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gzPath := path + ".gz"
+	tmpPath := gzPath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer out.Close()
+
+	// what was compressed before comes first
+	old, err := os.Open(gzPath)
+	if err == nil {
+		_, err = io.Copy(out, old)
+		old.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot copy %s: %v", gzPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, gzPath); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const day = 24 * 60 * 60
+
+// Starts the logger over, writing to a new directory
+func rotateSetup(t *testing.T, how string) {
+	logDirectory = t.TempDir()
+	rotation = how
+	retention = 0
+	filtering = true
+	repeatFilter = make(map[string]bool)
+	lastMessagePos = make(map[string]int64)
+	lastDay = make(map[string]int)
+	activeFile = make(map[string]string)
+	written = make(map[string]bool)
+}
+
+// Sweeps as if the files were quiet
+func sweepQuiet() {
+	mu.Lock()
+	defer mu.Unlock()
+	sweep(time.Now().Add(2 * quietTime))
+}
+
+// Logs a message from IPUpdate at Home
+func logAt(when int64, msgNum, msgVal int) {
+	processor(context.Background(), &pubsub.Message{Attributes: map[string]string{
+		"Location": "Home",
+		"Service":  "IPUpdate",
+		"IOTTime":  strconv.FormatInt(when, 10),
+		"Seqn":     "0",
+		"MsgNum":   strconv.Itoa(msgNum),
+		"MsgVal":   strconv.Itoa(msgVal),
+	}})
+}
+
+// The names of the files in the log directory
+func logFiles(t *testing.T) []string {
+	entries, err := os.ReadDir(logDirectory)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The MsgVals of the lines of a log file, gzipped or not
+func msgVals(t *testing.T, name string) string {
+	f, err := os.Open(filepath.Join(logDirectory, name))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Read %s: %v", name, err)
+	}
+
+	var vals []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) < 5 {
+			t.Fatalf("%s has line %q", name, line)
+		}
+		vals = append(vals, fields[4])
+	}
+	return strings.Join(vals, " ")
+}
+
+func TestRotateDaily(t *testing.T) {
+	rotateSetup(t, rotateDaily)
+	day0 := "Home_IPUpdate." + epoch.Format(dayStamp)
+	day1 := "Home_IPUpdate." + epoch.Add(day*time.Second).Format(dayStamp)
+
+	// a repeated heartbeat overwrites the last, even if shorter
+	logAt(100, 0, 1000)
+	logAt(200, 0, 2)
+	if got := msgVals(t, day0); got != "2" {
+		t.Fatalf("day 0 has %s", got)
+	}
+
+	// the next day's heartbeat starts the next day's file, and the
+	// last is compressed once it is quiet
+	logAt(day+100, 0, 3)
+	if got := strings.Join(logFiles(t), " "); got != day0+" "+day1 {
+		t.Fatalf("files are %s", got)
+	}
+	sweepQuiet()
+	if got := strings.Join(logFiles(t), " "); got != day0+".gz "+day1 {
+		t.Fatalf("files are %s", got)
+	}
+	if got := msgVals(t, day1); got != "3" {
+		t.Fatalf("day 1 has %s", got)
+	}
+
+	// late messages go to their own day, and are compressed together
+	logAt(300, 3, 4)
+	logAt(400, 3, 5)
+	if got := strings.Join(logFiles(t), " "); got != day0+" "+day0+".gz "+day1 {
+		t.Fatalf("files are %s", got)
+	}
+	if got := msgVals(t, day0); got != "4 5" {
+		t.Fatalf("day 0 late has %s", got)
+	}
+	sweepQuiet()
+	if got := strings.Join(logFiles(t), " "); got != day0+".gz "+day1 {
+		t.Fatalf("files are %s", got)
+	}
+	if got := msgVals(t, day0+".gz"); got != "2 4 5" {
+		t.Fatalf("day 0 has %s", got)
+	}
+
+	// and do not stop the heartbeat overwriting in the day they are not
+	logAt(day+200, 0, 6)
+	if got := msgVals(t, day1); got != "6" {
+		t.Fatalf("day 1 has %s", got)
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	rotateSetup(t, rotateSize)
+	rotateBytes = 100
+
+	for i := 1; i <= 5; i++ {
+		logAt(int64(i*100), 2, i)
+	}
+	sweepQuiet()
+
+	stamp := func(when int64) string {
+		return "Home_IPUpdate." + epoch.Add(time.Duration(when)*time.Second).Format(sizeStamp)
+	}
+	want := []string{stamp(100) + ".gz", stamp(300) + ".gz", stamp(500)}
+	if got := logFiles(t); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files are %v, want %v", got, want)
+	}
+	for i, vals := range []string{"1 2", "3 4", "5"} {
+		if got := msgVals(t, want[i]); got != vals {
+			t.Fatalf("%s has %s, want %s", want[i], got, vals)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	rotateSetup(t, rotateDaily)
+	retention = 90 * day * time.Second
+	written["Home_IPUpdate"] = true
+
+	now := time.Now().In(epoch.Location())
+	old := "Home_IPUpdate." + now.AddDate(0, 0, -200).Format(dayStamp) + ".gz"
+	recent := "Home_IPUpdate." + now.AddDate(0, 0, -10).Format(dayStamp)
+	today := "Home_IPUpdate." + now.Format(dayStamp)
+	other := "syslog.1"
+	// not written by the logger, so left alone however old
+	foreign := "foo.log.2020-01-01"
+	notYet := "Home_Other." + now.AddDate(0, 0, -200).Format(dayStamp)
+	for _, name := range []string{old, recent, today, other, foreign, notYet} {
+		if err := os.WriteFile(filepath.Join(logDirectory, name), []byte("x,x,x,x,1\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	sweepQuiet()
+	want := []string{recent + ".gz", today, other, foreign, notYet}
+	sort.Strings(want)
+	if got := logFiles(t); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files are %v, want %v", got, want)
+	}
+}
@@ -25,11 +25,17 @@ func init() {
 
 var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
-	payload := string(msg.Payload())
+	fmt.Printf("%s: %s\n", topic, decode(topic, string(msg.Payload())))
+}
+
+// The payload as it should be displayed
+func decode(topic, payload string) string {
 	if strings.Contains(topic, "firmware") {
 		payload = "(suppressed)"
 	}
-	if strings.Contains(topic, "time") && !strings.Contains(topic, "uptime") {
+	// only the last level, so environment/IOTtime/$offset is not taken for a time
+	last := topic[strings.LastIndex(topic, "/")+1:]
+	if strings.Contains(last, "time") && !strings.Contains(last, "uptime") {
 		t, err := strconv.ParseInt(payload, 10, 64)
 		if err == nil {
 			etime := epoch.Add(time.Duration(t) * time.Second)
@@ -37,7 +43,7 @@ var f mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 			payload += " (" + etime.Format("Mon Jan 2 15:04:05 -0700 EST 2006") + ")"
 		}
 	}
-	fmt.Printf("%s: %s\n", topic, payload)
+	return payload
 }
 
 func main() {
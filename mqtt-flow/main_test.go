@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const timeFormat = "Mon Jan 2 15:04:05 -0700 EST 2006"
+
+/*
+ * A time encoded as the automation daemon publishes it on
+ * environment/IOTtime decodes back to the same time.
+ */
+func TestTimeRoundTrip(t *testing.T) {
+	for _, when := range []time.Time{
+		epoch,
+		time.Date(2026, time.October, 19, 3, 1, 2, 0, time.UTC),
+		time.Date(2026, time.December, 25, 12, 0, 0, 0, time.UTC),
+	} {
+		payload := strconv.FormatInt(int64(when.Sub(epoch)/time.Second), 10)
+		shown := decode("environment/IOTtime", payload)
+
+		open := strings.Index(shown, " (")
+		if open < 0 || !strings.HasSuffix(shown, ")") || shown[:open] != payload {
+			t.Fatalf("%s decoded to %s", payload, shown)
+		}
+		got, err := time.Parse(timeFormat, shown[open+2:len(shown)-1])
+		if err != nil {
+			t.Fatalf("Cannot parse %s: %v", shown, err)
+		}
+		if !got.Equal(when) {
+			t.Fatalf("%v went out as %s and came back %v", when, payload, got)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var tests = []struct {
+		topic   string
+		payload string
+		want    string
+	}{
+		{"environment/IOTtime/$offset", "-14400", "-14400"},
+		{"environment/IOTtime/$dst", "3600", "3600"},
+		{"environment/IOTtime/$local", "2026-10-18T23:01:02", "2026-10-18T23:01:02"},
+		{"devices/environ-0001/$stats/uptime", "3600", "3600"},
+		{"devices/environ-0001/$fw/firmware", "abc", "(suppressed)"},
+		{"devices/environ-0001/lux/time-last-update", "junk", "junk"},
+	}
+
+	for _, test := range tests {
+		if got := decode(test.topic, test.payload); got != test.want {
+			t.Fatalf("%s: %s decoded to %s, expected %s", test.topic, test.payload, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * An in-process fake of Google Pub/Sub, for tests that publish or
+ * receive log messages without credentials or a network.
+ */
+
+package pubsubTest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type Server struct {
+	srv *pstest.Server
+	t   testing.TB
+}
+
+// Starts a fake server, stopped when the test is done
+func New(t testing.TB) *Server {
+	s := &Server{srv: pstest.NewServer(), t: t}
+	t.Cleanup(func() { s.srv.Close() })
+	return s
+}
+
+/*
+ * A new client of the fake server.  Its connection is closed when the
+ * test is done, so whoever is given it may close the client or not.
+ */
+func (s *Server) Client(ctx context.Context, projectID string) (*pubsub.Client, error) {
+	conn, err := grpc.Dial(s.srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	s.t.Cleanup(func() { conn.Close() })
+	return pubsub.NewClient(ctx, projectID, option.WithGRPCConn(conn))
+}
+
+/*
+ * Creates topicID in projectID, and a subscription to it for each of
+ * subIDs.
+ */
+func (s *Server) Topic(projectID, topicID string, subIDs ...string) {
+	ctx := context.Background()
+	client, err := s.Client(ctx, projectID)
+	if err != nil {
+		s.t.Fatalf("Cannot create client: %v", err)
+	}
+	defer client.Close()
+
+	topic, err := client.CreateTopic(ctx, topicID)
+	if err != nil {
+		s.t.Fatalf("Cannot create topic %s: %v", topicID, err)
+	}
+	for _, subID := range subIDs {
+		_, err := client.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{Topic: topic})
+		if err != nil {
+			s.t.Fatalf("Cannot create subscription %s: %v", subID, err)
+		}
+	}
+}
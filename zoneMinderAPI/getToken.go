@@ -3,81 +3,155 @@ package zoneMinderAPI
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/go-resty/resty/v2"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
+	"time"
+
+	"github.com/go-resty/resty/v2"
 )
 
-var (
-	Token string
-	Client *resty.Client
+const (
+	DefaultURL                 = "http://192.168.1.99:108/zm"
+	DefaultCredentialsFileName = "/usr/local/credentials/zoneminderapi.json"
+	defaultTimeout             = 10 * time.Second
 )
 
-const defaultCredentialsFileName = "/usr/local/credentials/zoneminderapi.json"
+/*
+ * A connection to one ZoneMinder server.
+ *
+ * Nothing is sent to the server until it is needed.  The client logs in
+ * on its first request, and again whenever the server says the token has
+ * expired.
+ */
+type ClientType struct {
+	baseURL string
+	user    string
+	pass    string
+	token   string
+	rest    *resty.Client
+}
 
-func init() {
-	var (
-		authRes         interface{}
-		credentialsJson interface{}
-	)
+// A client for the ZoneMinder at baseURL, e.g. http://host/zm
+func New(baseURL, user, pass string) *ClientType {
+	c := new(ClientType)
+	c.baseURL = baseURL
+	c.user = user
+	c.pass = pass
+	c.rest = resty.New().SetTimeout(defaultTimeout)
+	return c
+}
 
-	credentialsFileName := os.Getenv("CREDENTIALS")
+/*
+ * A client using the user and pass in a json credentials file.
+ * An empty file name means the file named by $CREDENTIALS, or the default.
+ */
+func NewFromCredentials(baseURL, credentialsFileName string) (*ClientType, error) {
+	var credentials struct {
+		User *string `json:"user"`
+		Pass *string `json:"pass"`
+	}
+
+	if len(credentialsFileName) < 1 {
+		credentialsFileName = os.Getenv("CREDENTIALS")
+	}
 	if len(credentialsFileName) < 1 {
-		credentialsFileName = defaultCredentialsFileName
+		credentialsFileName = DefaultCredentialsFileName
 	}
 
-	// Read the credentials
 	credentialsBytes, err := ioutil.ReadFile(credentialsFileName)
 	if err != nil {
-		log.Fatalf("Cannot read ZoneMinder API credentials file %s\n", credentialsFileName)
+		return nil, fmt.Errorf("Cannot read ZoneMinder API credentials file %s: %v", credentialsFileName, err)
 	}
 
-	// Parse them
-	err = json.Unmarshal(credentialsBytes, &credentialsJson)
+	err = json.Unmarshal(credentialsBytes, &credentials)
 	if err != nil {
-		log.Fatalf("Cannot parse ZoneMinder API credentials in file %s\n",
-			credentialsFileName)
+		return nil, fmt.Errorf("Cannot parse ZoneMinder API credentials in file %s: %v", credentialsFileName, err)
 	}
-	m, ok := credentialsJson.(map[string]interface{})
-	if !ok {
-		log.Fatalf("json credentials in ZoneMinder API credentials file %s not a map\n",
-			credentialsFileName)
+	if credentials.User == nil {
+		return nil, fmt.Errorf("ZoneMinder API credentials file %s lacks user information", credentialsFileName)
 	}
-
-	user, ok := m["user"].(string)
-	if !ok {
-		log.Fatalf("json credentials ZoneMinder API credentials file %s lacks user information\n",
-			credentialsFileName)
+	if credentials.Pass == nil {
+		return nil, fmt.Errorf("ZoneMinder API credentials file %s lacks password information", credentialsFileName)
 	}
 
-	pass, ok := m["pass"].(string)
-	if !ok {
-		log.Fatalf("json credentials ZoneMinder API credentials file %s lacks password information\n",
-			credentialsFileName)
-	}
+	return New(baseURL, *credentials.User, *credentials.Pass), nil
+}
 
-	Client = resty.New()
+// Log in, getting a new token
+func (c *ClientType) Login() error {
+	var authRes struct {
+		AccessToken string `json:"access_token"`
+	}
 
-	resp, err := Client.R().
+	resp, err := c.rest.R().
 		SetHeader("Content-Type", "application/json").
 		SetQueryParams(map[string]string{
-			"user": user,
-			"pass": pass,
+			"user": c.user,
+			"pass": c.pass,
 		}).
 		SetResult(&authRes).
-		Get("http://192.168.1.99:108/zm/api/host/login.json")
+		Get(c.baseURL + "/api/host/login.json")
 
 	if err != nil {
-		fmt.Println("Cannot log in to ZoneMinder")
-		fmt.Println("  Error = ", err)
-		fmt.Println("  Resp  = ", resp)
-		os.Exit(1)
+		return fmt.Errorf("Cannot log in to ZoneMinder: %v", err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("Cannot log in to ZoneMinder: %s", resp.Status())
+	}
+	if authRes.AccessToken == "" {
+		return fmt.Errorf("Cannot log in to ZoneMinder: no access token in response")
 	}
 
-	Token = authRes.(map[string]interface{})["access_token"].(string)
+	c.token = authRes.AccessToken
+	return nil
 }
 
-func GetToken() string {
-	return Token
+// The current token, logging in if need be
+func (c *ClientType) GetToken() (string, error) {
+	if c.token == "" {
+		if err := c.Login(); err != nil {
+			return "", err
+		}
+	}
+	return c.token, nil
+}
+
+/*
+ * Make an API request, logging in first if need be.  If the token has
+ * expired, log in again and make the request once more.
+ */
+func (c *ClientType) request(method, path string) (map[string]interface{}, error) {
+	var res map[string]interface{}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.GetToken()
+		if err != nil {
+			return nil, err
+		}
+
+		res = nil
+		resp, err := c.rest.R().
+			SetHeader("Content-Type", "application/json").
+			SetQueryParams(map[string]string{
+				"token": token,
+			}).
+			SetResult(&res).
+			Execute(method, c.baseURL+path)
+
+		if err != nil {
+			return nil, fmt.Errorf("ZoneMinder %s %s: %v", method, path, err)
+		}
+		if resp.StatusCode() == http.StatusUnauthorized && attempt == 0 {
+			c.token = ""
+			continue
+		}
+		if resp.IsError() {
+			return nil, fmt.Errorf("ZoneMinder %s %s: %s", method, path, resp.Status())
+		}
+		if res == nil {
+			return nil, fmt.Errorf("ZoneMinder %s %s: empty response", method, path)
+		}
+		return res, nil
+	}
 }
@@ -1,29 +1,163 @@
 package zoneMinderAPI
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
-	"fmt"
 )
 
-func TestInit(t *testing.T) {
-	s := GetToken()
+/*
+ * A fake ZoneMinder.  It knows the Home and Away run states, and
+ * hands out tokens that expire when the test says so.
+ */
+type fakeZoneMinder struct {
+	logins  int
+	token   string
+	state   string
+	changes []string
+}
+
+func (z *fakeZoneMinder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	path := strings.TrimPrefix(r.URL.Path, "/zm/api/")
+	w.Header().Set("Content-Type", "application/json")
+
+	if path == "host/login.json" {
+		if q.Get("user") != "admin" || q.Get("pass") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		z.logins++
+		z.token = "token" + string(rune('0'+z.logins))
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": z.token})
+		return
+	}
+
+	if z.token == "" || q.Get("token") != z.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case path == "configs.json":
+		json.NewEncoder(w).Encode(map[string]interface{}{"configs": []interface{}{}})
+	case path == "states.json":
+		json.NewEncoder(w).Encode(map[string]interface{}{"states": []string{"Home", "Away"}})
+	case strings.HasPrefix(path, "states/change/") && r.Method == "POST":
+		state := strings.TrimSuffix(strings.TrimPrefix(path, "states/change/"), ".json")
+		if state != "Home" && state != "Away" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		z.state = state
+		z.changes = append(z.changes, state)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": "ok"})
+	case strings.HasPrefix(path, "states/view/"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"state": z.state})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testServer(t *testing.T) (*fakeZoneMinder, *ClientType) {
+	z := new(fakeZoneMinder)
+	server := httptest.NewServer(z)
+	t.Cleanup(server.Close)
+	return z, New(server.URL+"/zm", "admin", "secret")
+}
+
+func TestLogin(t *testing.T) {
+	_, c := testServer(t)
+	s, err := c.GetToken()
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
 	if s == "" {
 		t.Errorf("token is empty")
 	}
+
+	c.pass = "wrong"
+	if err := c.Login(); err == nil {
+		t.Fatal("Login with a bad password should fail")
+	}
 }
 
 func TestListConfigs(t *testing.T) {
-	_ = GetConfigs()
+	_, c := testServer(t)
+	if _, err := c.GetConfigs(); err != nil {
+		t.Fatalf("GetConfigs failed: %v", err)
+	}
 }
 
 func TestGetStates(t *testing.T) {
-	response := GetStates()
-	states := response["states"]
-	fmt.Println(states)
+	_, c := testServer(t)
+	response, err := c.GetStates()
+	if err != nil {
+		t.Fatalf("GetStates failed: %v", err)
+	}
+	if states, ok := response["states"].([]interface{}); !ok || len(states) != 2 {
+		t.Fatalf("Unexpected states %v", response["states"])
+	}
 }
 
-func TestGetState(t *testing.T) {
-	s := GetState("Home")
+func TestChangeState(t *testing.T) {
+	z, c := testServer(t)
 
-	fmt.Println(s)
+	if err := c.ChangeState("Away"); err != nil {
+		t.Fatalf("ChangeState failed: %v", err)
+	}
+	s, err := c.GetState("Away")
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if s["state"] != "Away" {
+		t.Fatalf("Expected state Away, got %v", s["state"])
+	}
+
+	if err := c.ChangeState("Vacation"); err == nil {
+		t.Fatal("Changing to an unknown state should fail")
+	}
+
+	// the token expires, so the client logs in again
+	z.token = "expired"
+	if err := c.ChangeState("Home"); err != nil {
+		t.Fatalf("ChangeState after token expired failed: %v", err)
+	}
+	if z.logins != 2 || z.state != "Home" {
+		t.Fatalf("Expected 2 logins and state Home, got %d and %s", z.logins, z.state)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zoneminder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "zoneminderapi.json")
+
+	ioutil.WriteFile(fileName, []byte(`{"user": "admin", "pass": "secret"}`), 0600)
+	c, err := NewFromCredentials("http://localhost/zm", fileName)
+	if err != nil {
+		t.Fatalf("NewFromCredentials failed: %v", err)
+	}
+	if c.user != "admin" || c.pass != "secret" {
+		t.Fatalf("Read user %s pass %s", c.user, c.pass)
+	}
+
+	ioutil.WriteFile(fileName, []byte(`{"user": "admin"}`), 0600)
+	if _, err := NewFromCredentials("http://localhost/zm", fileName); err == nil {
+		t.Fatal("Credentials without a password should be rejected")
+	}
+
+	os.Setenv("CREDENTIALS", filepath.Join(dir, "missing.json"))
+	defer os.Unsetenv("CREDENTIALS")
+	if _, err := NewFromCredentials("http://localhost/zm", ""); err == nil {
+		t.Fatal("Missing credentials file should be rejected")
+	}
 }